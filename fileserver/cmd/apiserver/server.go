@@ -5,7 +5,11 @@ import (
 	"log"
 
 	"yadro.com/course/internal/apiserver"
+	"yadro.com/course/internal/cluster"
+	"yadro.com/course/internal/replication"
+	"yadro.com/course/internal/s3"
 	"yadro.com/course/internal/storage"
+	"yadro.com/course/internal/webhook"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
@@ -16,11 +20,16 @@ const (
 )
 
 var (
-	configPath string
+	configPath    string
+	rotateKeyPath string
+	heal          bool
 )
 
 func init() {
 	flag.StringVar(&configPath, "config", defaultConfigPath, "Path to config file")
+	flag.StringVar(&rotateKeyPath, "rotate-key", "",
+		"Rewrap data keys with the master key from this file and exit, the server must be stopped")
+	flag.BoolVar(&heal, "heal", false, "Rebuild lost shards of erasure coded files and exit")
 	flag.Parse()
 }
 
@@ -29,7 +38,7 @@ func getConfig() *apiserver.Config {
 
 	if err := cleanenv.ReadConfig(configPath, config); err == nil {
 		if config.BindPort != "" {
-			log.Printf("Using configuration: %s", config)
+			log.Printf("Using configuration: %+v", config)
 			return config
 		}
 	}
@@ -39,13 +48,123 @@ func getConfig() *apiserver.Config {
 	return apiserver.DefaultConfig()
 }
 
+func rotateKey(buckets *storage.Buckets) {
+	key, err := storage.LoadMasterKey(rotateKeyPath)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+
+	count, err := buckets.RewrapKeys(key)
+	if err != nil {
+		log.Fatalf("Failed to rotate master key after %d data keys: %v", count, err)
+	}
+	log.Printf("Rewrapped %d data keys with master key %s, use %s as the encryption key_file now",
+		count, key.ID(), rotateKeyPath)
+}
+
+func healShards(buckets *storage.Buckets) {
+	report, err := buckets.Heal()
+	if err != nil {
+		log.Fatalf("Failed to heal erasure coded files: %v", err)
+	}
+	log.Printf("Checked %d shard sets, rebuilt %d shards, removed %d unreferenced sets",
+		report.Sets, report.Rebuilt, report.Removed)
+	if len(report.Unrecoverable) > 0 {
+		log.Fatalf("Lost more shards than there is parity in %d sets: %v", len(report.Unrecoverable), report.Unrecoverable)
+	}
+}
+
+func startWebhooks(config *webhook.Config, buckets *storage.Buckets) {
+	dir, err := buckets.ServiceDir("webhooks")
+	if err != nil {
+		log.Panicf("Error while creating webhook queue: %v", err)
+	}
+	dispatcher, err := webhook.NewDispatcher(config, dir)
+	if err != nil {
+		log.Panicf("Error while loading webhooks: %v", err)
+	}
+	buckets.Subscribe(dispatcher.Notify)
+	dispatcher.Start()
+}
+
+func startReplication(config *replication.Config, buckets *storage.Buckets) *replication.Primary {
+	dir, err := buckets.ServiceDir("replication")
+	if err != nil {
+		log.Panicf("Error while creating replication state: %v", err)
+	}
+	primary, err := replication.NewPrimary(config, buckets, dir)
+	if err != nil {
+		log.Panicf("Error while loading replication state: %v", err)
+	}
+	primary.Run()
+	return primary
+}
+
+func startCluster(config *cluster.Config, buckets *storage.Buckets) *cluster.Cluster {
+	dir, err := buckets.ServiceDir("cluster")
+	if err != nil {
+		log.Panicf("Error while creating cluster state: %v", err)
+	}
+	c, err := cluster.New(config, buckets, dir)
+	if err != nil {
+		log.Panicf("Error while joining the cluster: %v", err)
+	}
+	c.Run()
+	return c
+}
+
 func main() {
 	config := getConfig()
-	fStorage, err := storage.NewStorage(defaultStoragePath)
+	buckets, err := storage.NewBuckets(defaultStoragePath, &config.Storage)
 	if err != nil {
 		log.Panicf("Error while creating storage with path %s: %v", defaultStoragePath, err)
 	}
 
-	s := apiserver.NewServer(config, fStorage)
+	if rotateKeyPath != "" {
+		rotateKey(buckets)
+		return
+	}
+	if heal {
+		healShards(buckets)
+		return
+	}
+
+	if err := config.Replication.Validate(); err != nil {
+		log.Panicf("Invalid replication configuration: %v", err)
+	}
+	if err := config.Cluster.Validate(); err != nil {
+		log.Panicf("Invalid cluster configuration: %v", err)
+	}
+	if config.Cluster.Enabled() && config.Replication.Role != "" {
+		log.Panicf("Cluster nodes replicate among themselves, replication can not be configured too")
+	}
+	var primary *replication.Primary
+	switch config.Replication.Role {
+	case replication.RolePrimary:
+		primary = startReplication(&config.Replication, buckets)
+	case replication.RoleReplica:
+		config.S3.ReadOnly = true
+	}
+
+	var node *cluster.Cluster
+	if config.Cluster.Enabled() {
+		node = startCluster(&config.Cluster, buckets)
+	}
+
+	if len(config.Webhooks.Hooks) > 0 {
+		startWebhooks(&config.Webhooks, buckets)
+	}
+
+	go buckets.RunTrashPurger()
+	go buckets.RunExpirySweeper()
+	go buckets.RunScrubber()
+	go buckets.RunWatcher()
+	go buckets.RunHealer()
+
+	if config.S3.Enabled {
+		go s3.NewServer(&config.S3, buckets).Run()
+	}
+
+	s := apiserver.NewServer(config, buckets, primary, node)
 	s.Run()
 }
@@ -0,0 +1,228 @@
+package apiserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+
+	"yadro.com/course/internal/storage"
+)
+
+const maxArchiveBodySize = 8 << 20
+
+// archiveRequest selects the files to download together, a file is included
+// when it is named or matches any prefix or the glob. POST requests send it as
+// JSON, GET requests as query parameters:
+//
+//	name=a.txt name=b.txt prefix=logs- glob=*.log format=tar.gz filename=logs.tar.gz
+type archiveRequest struct {
+	Names    []string `json:"names"`
+	Prefixes []string `json:"prefixes"`
+	Glob     string   `json:"glob"`
+	Format   string   `json:"format"`
+	Filename string   `json:"filename"`
+}
+
+var errNoSelection = errors.New("name, prefix or glob is required")
+
+// archiveWriter adds files to an archive streamed to the client
+type archiveWriter interface {
+	add(info *storage.FileInfo, content io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (z *zipArchive) add(info *storage.FileInfo, content io.Reader) error {
+	header := &zip.FileHeader{Name: info.Name, Modified: info.ModTime, Method: zip.Store}
+	header.SetMode(0640)
+	// compressing media and archives again is a waste of time
+	if compressible(info.ContentType) {
+		header.Method = zip.Deflate
+	}
+	w, err := z.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, content, info.Size)
+	return err
+}
+
+func (z *zipArchive) Close() error {
+	return z.zw.Close()
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gw *gzip.Writer
+}
+
+func (t *tarArchive) add(info *storage.FileInfo, content io.Reader) error {
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     info.Name,
+		Mode:     0640,
+		Size:     info.Size,
+		ModTime:  info.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(t.tw, content, info.Size)
+	return err
+}
+
+func (t *tarArchive) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gw.Close()
+}
+
+func parseArchiveRequest(w http.ResponseWriter, r *http.Request) (*archiveRequest, error) {
+	req := &archiveRequest{}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxArchiveBodySize)).Decode(req); err != nil {
+			return nil, errors.New("invalid archive request")
+		}
+	} else {
+		query := r.URL.Query()
+		req.Names, req.Prefixes = query["name"], query["prefix"]
+		req.Glob, req.Format, req.Filename = query.Get("glob"), query.Get("format"), query.Get("filename")
+	}
+
+	if req.Format == "" {
+		req.Format = "zip"
+	}
+	if req.Format != "zip" && req.Format != "tar.gz" {
+		return nil, errors.New("format must be zip or tar.gz")
+	}
+	if len(req.Names) == 0 && len(req.Prefixes) == 0 && req.Glob == "" {
+		return nil, errNoSelection
+	}
+	if req.Glob != "" {
+		if _, err := filepath.Match(req.Glob, ""); err != nil {
+			return nil, errors.New("invalid glob")
+		}
+	}
+	for _, name := range req.Names {
+		if !storage.ValidName(name) {
+			return nil, fmt.Errorf("invalid file name %q", name)
+		}
+	}
+	return req, nil
+}
+
+// selected returns the names of the requested files sorted
+func (req *archiveRequest) selected(st *storage.Storage) ([]string, error) {
+	names := map[string]struct{}{}
+	for _, name := range req.Names {
+		names[name] = struct{}{}
+	}
+	if len(req.Prefixes) > 0 || req.Glob != "" {
+		files, err := st.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			matched := false
+			if req.Glob != "" {
+				matched, _ = filepath.Match(req.Glob, f.Name)
+			}
+			if matched || len(req.Prefixes) > 0 && matchPrefix(f.Name, req.Prefixes) {
+				names[f.Name] = struct{}{}
+			}
+		}
+	}
+
+	res := make([]string, 0, len(names))
+	for name := range names {
+		res = append(res, name)
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+// handleArchive streams the selected files as a single zip or tar.gz built
+// on the fly. Files removed while the archive is sent are left out, other
+// failures abort the response so a truncated archive is not taken for a
+// complete one.
+func (s *Server) handleArchive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+		if s.cluster != nil {
+			// the selected files may be kept by different nodes
+			http.Error(w, "archive is not supported in a cluster", http.StatusNotImplemented)
+			return
+		}
+		req, err := parseArchiveRequest(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, name := range req.Names {
+			if _, err := st.Stat(name); err != nil {
+				http.Error(w, "File not found: "+name, http.StatusNotFound)
+				return
+			}
+		}
+		names, err := req.selected(st)
+		if err != nil {
+			log.Printf("Failed to select files to archive: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		filename := req.Filename
+		if filename == "" {
+			filename = bucketName(r) + "." + req.Format
+		}
+		var archive archiveWriter
+		if req.Format == "zip" {
+			w.Header().Set("Content-Type", "application/zip")
+			archive = &zipArchive{zw: zip.NewWriter(w)}
+		} else {
+			w.Header().Set("Content-Type", "application/gzip")
+			gw := gzip.NewWriter(w)
+			archive = &tarArchive{tw: tar.NewWriter(gw), gw: gw}
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+		for _, name := range names {
+			if err := addToArchive(archive, st, name); err != nil {
+				log.Printf("Failed to archive %s: %v", name, err)
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if err := archive.Close(); err != nil {
+			log.Printf("Failed to finish archive: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+func addToArchive(archive archiveWriter, st *storage.Storage, filename string) error {
+	content, info, err := st.Open(filename)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer safeClose(content)
+	return archive.add(info, content)
+}
@@ -0,0 +1,337 @@
+package apiserver
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+// A backup is a tar archive with a directory per bucket holding its files.
+// Bucket settings and file metadata travel in PAX records, so the archive can
+// be unpacked with any tar as well.
+const (
+	bucketRecord = "FILESERVER.bucket"
+	metaRecord   = "FILESERVER.meta"
+)
+
+var errUnknownFormat = errors.New("format must be tar or tar.gz")
+
+// archiveMeta is the metadata of a file kept in a backup, how the file was
+// stored is up to the server importing it
+type archiveMeta struct {
+	ContentType string            `json:"content_type,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type importReport struct {
+	Imported       int           `json:"imported"`
+	Skipped        int           `json:"skipped"`
+	BucketsCreated []string      `json:"buckets_created"`
+	Errors         []importError `json:"errors"`
+}
+
+type importError struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// handleExport streams every bucket, or the ones given in bucket parameters,
+// as a tar archive. Failures after the first byte abort the response so the
+// client does not take a truncated archive for a complete one.
+func (s *Server) handleExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster != nil {
+			// this node keeps only part of the files
+			http.Error(w, "export is not supported in a cluster", http.StatusNotImplemented)
+			return
+		}
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = "tar"
+		}
+		if format != "tar" && format != "tar.gz" {
+			http.Error(w, errUnknownFormat.Error(), http.StatusBadRequest)
+			return
+		}
+		buckets := s.buckets.List()
+		if names := query["bucket"]; len(names) > 0 {
+			buckets = slices.DeleteFunc(buckets, func(info storage.BucketInfo) bool {
+				return !slices.Contains(names, info.Name)
+			})
+			if len(buckets) != len(names) {
+				http.Error(w, "Bucket not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		filename := "fileserver-" + time.Now().UTC().Format("20060102-150405") + "." + format
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		var out io.Writer = w
+		if format == "tar.gz" {
+			w.Header().Set("Content-Type", "application/gzip")
+			gw := gzip.NewWriter(w)
+			defer safeClose(gw)
+			out = gw
+		} else {
+			w.Header().Set("Content-Type", "application/x-tar")
+		}
+
+		tw := tar.NewWriter(out)
+		for _, info := range buckets {
+			if err := s.exportBucket(tw, &info); err != nil {
+				log.Printf("Failed to export bucket %s: %v", info.Name, err)
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			log.Printf("Failed to export: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+func (s *Server) exportBucket(tw *tar.Writer, info *storage.BucketInfo) error {
+	st, err := s.buckets.Get(info.Name)
+	if err != nil {
+		// deleted meanwhile
+		return nil
+	}
+	settings, err := json.Marshal(info.Settings)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeDir,
+		Name:       info.Name + "/",
+		Mode:       0750,
+		ModTime:    info.Created,
+		PAXRecords: map[string]string{bucketRecord: string(settings)},
+		Format:     tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+
+	files, err := st.List()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := exportFile(tw, st, info.Name, f.Name); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func exportFile(tw *tar.Writer, st *storage.Storage, bucket, filename string) error {
+	content, info, err := st.Open(filename)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer safeClose(content)
+
+	meta, err := json.Marshal(archiveMeta{
+		ContentType: info.ContentType,
+		SHA256:      info.SHA256,
+		ExpiresAt:   info.ExpiresAt,
+		Metadata:    info.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       bucket + "/" + filename,
+		Mode:       0640,
+		Size:       info.Size,
+		ModTime:    info.ModTime,
+		PAXRecords: map[string]string{metaRecord: string(meta)},
+		Format:     tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, content, info.Size)
+	return err
+}
+
+// handleImport restores files from an export, gzip compressed or not.
+// Missing buckets are created with the exported settings. The conflict
+// parameter decides what happens to files that exist already: skip keeps
+// them, overwrite replaces them and fail, the default, stops the import at
+// the first one.
+func (s *Server) handleImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster != nil {
+			// the files would be kept here instead of on their owners
+			http.Error(w, "import is not supported in a cluster", http.StatusNotImplemented)
+			return
+		}
+		conflict := r.URL.Query().Get("conflict")
+		if conflict == "" {
+			conflict = storage.ConflictFail
+		}
+		if conflict != storage.ConflictFail && conflict != storage.ConflictOverwrite && conflict != storage.ConflictSkip {
+			http.Error(w, "conflict must be skip, overwrite or fail", http.StatusBadRequest)
+			return
+		}
+
+		body, err := decompressed(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid archive", http.StatusBadRequest)
+			return
+		}
+		report := &importReport{BucketsCreated: []string{}, Errors: []importError{}}
+		tr := tar.NewReader(body)
+		for {
+			header, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				report.Errors = append(report.Errors, importError{Error: "invalid archive: " + err.Error()})
+				s.writeJSON(w, http.StatusBadRequest, report)
+				return
+			}
+			if err := s.importEntry(tr, header, conflict, report); err != nil {
+				report.Errors = append(report.Errors, importError{Name: header.Name, Error: entryError(err)})
+				if errors.Is(err, storage.ErrExist) {
+					s.writeJSON(w, http.StatusConflict, report)
+					return
+				}
+			}
+		}
+
+		s.writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// decompressed returns the content of r, gunzipping it when it starts with
+// the gzip magic
+func decompressed(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+func (s *Server) importEntry(tr *tar.Reader, header *tar.Header, conflict string, report *importReport) error {
+	name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+	bucket, filename, _ := strings.Cut(name, "/")
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if filename != "" {
+			return errors.New("nested directories are not supported")
+		}
+		var settings storage.BucketSettings
+		if v, ok := header.PAXRecords[bucketRecord]; ok {
+			if err := json.Unmarshal([]byte(v), &settings); err != nil {
+				return fmt.Errorf("invalid bucket settings: %w", err)
+			}
+		}
+		_, err := s.importBucket(bucket, settings, report)
+		return err
+	case tar.TypeReg:
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		return errors.New("only directories and regular files are supported")
+	}
+
+	if !storage.ValidName(filename) {
+		return storage.ErrInvalidName
+	}
+	st, err := s.importBucket(bucket, storage.BucketSettings{}, report)
+	if err != nil {
+		return err
+	}
+
+	var meta archiveMeta
+	if v, ok := header.PAXRecords[metaRecord]; ok {
+		if err := json.Unmarshal([]byte(v), &meta); err != nil {
+			return fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
+	digests := http.Header{}
+	if meta.SHA256 != "" {
+		digests.Set("Repr-Digest", reprDigest(meta.SHA256))
+	}
+	content, err := verifyDigests(digests, tr)
+	if err != nil {
+		return err
+	}
+
+	stored := &storage.Meta{ContentType: meta.ContentType, ExpiresAt: meta.ExpiresAt, Metadata: meta.Metadata}
+	if conflict == storage.ConflictOverwrite {
+		err = st.Put(content, filename, stored)
+	} else {
+		err = st.Save(content, filename, stored)
+	}
+	if errors.Is(err, storage.ErrExist) && conflict == storage.ConflictSkip {
+		report.Skipped++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	report.Imported++
+	return nil
+}
+
+// entryError describes why an entry failed without the paths on the server
+func entryError(err error) string {
+	for _, known := range []error{storage.ErrExist, storage.ErrInvalidName, storage.ErrInvalidBucket,
+		storage.ErrInvalidMetadata, storage.ErrFileTooLarge, storage.ErrQuotaExceeded, storage.ErrSameFile,
+		errDigestMismatch} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return err.Error()
+}
+
+// importBucket returns the storage of the bucket creating the bucket if
+// needed
+func (s *Server) importBucket(name string, settings storage.BucketSettings, report *importReport) (*storage.Storage,
+	error) {
+	if st, err := s.buckets.Get(name); err == nil {
+		return st, nil
+	}
+	info, err := s.buckets.Create(name, settings)
+	if err != nil && !errors.Is(err, storage.ErrBucketExists) {
+		return nil, err
+	}
+	if err == nil {
+		report.BucketsCreated = append(report.BucketsCreated, name)
+		if s.cluster != nil {
+			s.cluster.CreateBucket(info)
+		}
+	}
+	return s.buckets.Get(name)
+}
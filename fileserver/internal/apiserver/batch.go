@@ -0,0 +1,138 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"yadro.com/course/internal/storage"
+)
+
+const maxBatchBodySize = 32 << 20
+
+// batchRequest lists operations on the files of a bucket:
+//
+//	{"atomic": false, "operations": [
+//	  {"op": "delete", "name": "a.txt"},
+//	  {"op": "copy", "name": "b.txt", "destination": "c.txt", "overwrite": true},
+//	  {"op": "move", "name": "d.txt", "destination": "e.txt"},
+//	  {"op": "set-metadata", "name": "e.txt", "metadata": {"owner": "me"}}]}
+//
+// Operations are applied in order, each one sees the files as the ones before
+// it left them.
+type batchRequest struct {
+	Atomic     bool                `json:"atomic"`
+	Operations []storage.Operation `json:"operations"`
+}
+
+type batchReport struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []batchResult `json:"results"`
+}
+
+// batchResult is the outcome of an operation, status is the one a single
+// request doing the same would get
+type batchResult struct {
+	Op          string `json:"op"`
+	Name        string `json:"name"`
+	Destination string `json:"destination,omitempty"`
+	Status      int    `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// handleBatch applies many operations in one request and reports the result
+// of each. In atomic mode the operations are checked against the files and
+// the quota first: either all of them are applied or, with 409, none. Should
+// the disk fail halfway, the operations applied before stay applied and the
+// batch fails with 500.
+func (s *Server) handleBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+		if s.cluster != nil {
+			// operations would touch files of different nodes
+			http.Error(w, "batch is not supported in a cluster", http.StatusNotImplemented)
+			return
+		}
+
+		var req batchRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodySize)).Decode(&req); err != nil {
+			http.Error(w, "Invalid batch request", http.StatusBadRequest)
+			return
+		}
+		if len(req.Operations) == 0 {
+			http.Error(w, "operations are required", http.StatusBadRequest)
+			return
+		}
+		if limit := s.config.Batch.MaxOperations; limit > 0 && len(req.Operations) > limit {
+			http.Error(w, fmt.Sprintf("at most %d operations are allowed", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var errs []error
+		if req.Atomic {
+			errs = st.ApplyAll(req.Operations)
+		} else {
+			// every operation takes the storage lock, running them at once
+			// would not make the batch faster
+			errs = make([]error, len(req.Operations))
+			for i := range req.Operations {
+				errs[i] = st.Apply(&req.Operations[i])
+			}
+		}
+
+		report := &batchReport{Results: make([]batchResult, len(req.Operations))}
+		for i, op := range req.Operations {
+			status, message := operationStatus(errs[i])
+			report.Results[i] = batchResult{Op: op.Op, Name: op.Name, Destination: op.Destination, Status: status,
+				Error: message}
+			if errs[i] == nil {
+				report.Succeeded++
+			} else {
+				report.Failed++
+			}
+		}
+
+		status := http.StatusOK
+		switch {
+		case !req.Atomic || report.Failed == 0:
+		case report.Succeeded > 0:
+			status = http.StatusInternalServerError
+		default:
+			status = http.StatusConflict
+		}
+		s.writeJSON(w, status, report)
+	}
+}
+
+// operationStatus maps the result of an operation to a status code and a
+// message without the paths on the server
+func operationStatus(err error) (int, string) {
+	switch {
+	case err == nil:
+		return http.StatusOK, ""
+	case errors.Is(err, storage.ErrNotApplied):
+		return http.StatusFailedDependency, err.Error()
+	case errors.Is(err, storage.ErrNotExist):
+		return http.StatusNotFound, "file not found"
+	case errors.Is(err, storage.ErrExist):
+		return http.StatusConflict, "destination already exists"
+	case errors.Is(err, storage.ErrInvalidOperation):
+		return http.StatusBadRequest, storage.ErrInvalidOperation.Error()
+	case errors.Is(err, storage.ErrInvalidName), errors.Is(err, storage.ErrSameFile),
+		errors.Is(err, storage.ErrInvalidMetadata):
+		return http.StatusBadRequest, entryError(err)
+	case errors.Is(err, storage.ErrFileTooLarge):
+		return http.StatusRequestEntityTooLarge, entryError(err)
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, entryError(err)
+	default:
+		log.Printf("Batch operation failed: %v", err)
+		return http.StatusInternalServerError, "internal error"
+	}
+}
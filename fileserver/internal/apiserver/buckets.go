@@ -0,0 +1,130 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"yadro.com/course/internal/storage"
+)
+
+type bucketRequest struct {
+	Name string `json:"name"`
+	storage.BucketSettings
+}
+
+type bucketResponse struct {
+	storage.BucketInfo
+	Usage storage.Usage `json:"usage"`
+}
+
+// bucket resolves the storage addressed by the request, routes without
+// a {bucket} path segment use the default bucket
+func (s *Server) bucket(w http.ResponseWriter, r *http.Request) (*storage.Storage, bool) {
+	name := r.PathValue("bucket")
+	if name == "" {
+		name = storage.DefaultBucket
+	}
+
+	st, err := s.buckets.Get(name)
+	if err != nil {
+		http.Error(w, "Bucket not found", http.StatusNotFound)
+		return nil, false
+	}
+	return st, true
+}
+
+func (s *Server) handleListBuckets() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, http.StatusOK, s.buckets.List())
+	}
+}
+
+func (s *Server) handleCreateBucket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req bucketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid bucket description", http.StatusBadRequest)
+			return
+		}
+
+		info, err := s.buckets.Create(req.Name, req.BucketSettings)
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrInvalidBucket):
+				http.Error(w, "Invalid bucket name", http.StatusBadRequest)
+			case errors.Is(err, storage.ErrBucketExists):
+				http.Error(w, "Bucket already exists", http.StatusConflict)
+			default:
+				log.Printf("Failed to create bucket %s: %v", req.Name, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if s.cluster != nil {
+			s.cluster.CreateBucket(info)
+		}
+		s.writeJSON(w, http.StatusCreated, info)
+	}
+}
+
+func (s *Server) handleGetBucket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		info, err := s.buckets.Info(r.PathValue("bucket"))
+		if err != nil {
+			http.Error(w, "Bucket not found", http.StatusNotFound)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, bucketResponse{BucketInfo: *info, Usage: st.Usage()})
+	}
+}
+
+// clusterBucketEmpty reports whether no node has files in the bucket
+func (s *Server) clusterBucketEmpty(st *storage.Storage, name string) bool {
+	local, err := st.List()
+	return err == nil && len(s.cluster.List(name, local)) == 0
+}
+
+func (s *Server) handleDeleteBucket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("bucket")
+		force := r.URL.Query().Get("force") == "true"
+
+		if st, err := s.buckets.Get(name); err == nil && s.cluster != nil && name != storage.DefaultBucket {
+			if !force && !s.clusterBucketEmpty(st, name) {
+				http.Error(w, "Bucket is not empty", http.StatusConflict)
+				return
+			}
+			// the other nodes go first so they do not ship the files back
+			if err := s.cluster.DeleteBucket(name); err != nil {
+				log.Printf("Failed to delete bucket %s in the cluster: %v", name, err)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+		}
+		if err := s.buckets.Delete(name, force); err != nil {
+			switch {
+			case errors.Is(err, storage.ErrBucketNotFound):
+				http.Error(w, "Bucket not found", http.StatusNotFound)
+			case errors.Is(err, storage.ErrDefaultBucket):
+				http.Error(w, "Default bucket can not be deleted", http.StatusForbidden)
+			case errors.Is(err, storage.ErrBucketNotEmpty):
+				http.Error(w, "Bucket is not empty", http.StatusConflict)
+			default:
+				log.Printf("Failed to delete bucket %s: %v", name, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		s.writeResponse(w, http.StatusOK, "Bucket deleted successfully")
+	}
+}
@@ -0,0 +1,63 @@
+package apiserver
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"yadro.com/course/internal/storage"
+)
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+type changesCompactedResponse struct {
+	Error string `json:"error"`
+	*storage.ChangesPage
+}
+
+// handleChanges returns the journal of the bucket after ?since=<seq>. A
+// consumer whose position was already compacted gets 410 Gone together with
+// the retained window and has to resynchronize from the file listing.
+func (s *Server) handleChanges() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		var since uint64
+		if v := query.Get("since"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid since", http.StatusBadRequest)
+				return
+			}
+			since = n
+		}
+		limit := defaultChangesLimit
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxChangesLimit)
+		}
+
+		page, err := st.Changes(since, limit)
+		switch {
+		case errors.Is(err, storage.ErrChangesCompacted):
+			s.writeJSON(w, http.StatusGone, changesCompactedResponse{Error: err.Error(), ChangesPage: page})
+		case err != nil:
+			log.Printf("Failed to read changes: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		default:
+			s.writeJSON(w, http.StatusOK, page)
+		}
+	}
+}
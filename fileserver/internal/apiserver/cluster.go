@@ -0,0 +1,142 @@
+package apiserver
+
+import (
+	"crypto/subtle"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+
+	"yadro.com/course/internal/replication"
+	"yadro.com/course/internal/storage"
+)
+
+// fromPeer reports whether the request comes from the primary or another
+// node of the cluster, such requests are served locally
+func (s *Server) fromPeer(r *http.Request) bool {
+	token := s.config.Replication.Token
+	if s.cluster != nil {
+		token = s.config.Cluster.Token
+	}
+	header := r.Header.Get(replication.TokenHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(header), []byte(token)) == 1
+}
+
+func bucketName(r *http.Request) string {
+	if name := r.PathValue("bucket"); name != "" {
+		return name
+	}
+	return storage.DefaultBucket
+}
+
+// placed forwards requests for files this node does not own. Reads are
+// served by any owner, writes by the first one.
+func (s *Server) placed(h http.HandlerFunc) http.HandlerFunc {
+	if s.cluster == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.fromPeer(r) {
+			h(w, r)
+			return
+		}
+		owners := s.cluster.Owners(bucketName(r), r.PathValue("filename"))
+		reading := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if owners[0] == s.cluster.Self() || reading && slices.Contains(owners, s.cluster.Self()) {
+			h(w, r)
+			return
+		}
+		s.cluster.Forward(w, r, owners)
+	}
+}
+
+// ownerOf returns the node taking writes of the uploaded file when it is not
+// this one
+func (s *Server) ownerOf(r *http.Request, filename string) (string, bool) {
+	if s.cluster == nil || s.fromPeer(r) {
+		return "", false
+	}
+	owner := s.cluster.Owners(bucketName(r), filename)[0]
+	return owner, owner != s.cluster.Self()
+}
+
+// forwardUpload sends a multipart upload already being read to its owner.
+// The fields read so far and the file are streamed as a new form.
+func (s *Server) forwardUpload(w http.ResponseWriter, r *http.Request, upload *upload, owner string) {
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		err := func() error {
+			for name, values := range upload.fields {
+				for _, value := range values {
+					if err := form.WriteField(name, value); err != nil {
+						return err
+					}
+				}
+			}
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Disposition", mime.FormatMediaType("form-data",
+				map[string]string{"name": "file", "filename": upload.filename}))
+			header.Set("Content-Type", upload.contentType)
+			part, err := form.CreatePart(header)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(part, upload.file); err != nil {
+				return err
+			}
+			return form.Close()
+		}()
+		pw.CloseWithError(err)
+	}()
+	defer safeClose(pr)
+
+	out := r.Clone(r.Context())
+	out.Body = pr
+	out.ContentLength = -1
+	out.Header.Del("Content-Length")
+	out.Header.Set("Content-Type", form.FormDataContentType())
+	s.cluster.Forward(w, out, []string{owner})
+}
+
+func (s *Server) handleClusterStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, http.StatusOK, s.cluster.Status())
+	}
+}
+
+// handlePlacement tells which nodes own a file
+func (s *Server) handlePlacement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		bucket, name := query.Get("bucket"), query.Get("name")
+		if bucket == "" {
+			bucket = storage.DefaultBucket
+		}
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, map[string]any{
+			"bucket": bucket,
+			"name":   name,
+			"owners": s.cluster.Owners(bucket, name),
+		})
+	}
+}
+
+func (s *Server) handleRebalance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moved, err := s.cluster.Rebalance()
+		if err != nil {
+			log.Printf("Rebalance failed: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, map[string]int{"moved": moved})
+	}
+}
@@ -0,0 +1,104 @@
+package apiserver
+
+import (
+	"compress/gzip"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"yadro.com/course/internal/storage"
+)
+
+const (
+	compressionHeader = "X-Compression"
+	compressionField  = "compression"
+	// smaller responses are not worth compressing on the fly
+	minCompressSize = 1024
+)
+
+var (
+	errInvalidCompression  = errors.New("compression must be gzip or identity")
+	errUnsupportedEncoding = errors.New("only gzip request bodies are supported")
+)
+
+// decodeBody makes the request body readable as sent before the client
+// applied Content-Encoding
+func decodeBody(r *http.Request) error {
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = reader
+		r.Header.Del("Content-Encoding")
+		return nil
+	default:
+		return errUnsupportedEncoding
+	}
+}
+
+// acceptsGzip reports whether the client accepts gzip encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether content of the type is likely to shrink
+func compressible(contentType string) bool {
+	return storage.IsText(contentType)
+}
+
+// gzipResponseWriter compresses the response body on the fly
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer      *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(statusCode int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	// the length of the compressed body is not known in advance
+	g.Header().Del("Content-Length")
+	g.Header().Set("Content-Encoding", "gzip")
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.writer == nil {
+		g.writer = gzip.NewWriter(g.ResponseWriter)
+	}
+	return g.writer.Write(p)
+}
+
+func (g *gzipResponseWriter) Close() {
+	if g.writer == nil {
+		return
+	}
+	if err := g.writer.Close(); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
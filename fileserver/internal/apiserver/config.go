@@ -1,23 +1,76 @@
 package apiserver
 
+import (
+	"time"
+
+	"yadro.com/course/internal/cluster"
+	"yadro.com/course/internal/replication"
+	"yadro.com/course/internal/s3"
+	"yadro.com/course/internal/storage"
+	"yadro.com/course/internal/webhook"
+)
+
+// EventsConfig sets how many events are kept for clients of /events resuming
+// with Last-Event-ID and how often idle streams get a heartbeat comment
+type EventsConfig struct {
+	BufferSize int           `yaml:"buffer_size" env:"FILESERVER_EVENTS_BUFFER_SIZE" default:"1000"`
+	Heartbeat  time.Duration `yaml:"heartbeat" env:"FILESERVER_EVENTS_HEARTBEAT" default:"15s"`
+}
+
+// ExtractConfig limits archives extracted on upload, MaxSize is the total
+// size of the extracted files in bytes
+type ExtractConfig struct {
+	MaxEntries int   `yaml:"max_entries" env:"FILESERVER_EXTRACT_MAX_ENTRIES" default:"10000"`
+	MaxSize    int64 `yaml:"max_size" env:"FILESERVER_EXTRACT_MAX_SIZE" default:"1073741824"`
+}
+
+// BatchConfig limits the operations of a /batch request
+type BatchConfig struct {
+	MaxOperations int `yaml:"max_operations" env:"FILESERVER_BATCH_MAX_OPERATIONS" default:"10000"`
+}
+
 type Config struct {
-	BindPort   string `yaml:"port" env:"FILESERVER_PORT" default:"9001"`
-	BindHost   string `yaml:"host" env:"FILESERVER_HOST" default:"0.0.0.0"`
-	ConfigPath string `yaml:"path" env:"FILESERVER_CONFIG_PATH" default:"./data"`
+	BindPort    string             `yaml:"port" env:"FILESERVER_PORT" default:"9001"`
+	BindHost    string             `yaml:"host" env:"FILESERVER_HOST" default:"0.0.0.0"`
+	ConfigPath  string             `yaml:"path" env:"FILESERVER_CONFIG_PATH" default:"./data"`
+	S3          s3.Config          `yaml:"s3"`
+	Storage     storage.Config     `yaml:"storage"`
+	Webhooks    webhook.Config     `yaml:"webhooks"`
+	Events      EventsConfig       `yaml:"events"`
+	Extract     ExtractConfig      `yaml:"extract"`
+	Batch       BatchConfig        `yaml:"batch"`
+	Replication replication.Config `yaml:"replication"`
+	Cluster     cluster.Config     `yaml:"cluster"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		BindPort:   "",
-		BindHost:   "0.0.0.0", // костылек, в задании не задается хост
-		ConfigPath: "./data",  // костылек, в задании не задается путь
+		BindPort:    "",
+		BindHost:    "0.0.0.0", // костылек, в задании не задается хост
+		ConfigPath:  "./data",  // костылек, в задании не задается путь
+		S3:          s3.DefaultConfig(),
+		Storage:     storage.DefaultConfig(),
+		Webhooks:    webhook.DefaultConfig(),
+		Events:      EventsConfig{BufferSize: 1000, Heartbeat: 15 * time.Second},
+		Extract:     ExtractConfig{MaxEntries: 10000, MaxSize: 1 << 30},
+		Batch:       BatchConfig{MaxOperations: 10000},
+		Replication: replication.DefaultConfig(),
+		Cluster:     cluster.DefaultConfig(),
 	}
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		BindPort:   "9001",
-		BindHost:   "0.0.0.0",
-		ConfigPath: "./data",
+		BindPort:    "9001",
+		BindHost:    "0.0.0.0",
+		ConfigPath:  "./data",
+		S3:          s3.DefaultConfig(),
+		Storage:     storage.DefaultConfig(),
+		Webhooks:    webhook.DefaultConfig(),
+		Events:      EventsConfig{BufferSize: 1000, Heartbeat: 15 * time.Second},
+		Extract:     ExtractConfig{MaxEntries: 10000, MaxSize: 1 << 30},
+		Batch:       BatchConfig{MaxOperations: 10000},
+		Replication: replication.DefaultConfig(),
+		Cluster:     cluster.DefaultConfig(),
 	}
 }
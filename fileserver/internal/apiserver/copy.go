@@ -0,0 +1,169 @@
+package apiserver
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+var (
+	errDestination        = errors.New("destination must be a file of the same bucket")
+	errPreconditionFailed = errors.New("precondition failed")
+)
+
+// handleTransfer copies or moves a file within its bucket. It serves the
+// WebDAV COPY and MOVE methods, which name the destination in the Destination
+// header and refuse to replace an existing file with "Overwrite: F", and
+// POST .../copy and .../move with destination and overwrite parameters for
+// clients limited to the usual methods. The source can be guarded with
+// If-Match or If-Unmodified-Since and the destination with If-None-Match, the
+// preconditions are checked together with the transfer.
+func (s *Server) handleTransfer(move bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		src := r.PathValue("filename")
+		dst, overwrite, err := transferTarget(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.cluster != nil && s.cluster.Owners(bucketName(r), dst)[0] != s.cluster.Self() {
+			// the source is served by its owner, the destination may belong
+			// to another node
+			http.Error(w, "destination is kept by another node", http.StatusNotImplemented)
+			return
+		}
+
+		var replaced bool
+		if move {
+			replaced, err = st.Move(src, dst, overwrite, transferPreconditions(r))
+		} else {
+			replaced, err = st.Copy(src, dst, overwrite, transferPreconditions(r))
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, errPreconditionFailed):
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		case errors.Is(err, storage.ErrNotExist):
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		case errors.Is(err, storage.ErrExist):
+			http.Error(w, "Destination already exists", http.StatusPreconditionFailed)
+			return
+		case errors.Is(err, storage.ErrSameFile):
+			http.Error(w, storage.ErrSameFile.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, storage.ErrInvalidName):
+			http.Error(w, storage.ErrInvalidName.Error(), http.StatusBadRequest)
+			return
+		default:
+			log.Printf("Failed to transfer %s to %s: %v", src, dst, err)
+			s.writeStorageError(w, err, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		if replaced {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		s.writeResponse(w, http.StatusCreated, dst)
+	}
+}
+
+// transferTarget returns the destination name and whether it may be
+// replaced, an existing destination is replaced unless told otherwise
+func transferTarget(r *http.Request) (string, bool, error) {
+	if r.Method == http.MethodPost {
+		query := r.URL.Query()
+		dst := query.Get("destination")
+		if !storage.ValidName(dst) {
+			return "", false, storage.ErrInvalidName
+		}
+		return dst, query.Get("overwrite") != "false", nil
+	}
+
+	overwrite := true
+	switch r.Header.Get("Overwrite") {
+	case "", "T":
+	case "F":
+		overwrite = false
+	default:
+		return "", false, errors.New("overwrite must be T or F")
+	}
+
+	// an absolute URL or a path, the directory must be the one of the source
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", false, errDestination
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", false, errDestination
+	}
+	dir, dst := path.Split(u.Path)
+	srcDir, _ := path.Split(r.URL.Path)
+	if dir != srcDir || !storage.ValidName(dst) {
+		return "", false, errDestination
+	}
+	return dst, overwrite, nil
+}
+
+// transferPreconditions returns the check of the conditional headers of a
+// transfer, nil without them. If-Match takes precedence over
+// If-Unmodified-Since like for any request.
+func transferPreconditions(r *http.Request) storage.TransferCheck {
+	ifMatch := strings.Join(r.Header.Values("If-Match"), ",")
+	ifNoneMatch := strings.Join(r.Header.Values("If-None-Match"), ",")
+	since, sinceErr := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+	if ifMatch == "" && ifNoneMatch == "" && sinceErr != nil {
+		return nil
+	}
+
+	return func(src, dst *storage.FileInfo) error {
+		switch {
+		case ifMatch != "":
+			if !matchesTag(ifMatch, entityTag(src), false) {
+				return errPreconditionFailed
+			}
+		case sinceErr == nil:
+			if src.ModTime.Truncate(time.Second).After(since) {
+				return errPreconditionFailed
+			}
+		}
+		if ifNoneMatch != "" && dst != nil && matchesTag(ifNoneMatch, entityTag(dst), true) {
+			return errPreconditionFailed
+		}
+		return nil
+	}
+}
+
+// matchesTag reports whether the entity tag of an existing file is in the
+// list of a conditional header, weak tags only match when weak is set
+func matchesTag(list, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if tag != "" && candidate == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package apiserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"yadro.com/course/internal/storage"
+)
+
+var (
+	errInvalidDigest  = errors.New("malformed digest header")
+	errDigestMismatch = errors.New("content does not match the digest")
+)
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// digestReader checks the digests of everything read from r once r is
+// exhausted, so a mismatching upload fails before it is stored
+type digestReader struct {
+	r        io.Reader
+	hashes   map[string]hash.Hash
+	expected map[string][]byte
+}
+
+// verifyDigests wraps the upload so it is checked against the digests sent in
+// Content-MD5, Digest (RFC 3230) or Repr-Digest (RFC 9530) headers. Digests of
+// unknown algorithms are ignored.
+func verifyDigests(header http.Header, r io.Reader) (io.Reader, error) {
+	expected := map[string][]byte{}
+	add := func(algorithm, value string) error {
+		if _, ok := digestAlgorithms[algorithm]; !ok {
+			return nil
+		}
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != digestAlgorithms[algorithm]().Size() {
+			return errInvalidDigest
+		}
+		if prev, ok := expected[algorithm]; ok && !bytes.Equal(prev, sum) {
+			return errDigestMismatch
+		}
+		expected[algorithm] = sum
+		return nil
+	}
+
+	if v := header.Get("Content-MD5"); v != "" {
+		if err := add("md5", strings.TrimSpace(v)); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range header.Values("Digest") {
+		for _, item := range strings.Split(v, ",") {
+			algorithm, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				return nil, errInvalidDigest
+			}
+			if err := add(strings.ToLower(algorithm), value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, v := range header.Values("Repr-Digest") {
+		for _, item := range strings.Split(v, ",") {
+			algorithm, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			// values are structured field byte sequences: :base64:
+			if !ok || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return nil, errInvalidDigest
+			}
+			if err := add(strings.ToLower(algorithm), value[1:len(value)-1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(expected) == 0 {
+		return r, nil
+	}
+	d := &digestReader{r: r, hashes: map[string]hash.Hash{}, expected: expected}
+	for algorithm := range expected {
+		d.hashes[algorithm] = digestAlgorithms[algorithm]()
+	}
+	return d, nil
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	for _, h := range d.hashes {
+		h.Write(p[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		for algorithm, h := range d.hashes {
+			if sum := h.Sum(nil); !bytes.Equal(sum, d.expected[algorithm]) {
+				return n, fmt.Errorf("%w: %s is %s", errDigestMismatch, algorithm, hex.EncodeToString(sum))
+			}
+		}
+	}
+	return n, err
+}
+
+// reprDigest formats the SHA-256 of a file for the Repr-Digest header
+func reprDigest(sha256Hex string) string {
+	sum, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// entityTag is the strong entity tag of a file, its quoted SHA-256. Files
+// whose digest is not recorded have none.
+func entityTag(info *storage.FileInfo) string {
+	if info.SHA256 == "" {
+		return ""
+	}
+	return `"` + info.SHA256 + `"`
+}
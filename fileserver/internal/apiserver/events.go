@@ -0,0 +1,183 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+// streamBuffer is the number of events a slow client may lag behind before it
+// is disconnected, it resumes from the ring buffer on reconnect
+const streamBuffer = 64
+
+type streamEvent struct {
+	id uint64
+	storage.Event
+}
+
+// eventBroker numbers file events, keeps the latest ones for clients
+// resuming with Last-Event-ID and fans them out to connected clients
+type eventBroker struct {
+	mu          sync.Mutex
+	size        int
+	ring        []streamEvent
+	seq         uint64
+	subscribers map[chan streamEvent]struct{}
+}
+
+func newEventBroker(size int) *eventBroker {
+	if size <= 0 {
+		size = 1
+	}
+	return &eventBroker{size: size, subscribers: map[chan streamEvent]struct{}{}}
+}
+
+func (b *eventBroker) publish(e storage.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	se := streamEvent{id: b.seq, Event: e}
+	if len(b.ring) == b.size {
+		b.ring = append(b.ring[:0], b.ring[1:]...)
+	}
+	b.ring = append(b.ring, se)
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- se:
+		default:
+			// the client can not keep up
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the retained events after lastID together with a channel
+// of the following ones. An id the broker has not issued, as after a restart,
+// replays everything retained.
+func (b *eventBroker) subscribe(lastID uint64) ([]streamEvent, chan streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var backlog []streamEvent
+	if lastID > b.seq {
+		lastID = 0
+	}
+	for _, e := range b.ring {
+		if e.id > lastID {
+			backlog = append(backlog, e)
+		}
+	}
+
+	ch := make(chan streamEvent, streamBuffer)
+	b.subscribers[ch] = struct{}{}
+	return backlog, ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// handleEvents streams changes of the bucket as Server-Sent Events. Events
+// can be limited to names starting with one of the prefix parameters.
+func (s *Server) handleEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.bucket(w, r); !ok {
+			return
+		}
+		bucket := r.PathValue("bucket")
+		if bucket == "" {
+			bucket = storage.DefaultBucket
+		}
+		prefixes := r.URL.Query()["prefix"]
+
+		var lastID uint64
+		if v := r.Header.Get("Last-Event-ID"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			lastID = id
+		}
+
+		backlog, ch := s.events.subscribe(lastID)
+		defer s.events.unsubscribe(ch)
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(e streamEvent) error {
+			if e.Bucket != bucket || !matchPrefix(e.Name, prefixes) {
+				return nil
+			}
+			data, err := json.Marshal(e.Event)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.Type, data)
+			return err
+		}
+		for _, e := range backlog {
+			if err := send(e); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			log.Printf("Failed to stream events: %v", err)
+			return
+		}
+
+		heartbeat := time.NewTicker(s.config.Events.Heartbeat)
+		defer heartbeat.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				err = send(e)
+			case <-heartbeat.C:
+				_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func matchPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
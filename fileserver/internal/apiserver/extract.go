@@ -0,0 +1,394 @@
+package apiserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"yadro.com/course/internal/storage"
+)
+
+const (
+	extractField     = "extract"
+	dirField         = "dir"
+	separatorField   = "separator"
+	conflictField    = "conflict"
+	defaultSeparator = "_"
+	tarBlockSize     = 512
+	// zipEntrySlack is what a zip entry may take besides its content: the
+	// local and the central directory headers, a data descriptor and twice
+	// its name and extra field of up to 1 KiB each
+	zipEntrySlack = 4 << 10
+	// zipEndSlack covers the end of the central directory and its comment
+	zipEndSlack = 96 << 10
+)
+
+var (
+	errTooManyEntries  = errors.New("archive has too many entries")
+	errExtractTooLarge = errors.New("archive expands beyond the size limit")
+	errUnsafePath      = errors.New("unsafe path")
+	errUnknownArchive  = errors.New("file is not a zip, tar or tar.gz archive")
+)
+
+// extraction extracts an uploaded archive into a bucket. File names are flat,
+// so the target directory and the directories inside the archive become a
+// prefix of the name: docs/api/index.html extracted to v2 is stored as
+// v2_docs_api_index.html.
+type extraction struct {
+	st        *storage.Storage
+	meta      *storage.Meta
+	dir       string
+	separator string
+	conflict  string
+	// entries and remaining are what is left of the limits
+	entries   int
+	remaining int64
+	report    *extractReport
+}
+
+type extractReport struct {
+	Extracted int             `json:"extracted"`
+	Skipped   int             `json:"skipped"`
+	Failed    int             `json:"failed"`
+	Entries   []extractResult `json:"entries"`
+	// Error is why the extraction stopped, entries before it are kept
+	Error string `json:"error,omitempty"`
+}
+
+type extractResult struct {
+	Entry  string `json:"entry"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	extractCreated  = "created"
+	extractReplaced = "replaced"
+	extractSkipped  = "skipped"
+	extractFailed   = "failed"
+)
+
+// formValue returns a parameter of an upload given either in the query or
+// as a form field before the file
+func formValue(r *http.Request, upload *upload, name string) string {
+	if v := r.URL.Query().Get(name); v != "" {
+		return v
+	}
+	return upload.fields.Get(name)
+}
+
+func extractRequested(r *http.Request, upload *upload) bool {
+	return formValue(r, upload, extractField) == "true"
+}
+
+// handleExtract stores the entries of an uploaded zip, tar or tar.gz as
+// separate files and reports the result of every entry. Entries failing do
+// not stop the extraction, exceeding the limits does.
+func (s *Server) handleExtract(w http.ResponseWriter, r *http.Request, st *storage.Storage, upload *upload,
+	file io.Reader, meta *storage.Meta) {
+	e := &extraction{
+		st:        st,
+		meta:      meta,
+		dir:       strings.Trim(formValue(r, upload, dirField), "/"),
+		separator: formValue(r, upload, separatorField),
+		conflict:  formValue(r, upload, conflictField),
+		entries:   s.config.Extract.MaxEntries,
+		remaining: s.config.Extract.MaxSize,
+		report:    &extractReport{Entries: []extractResult{}},
+	}
+	if e.separator == "" {
+		e.separator = defaultSeparator
+	}
+	if e.conflict == "" {
+		e.conflict = storage.ConflictFail
+	}
+	switch {
+	case s.cluster != nil:
+		// entries would belong to different nodes
+		http.Error(w, "extract is not supported in a cluster", http.StatusNotImplemented)
+		return
+	case e.conflict != storage.ConflictFail && e.conflict != storage.ConflictOverwrite &&
+		e.conflict != storage.ConflictSkip:
+		http.Error(w, "conflict must be skip, overwrite or fail", http.StatusBadRequest)
+		return
+	case strings.ContainsAny(e.separator, `/\`):
+		http.Error(w, "invalid separator", http.StatusBadRequest)
+		return
+	case e.dir != "" && !safePath(e.dir):
+		http.Error(w, "invalid dir", http.StatusBadRequest)
+		return
+	}
+
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(4)
+	var err error
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		err = e.zip(br)
+	} else {
+		err = e.tar(br)
+	}
+
+	switch {
+	case err == nil:
+		s.writeJSON(w, http.StatusOK, e.report)
+	case errors.Is(err, errUnknownArchive), errors.Is(err, errDigestMismatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errTooManyEntries), errors.Is(err, errExtractTooLarge):
+		e.report.Error = err.Error()
+		s.writeJSON(w, http.StatusRequestEntityTooLarge, e.report)
+	default:
+		log.Printf("Failed to extract %s: %v", upload.filename, err)
+		e.report.Error = "invalid archive: " + entryError(err)
+		s.writeJSON(w, http.StatusBadRequest, e.report)
+	}
+}
+
+// spool copies the archive to a temporary file, so the digests of the upload
+// are verified before any entry is stored. The archive may be larger than its
+// content by slack. The caller removes the file with discard.
+func (e *extraction) spool(r io.Reader, slack int64) (*os.File, int64, error) {
+	tmp, err := e.st.CreateTemp("extract-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	limit := e.remaining + slack
+	size, err := io.Copy(tmp, io.LimitReader(r, limit+1))
+	if err == nil && size > limit {
+		err = errExtractTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		discard(tmp)
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+func discard(tmp *os.File) {
+	safeClose(tmp)
+	if err := os.Remove(tmp.Name()); err != nil {
+		log.Printf("Failed to remove %s: %v", tmp.Name(), err)
+	}
+}
+
+// zip is read from a spooled file since the central directory is at its end.
+// The limits are checked against the directory before anything is extracted
+// and enforced on the actual content too.
+func (e *extraction) zip(r io.Reader) error {
+	tmp, size, err := e.spool(r, int64(e.entries+1)*zipEntrySlack+zipEndSlack)
+	if err != nil {
+		return err
+	}
+	defer discard(tmp)
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+	var total uint64
+	files := 0
+	for _, f := range zr.File {
+		if !f.Mode().IsDir() {
+			files++
+			total += f.UncompressedSize64
+		}
+	}
+	if files > e.entries {
+		return errTooManyEntries
+	}
+	if total > uint64(e.remaining) {
+		return errExtractTooLarge
+	}
+
+	for _, f := range zr.File {
+		if f.Mode().IsDir() {
+			continue
+		}
+		res := extractResult{Entry: f.Name}
+		if !f.Mode().IsRegular() {
+			e.fail(&res, errors.New("only regular files are extracted"))
+			continue
+		}
+		content, err := f.Open()
+		if err != nil {
+			e.fail(&res, err)
+			continue
+		}
+		err = e.extract(&res, content)
+		safeClose(content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tar extracts a spooled tar or tar.gz, the limits are checked as entries are
+// read
+func (e *extraction) tar(r io.Reader) error {
+	// every entry takes a header and padding, and possibly an extended
+	// header, on top of its content
+	tmp, _, err := e.spool(r, int64(e.entries+1)*4*tarBlockSize)
+	if err != nil {
+		return err
+	}
+	defer discard(tmp)
+
+	body, err := decompressed(tmp)
+	if err != nil {
+		return errUnknownArchive
+	}
+	tr := tar.NewReader(body)
+	for first := true; ; first = false {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			if first {
+				return errUnknownArchive
+			}
+			return err
+		}
+
+		res := extractResult{Entry: header.Name}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg:
+		default:
+			e.fail(&res, errors.New("only regular files are extracted"))
+			continue
+		}
+		if e.entries--; e.entries < 0 {
+			return errTooManyEntries
+		}
+		if header.Size > e.remaining {
+			return errExtractTooLarge
+		}
+		if err := e.extract(&res, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extract stores an entry and records the result. Only failures stopping the
+// whole extraction are returned.
+func (e *extraction) extract(res *extractResult, content io.Reader) error {
+	name, err := e.name(res.Entry)
+	if err != nil {
+		e.fail(res, err)
+		return nil
+	}
+	res.Name = name
+
+	_, statErr := e.st.Stat(name)
+	exists := statErr == nil
+	if exists && e.conflict != storage.ConflictOverwrite {
+		if e.conflict == storage.ConflictSkip {
+			res.Status = extractSkipped
+			e.report.Skipped++
+			e.report.Entries = append(e.report.Entries, *res)
+			return nil
+		}
+		e.fail(res, storage.ErrExist)
+		return nil
+	}
+
+	limited := &limitedReader{r: content, remaining: e.remaining}
+	file, contentType := storage.DetectContentType(limited, name, "")
+	meta := *e.meta
+	meta.ContentType = contentType
+	if e.conflict == storage.ConflictOverwrite {
+		err = e.st.Put(file, name, &meta)
+	} else {
+		err = e.st.Save(file, name, &meta)
+	}
+	e.remaining = limited.remaining
+	if errors.Is(err, errExtractTooLarge) {
+		return err
+	}
+	if err != nil {
+		e.fail(res, err)
+		return nil
+	}
+
+	res.Size = limited.read
+	res.Status = extractCreated
+	if exists {
+		res.Status = extractReplaced
+	}
+	e.report.Extracted++
+	e.report.Entries = append(e.report.Entries, *res)
+	return nil
+}
+
+func (e *extraction) fail(res *extractResult, err error) {
+	res.Status = extractFailed
+	res.Error = entryError(err)
+	e.report.Failed++
+	e.report.Entries = append(e.report.Entries, *res)
+}
+
+// name maps an entry path to a file name, paths escaping the target
+// directory are rejected
+func (e *extraction) name(entry string) (string, error) {
+	entry = strings.TrimPrefix(entry, "./")
+	if !safePath(entry) {
+		return "", errUnsafePath
+	}
+	elements := strings.Split(path.Clean(entry), "/")
+	if e.dir != "" {
+		elements = append(strings.Split(e.dir, "/"), elements...)
+	}
+	name := strings.Join(elements, e.separator)
+	if !storage.ValidName(name) {
+		return "", storage.ErrInvalidName
+	}
+	return name, nil
+}
+
+// safePath reports whether p is a relative slash separated path staying
+// below the directory it is resolved in
+func safePath(p string) bool {
+	if p == "" || strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\\\x00") || strings.Contains(p, ":") {
+		return false
+	}
+	for _, element := range strings.Split(p, "/") {
+		if element == ".." {
+			return false
+		}
+	}
+	return path.Clean(p) != "."
+}
+
+// limitedReader fails once more than remaining bytes are read, unlike
+// io.LimitReader which ends the content silently
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	read      int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, fmt.Errorf("%w: %d bytes", errExtractTooLarge, l.read)
+	}
+	return n, err
+}
@@ -0,0 +1,111 @@
+package apiserver
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+const (
+	expiresAfterHeader = "X-Expires-After"
+	expiresAfterField  = "expires_after"
+	// client metadata is sent as X-Meta-<key> headers or meta_<key> form
+	// fields
+	metadataHeaderPrefix = "X-Meta-"
+	metadataFieldPrefix  = "meta_"
+)
+
+var errInvalidExpiry = errors.New("expiry must be a positive duration such as 24h")
+
+// uploadMeta collects file metadata sent with an upload either in headers or
+// in form fields
+func uploadMeta(r *http.Request, upload *upload) (*storage.Meta, error) {
+	meta := &storage.Meta{ContentType: upload.contentType}
+
+	expiresAfter := r.Header.Get(expiresAfterHeader)
+	if expiresAfter == "" {
+		expiresAfter = upload.fields.Get(expiresAfterField)
+	}
+	if expiresAfter != "" {
+		ttl, err := time.ParseDuration(expiresAfter)
+		if err != nil || ttl <= 0 {
+			return nil, errInvalidExpiry
+		}
+		expiresAt := time.Now().Add(ttl).UTC()
+		meta.ExpiresAt = &expiresAt
+	}
+
+	meta.Compression = r.Header.Get(compressionHeader)
+	if meta.Compression == "" {
+		meta.Compression = upload.fields.Get(compressionField)
+	}
+	if meta.Compression != "" && meta.Compression != storage.CompressionGzip &&
+		meta.Compression != storage.CompressionIdentity {
+		return nil, errInvalidCompression
+	}
+
+	meta.Metadata = uploadMetadata(r, upload)
+	return meta, nil
+}
+
+// uploadMetadata collects client metadata, headers win over form fields
+func uploadMetadata(r *http.Request, upload *upload) map[string]string {
+	metadata := map[string]string{}
+	for name, values := range upload.fields {
+		if key, ok := strings.CutPrefix(name, metadataFieldPrefix); ok {
+			metadata[strings.ToLower(key)] = values[0]
+		}
+	}
+	for name, values := range r.Header {
+		// header names are canonical, X-Meta-Build-Id
+		if key, ok := strings.CutPrefix(name, metadataHeaderPrefix); ok {
+			metadata[strings.ToLower(key)] = strings.Join(values, ",")
+		}
+	}
+	return metadata
+}
+
+// writeMetadataHeaders returns client metadata as X-Meta-<key> headers
+func writeMetadataHeaders(header http.Header, metadata map[string]string) {
+	for key, value := range metadata {
+		header.Set(metadataHeaderPrefix+key, value)
+	}
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || r.Header.Get("Accept") == "application/json"
+}
+
+// contentDisposition returns "inline" or "attachment" for a download. Types
+// browsers can display safely are shown inline unless ?download=1 is given,
+// ?inline=1 asks to display any other type too.
+func contentDisposition(r *http.Request, contentType string) string {
+	query := r.URL.Query()
+	switch {
+	case query.Get("download") == "1":
+		return "attachment"
+	case query.Get("inline") == "1", inlineSafe(contentType):
+		return "inline"
+	default:
+		return "attachment"
+	}
+}
+
+func inlineSafe(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/pdf", mediaType == "text/plain":
+		return true
+	case mediaType == "image/svg+xml":
+		// may carry scripts
+		return false
+	default:
+		return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "audio/") ||
+			strings.HasPrefix(mediaType, "video/")
+	}
+}
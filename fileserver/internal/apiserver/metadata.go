@@ -0,0 +1,93 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"yadro.com/course/internal/storage"
+)
+
+const maxMetadataBodySize = 64 * 1024
+
+func (s *Server) handleGetMetadata() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		meta, err := st.Meta(r.PathValue("filename"))
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		metadata := meta.Metadata
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		s.writeJSON(w, http.StatusOK, metadata)
+	}
+}
+
+// handleSetMetadata replaces the client metadata of a file with the JSON
+// object in the body
+func (s *Server) handleSetMetadata() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		var metadata map[string]string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataBodySize)).Decode(&metadata); err != nil {
+			http.Error(w, "Invalid metadata", http.StatusBadRequest)
+			return
+		}
+
+		res, err := st.SetMetadata(r.PathValue("filename"), metadata)
+		if err != nil {
+			s.writeMetadataError(w, err)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// handlePatchMetadata merges the JSON object in the body into the client
+// metadata of a file, null values remove keys
+func (s *Server) handlePatchMetadata() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		var changes map[string]*string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataBodySize)).Decode(&changes); err != nil {
+			http.Error(w, "Invalid metadata", http.StatusBadRequest)
+			return
+		}
+
+		res, err := st.PatchMetadata(r.PathValue("filename"), changes)
+		if err != nil {
+			s.writeMetadataError(w, err)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func (s *Server) writeMetadataError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotExist), errors.Is(err, storage.ErrInvalidName):
+		http.Error(w, "File not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrInvalidMetadata):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Failed to update metadata: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
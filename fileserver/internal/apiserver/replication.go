@@ -0,0 +1,174 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"yadro.com/course/internal/replication"
+	"yadro.com/course/internal/storage"
+)
+
+// readOnly rejects requests changing data on a replica, only the primary
+// writes through the /replication routes
+func (s *Server) readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !strings.HasPrefix(r.URL.Path, "/replication/") {
+				http.Error(w, "Read-only replica", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fromPrimary rejects requests of others than the primary or the other
+// nodes of the cluster
+func (s *Server) fromPrimary(w http.ResponseWriter, r *http.Request) bool {
+	if !s.fromPeer(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleReplicatePut stores a file sent by the primary as is, creating or
+// replacing it
+func (s *Server) handleReplicatePut() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.fromPrimary(w, r) {
+			return
+		}
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		meta := &storage.Meta{
+			ContentType: r.Header.Get("Content-Type"),
+			Metadata:    uploadMetadata(r, &upload{}),
+		}
+		if v := r.Header.Get(replication.ExpiresAtHeader); v != "" {
+			expiresAt, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				http.Error(w, "invalid "+replication.ExpiresAtHeader, http.StatusBadRequest)
+				return
+			}
+			meta.ExpiresAt = &expiresAt
+		}
+
+		filename := r.PathValue("filename")
+		if current, err := st.Stat(filename); err == nil && sameFile(current, meta, r.Header.Get("Repr-Digest")) {
+			// cluster nodes send back what they received
+			s.writeResponse(w, http.StatusOK, "File unchanged")
+			return
+		}
+		file, err := verifyDigests(r.Header, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := st.Put(file, filename, meta); err != nil {
+			if !errors.Is(err, errDigestMismatch) {
+				log.Printf("Failed to replicate %s: %v", filename, err)
+			}
+			s.writeStorageError(w, err, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		s.writeResponse(w, http.StatusOK, "File replicated")
+	}
+}
+
+// sameFile reports whether the stored file already has the content and
+// metadata being replicated
+func sameFile(current *storage.FileInfo, meta *storage.Meta, digest string) bool {
+	return current.SHA256 != "" && reprDigest(current.SHA256) == digest &&
+		current.ContentType == meta.ContentType && maps.Equal(current.Metadata, meta.Metadata) &&
+		(current.ExpiresAt == nil) == (meta.ExpiresAt == nil) &&
+		(current.ExpiresAt == nil || current.ExpiresAt.Equal(*meta.ExpiresAt))
+}
+
+func (s *Server) handleReplicateDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.fromPrimary(w, r) {
+			return
+		}
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		filename := r.PathValue("filename")
+		if err := st.Delete(filename); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			log.Printf("Failed to replicate deletion of %s: %v", filename, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		s.writeResponse(w, http.StatusOK, "File deleted")
+	}
+}
+
+func (s *Server) handleReplicateCreateBucket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.fromPrimary(w, r) {
+			return
+		}
+
+		var req bucketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid bucket description", http.StatusBadRequest)
+			return
+		}
+
+		_, err := s.buckets.Create(req.Name, req.BucketSettings)
+		switch {
+		case err == nil, errors.Is(err, storage.ErrBucketExists):
+			s.writeResponse(w, http.StatusOK, "Bucket replicated")
+		case errors.Is(err, storage.ErrInvalidBucket):
+			http.Error(w, "Invalid bucket name", http.StatusBadRequest)
+		default:
+			log.Printf("Failed to replicate bucket %s: %v", req.Name, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+	}
+}
+
+func (s *Server) handleReplicateDeleteBucket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.fromPrimary(w, r) {
+			return
+		}
+
+		name := r.PathValue("bucket")
+		err := s.buckets.Delete(name, true)
+		switch {
+		case err == nil, errors.Is(err, storage.ErrBucketNotFound):
+			s.writeResponse(w, http.StatusOK, "Bucket deleted successfully")
+		case errors.Is(err, storage.ErrDefaultBucket):
+			http.Error(w, "Default bucket can not be deleted", http.StatusForbidden)
+		default:
+			log.Printf("Failed to replicate deletion of bucket %s: %v", name, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+	}
+}
+
+// handleReplicationStatus reports the lag of the replicas on the primary
+func (s *Server) handleReplicationStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeJSON(w, http.StatusOK, map[string]any{
+			"role":     s.config.Replication.Role,
+			"replicas": s.replicator.Status(),
+		})
+	}
+}
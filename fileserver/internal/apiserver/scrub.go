@@ -0,0 +1,41 @@
+package apiserver
+
+import (
+	"log"
+	"net/http"
+)
+
+func (s *Server) handleGetScrub() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		report := st.LastScrub()
+		if report == nil {
+			http.Error(w, "No scrub has run yet", http.StatusNotFound)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func (s *Server) handleRunScrub() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		report, err := st.Scrub()
+		if err != nil {
+			log.Printf("Failed to scrub: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,117 @@
+package apiserver
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+// parseSearchQuery reads a search from query parameters:
+//
+//	name=*.log regex=^build- min_size=1024 max_size=1048576
+//	modified_after=2024-01-01T00:00:00Z modified_before=...
+//	content_type=image/* meta=build=42 meta=owner limit=100
+func parseSearchQuery(r *http.Request) (*storage.SearchQuery, error) {
+	params := r.URL.Query()
+	q := &storage.SearchQuery{Name: params.Get("name"), ContentType: params.Get("content_type")}
+
+	if q.Name != "" {
+		if _, err := filepath.Match(q.Name, ""); err != nil {
+			return nil, errors.New("invalid name pattern")
+		}
+	}
+	if v := params.Get("regex"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, errors.New("invalid regex")
+		}
+		q.NameRegexp = re
+	}
+
+	for name, dst := range map[string]*int64{"min_size": &q.MinSize, "max_size": &q.MaxSize} {
+		if v := params.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid " + name)
+			}
+			*dst = n
+		}
+	}
+	for name, dst := range map[string]*time.Time{"modified_after": &q.ModifiedAfter, "modified_before": &q.ModifiedBefore} {
+		if v := params.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.New("invalid " + name + ", expected RFC 3339 time")
+			}
+			*dst = t
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid limit")
+		}
+		q.Limit = n
+	}
+
+	if tags := params["meta"]; len(tags) > 0 {
+		q.Metadata = make(map[string]string, len(tags))
+		for _, tag := range tags {
+			key, value, _ := strings.Cut(tag, "=")
+			if key == "" {
+				return nil, errors.New("invalid meta, expected key=value or key")
+			}
+			q.Metadata[key] = value
+		}
+	}
+	return q, nil
+}
+
+func (s *Server) handleSearch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		q, err := parseSearchQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, st.Search(q))
+	}
+}
+
+func (s *Server) handleSearchText() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		limit := 0
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		matches, err := st.SearchText(r.URL.Query().Get("q"), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, matches)
+	}
+}
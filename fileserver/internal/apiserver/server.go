@@ -1,30 +1,46 @@
 package apiserver
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
+	"mime"
 	"net/http"
-	"os"
+	"strings"
+	"time"
 
+	"yadro.com/course/internal/cluster"
+	"yadro.com/course/internal/replication"
 	"yadro.com/course/internal/storage"
 )
 
-const maxMemory = 32 * 1024 * 1024
-
 type Server struct {
-	mux     *http.ServeMux
-	config  *Config
-	storage *storage.Storage
+	mux        *http.ServeMux
+	config     *Config
+	buckets    *storage.Buckets
+	events     *eventBroker
+	replicator *replication.Primary
+	cluster    *cluster.Cluster
 }
 
-func NewServer(config *Config, storage *storage.Storage) *Server {
+// NewServer creates the API server, replicator is set on a replication
+// primary and cluster on the nodes of a cluster only
+func NewServer(config *Config, buckets *storage.Buckets, replicator *replication.Primary,
+	cluster *cluster.Cluster) *Server {
 	s := &Server{
-		mux:     http.NewServeMux(),
-		config:  config,
-		storage: storage,
+		mux:        http.NewServeMux(),
+		config:     config,
+		buckets:    buckets,
+		events:     newEventBroker(config.Events.BufferSize),
+		replicator: replicator,
+		cluster:    cluster,
+	}
+	if s.config.Events.Heartbeat <= 0 {
+		s.config.Events.Heartbeat = 15 * time.Second
 	}
+	buckets.Subscribe(s.events.publish)
 	s.addRoutes()
 	return s
 }
@@ -36,6 +52,14 @@ func (s *Server) writeResponse(w http.ResponseWriter, statusCode int, message st
 	}
 }
 
+func (s *Server) writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
 func safeClose(closer io.Closer) {
 	if err := closer.Close(); err != nil {
 		log.Printf("Failed to close file: %v", err)
@@ -44,53 +68,74 @@ func safeClose(closer io.Closer) {
 
 func (s *Server) handleSaveFile() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseMultipartForm(maxMemory); err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+		st, ok := s.bucket(w, r)
+		if !ok {
 			return
 		}
 
-		file, header, err := r.FormFile("file")
+		upload, err := readUpload(r)
 		if err != nil {
 			http.Error(w, "Bad Request", http.StatusBadRequest)
 			return
 		}
-		defer safeClose(file)
-
-		osFile, err := convertToOSFile(file)
-		defer safeClose(osFile)
+		meta, err := uploadMeta(r, upload)
 		if err != nil {
-			http.Error(w, "Bad Request", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, err := verifyDigests(r.Header, upload.file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if extractRequested(r, upload) {
+			s.handleExtract(w, r, st, upload, file, meta)
+			return
 		}
-		if err := s.storage.Save(osFile, header.Filename); err != nil {
-			http.Error(w, "Conflict", http.StatusConflict)
+		if owner, ok := s.ownerOf(r, upload.filename); ok {
+			s.forwardUpload(w, r, upload, owner)
+			return
+		}
+		if err := st.Save(file, upload.filename, meta); err != nil {
+			s.writeStorageError(w, err, http.StatusConflict, "Conflict")
 			return
 		}
 
-		s.writeResponse(w, http.StatusCreated, header.Filename)
+		s.writeResponse(w, http.StatusCreated, upload.filename)
 	}
 }
 
 func (s *Server) handleUpdateFile() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseMultipartForm(maxMemory); err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+		st, ok := s.bucket(w, r)
+		if !ok {
 			return
 		}
 
-		file, header, err := r.FormFile("file")
+		upload, err := readUpload(r)
 		if err != nil {
 			http.Error(w, "Bad Request", http.StatusBadRequest)
 			return
 		}
-		defer safeClose(file)
-
-		osFile, err := convertToOSFile(file)
-		defer safeClose(osFile)
+		if upload.filename != r.PathValue("filename") {
+			// the request was routed to the owner of the name in the path
+			http.Error(w, "file name does not match the path", http.StatusBadRequest)
+			return
+		}
+		meta, err := uploadMeta(r, upload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, err := verifyDigests(r.Header, upload.file)
 		if err != nil {
-			http.Error(w, "Bad Request", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		if err := s.storage.Update(osFile, header.Filename); err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+
+		if err := st.Update(file, upload.filename, meta); err != nil {
+			s.writeStorageError(w, err, http.StatusNotFound, err.Error())
 			return
 		}
 
@@ -98,9 +143,44 @@ func (s *Server) handleUpdateFile() http.HandlerFunc {
 	}
 }
 
+// writeStorageError reports quota violations and rejected uploads, any other
+// error is written with the given fallback status and message
+func (s *Server) writeStorageError(w http.ResponseWriter, err error, statusCode int, message string) {
+	switch {
+	case errors.Is(err, errDigestMismatch), errors.Is(err, storage.ErrInvalidMetadata):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrFileTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		http.Error(w, message, statusCode)
+	}
+}
+
 func (s *Server) handleListFiles() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		files, err := s.storage.GetFilesAsString()
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		if s.cluster != nil && !s.fromPeer(r) {
+			s.listCluster(w, r, st)
+			return
+		}
+
+		if wantsJSON(r) {
+			files, err := st.List()
+			if err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			s.writeJSON(w, http.StatusOK, files)
+			return
+		}
+
+		files, err := st.GetFilesAsString()
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
@@ -110,32 +190,119 @@ func (s *Server) handleListFiles() http.HandlerFunc {
 	}
 }
 
+// listCluster lists the files of the bucket on every node
+func (s *Server) listCluster(w http.ResponseWriter, r *http.Request, st *storage.Storage) {
+	local, err := st.List()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	files := s.cluster.List(bucketName(r), local)
+	if wantsJSON(r) {
+		s.writeJSON(w, http.StatusOK, files)
+		return
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	s.writeResponse(w, http.StatusOK, strings.Join(names, "\n"))
+}
+
 func (s *Server) handleGetFile() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
 		filename := r.PathValue("filename")
 
-		file, err := s.storage.Get(filename)
+		var file io.ReadSeekCloser
+		var err error
+		info := &storage.FileInfo{Name: filename}
+		// files stored compressed are sent as is to clients accepting gzip
+		encoded := false
+		if version := r.URL.Query().Get("version"); version != "" {
+			file, err = st.GetVersion(filename, version)
+		} else {
+			// the content and its description come from one open, so the
+			// digest matches the body sent
+			if acceptsGzip(r) && r.Header.Get("Range") == "" {
+				file, info, err = st.OpenCompressed(filename)
+				encoded = err == nil && info.ContentType != ""
+				if err == nil && !encoded {
+					// the content type is detected on the decompressed content
+					safeClose(file)
+				}
+			}
+			if !encoded {
+				file, info, err = st.Open(filename)
+			}
+		}
 		if err != nil {
 			http.Error(w, "File not found", http.StatusNotFound)
 			return
 		}
 		defer safeClose(file)
 
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
-		w.Header().Set("Content-Transfer-Encoding", "binary")
+		contentType := info.ContentType
+		// versions and files stored before content types were recorded
+		if contentType == "" {
+			_, contentType = storage.DetectContentType(file, filename, "")
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
 
-		if _, err := io.Copy(w, file); err != nil {
-			log.Printf("Failed to write response: %v", err)
+		disposition := contentDisposition(r, contentType)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Add("Vary", "Accept-Encoding")
+		writeMetadataHeaders(w.Header(), info.Metadata)
+		if disposition == "inline" && !inlineSafe(contentType) {
+			// keep scripts in uploaded pages from running on the server origin
+			w.Header().Set("Content-Security-Policy", "sandbox")
 		}
+
+		compress := !encoded && info.Size >= minCompressSize && compressible(contentType) && acceptsGzip(r) &&
+			r.Header.Get("Range") == ""
+		if tag := entityTag(info); tag != "" {
+			// gzip responses carry other bytes than the file
+			if encoded || compress {
+				tag = "W/" + tag
+			}
+			w.Header().Set("ETag", tag)
+		}
+		switch {
+		case encoded:
+			w.Header().Set("Content-Encoding", "gzip")
+		case compress:
+			gw := &gzipResponseWriter{ResponseWriter: w}
+			defer gw.Close()
+			w = gw
+		case info.SHA256 != "":
+			// the digest describes the identity encoding only
+			w.Header().Set("Repr-Digest", reprDigest(info.SHA256))
+		}
+
+		http.ServeContent(w, r, filename, info.ModTime, file)
 	}
 }
 
 func (s *Server) handleDeleteFile() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
 		filename := r.PathValue("filename")
 
-		if err := s.storage.Delete(filename); err != nil {
+		if err := st.Delete(filename); err != nil {
 			http.Error(w, "File not found", http.StatusNotFound)
 			return
 		}
@@ -145,40 +312,72 @@ func (s *Server) handleDeleteFile() http.HandlerFunc {
 }
 
 func (s *Server) addRoutes() {
-	s.mux.HandleFunc("POST /files", s.handleSaveFile())
-	s.mux.HandleFunc("PUT /files/{filename}", s.handleUpdateFile())
-	s.mux.HandleFunc("GET /files/{filename}", s.handleGetFile())
-	s.mux.HandleFunc("GET /files", s.handleListFiles())
-	s.mux.HandleFunc("DELETE /files/{filename}", s.handleDeleteFile())
-}
+	// the routes of the default bucket are kept without prefix for backwards
+	// compatibility
+	s.addBucketRoutes("")
+	s.addBucketRoutes("/buckets/{bucket}")
 
-func (s *Server) Run() {
-	serverAddress := s.config.BindHost + ":" + s.config.BindPort
-	log.Printf("File server started on address %s", serverAddress)
-	log.Fatal(http.ListenAndServe(serverAddress, s.mux))
-}
+	s.mux.HandleFunc("GET /buckets", s.handleListBuckets())
+	s.mux.HandleFunc("POST /buckets", s.handleCreateBucket())
+	s.mux.HandleFunc("GET /buckets/{bucket}", s.handleGetBucket())
+	s.mux.HandleFunc("DELETE /buckets/{bucket}", s.handleDeleteBucket())
 
-func convertToOSFile(mf multipart.File) (*os.File, error) {
-	tmpFile, err := os.CreateTemp("", "upload-*")
-	if err != nil {
-		return nil, err
-	}
+	s.mux.HandleFunc("GET /admin/export", s.handleExport())
+	s.mux.HandleFunc("POST /admin/import", s.handleImport())
 
-	if _, err := io.Copy(tmpFile, mf); err != nil {
-		safeClose(tmpFile)
-		if err := os.Remove(tmpFile.Name()); err != nil {
-			return nil, err
-		}
-		return nil, err
+	if s.cluster != nil {
+		s.mux.HandleFunc("GET /cluster/status", s.handleClusterStatus())
+		s.mux.HandleFunc("GET /cluster/placement", s.handlePlacement())
+		s.mux.HandleFunc("POST /cluster/rebalance", s.handleRebalance())
 	}
-
-	if _, err := tmpFile.Seek(0, 0); err != nil {
-		safeClose(tmpFile)
-		if err := os.Remove(tmpFile.Name()); err != nil {
-			return nil, err
-		}
-		return nil, err
+	switch {
+	case s.replicator != nil:
+		s.mux.HandleFunc("GET /replication/status", s.handleReplicationStatus())
+	case s.config.Replication.Role == replication.RoleReplica, s.cluster != nil:
+		s.mux.HandleFunc("PUT /replication/buckets/{bucket}/files/{filename}", s.handleReplicatePut())
+		s.mux.HandleFunc("DELETE /replication/buckets/{bucket}/files/{filename}", s.handleReplicateDelete())
+		s.mux.HandleFunc("POST /replication/buckets", s.handleReplicateCreateBucket())
+		s.mux.HandleFunc("DELETE /replication/buckets/{bucket}", s.handleReplicateDeleteBucket())
 	}
+}
+
+func (s *Server) addBucketRoutes(prefix string) {
+	s.mux.HandleFunc("POST "+prefix+"/files", s.handleSaveFile())
+	s.mux.HandleFunc("PUT "+prefix+"/files/{filename}", s.placed(s.handleUpdateFile()))
+	s.mux.HandleFunc("GET "+prefix+"/files/{filename}", s.placed(s.handleGetFile()))
+	s.mux.HandleFunc("GET "+prefix+"/files", s.handleListFiles())
+	s.mux.HandleFunc("DELETE "+prefix+"/files/{filename}", s.placed(s.handleDeleteFile()))
+	s.mux.HandleFunc("COPY "+prefix+"/files/{filename}", s.placed(s.handleTransfer(false)))
+	s.mux.HandleFunc("MOVE "+prefix+"/files/{filename}", s.placed(s.handleTransfer(true)))
+	s.mux.HandleFunc("POST "+prefix+"/files/{filename}/copy", s.placed(s.handleTransfer(false)))
+	s.mux.HandleFunc("POST "+prefix+"/files/{filename}/move", s.placed(s.handleTransfer(true)))
+	s.mux.HandleFunc("GET "+prefix+"/files/{filename}/metadata", s.placed(s.handleGetMetadata()))
+	s.mux.HandleFunc("PUT "+prefix+"/files/{filename}/metadata", s.placed(s.handleSetMetadata()))
+	s.mux.HandleFunc("PATCH "+prefix+"/files/{filename}/metadata", s.placed(s.handlePatchMetadata()))
+	s.mux.HandleFunc("GET "+prefix+"/files/{filename}/versions", s.placed(s.handleListVersions()))
+	s.mux.HandleFunc("POST "+prefix+"/files/{filename}/versions/{version}/restore", s.placed(s.handleRestoreVersion()))
+	s.mux.HandleFunc("GET "+prefix+"/archive", s.handleArchive())
+	s.mux.HandleFunc("POST "+prefix+"/archive", s.handleArchive())
+	s.mux.HandleFunc("POST "+prefix+"/batch", s.handleBatch())
+	s.mux.HandleFunc("GET "+prefix+"/search", s.handleSearch())
+	s.mux.HandleFunc("GET "+prefix+"/search/text", s.handleSearchText())
+	s.mux.HandleFunc("GET "+prefix+"/events", s.handleEvents())
+	s.mux.HandleFunc("GET "+prefix+"/changes", s.handleChanges())
+	s.mux.HandleFunc("GET "+prefix+"/usage", s.handleUsage())
+	s.mux.HandleFunc("GET "+prefix+"/trash", s.handleListTrash())
+	s.mux.HandleFunc("DELETE "+prefix+"/trash", s.handleEmptyTrash())
+	s.mux.HandleFunc("POST "+prefix+"/trash/{id}/restore", s.handleRestoreFromTrash())
+	s.mux.HandleFunc("DELETE "+prefix+"/trash/{id}", s.handleDeleteFromTrash())
+	s.mux.HandleFunc("GET "+prefix+"/scrub", s.handleGetScrub())
+	s.mux.HandleFunc("POST "+prefix+"/scrub", s.handleRunScrub())
+}
 
-	return tmpFile, nil
+func (s *Server) Run() {
+	serverAddress := s.config.BindHost + ":" + s.config.BindPort
+	log.Printf("File server started on address %s", serverAddress)
+	var handler http.Handler = s.mux
+	if s.config.Replication.Role == replication.RoleReplica {
+		handler = s.readOnly(handler)
+	}
+	log.Fatal(http.ListenAndServe(serverAddress, handler))
 }
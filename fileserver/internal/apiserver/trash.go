@@ -0,0 +1,102 @@
+package apiserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+func (s *Server) handleUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, st.Usage())
+	}
+}
+
+func (s *Server) handleListTrash() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		entries, err := st.Trash()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+func (s *Server) handleRestoreFromTrash() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		id := r.PathValue("id")
+
+		filename, err := st.RestoreFromTrash(id, r.URL.Query().Get("conflict"))
+		switch {
+		case errors.Is(err, storage.ErrTrashEntryNotFound):
+			http.Error(w, "Trash entry not found", http.StatusNotFound)
+			return
+		case errors.Is(err, storage.ErrExist):
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		case errors.Is(err, storage.ErrInvalidConflict):
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		s.writeResponse(w, http.StatusOK, filename)
+	}
+}
+
+func (s *Server) handleDeleteFromTrash() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		id := r.PathValue("id")
+
+		if err := st.DeleteFromTrash(id); err != nil {
+			http.Error(w, "Trash entry not found", http.StatusNotFound)
+			return
+		}
+
+		s.writeResponse(w, http.StatusOK, "File deleted permanently")
+	}
+}
+
+func (s *Server) handleEmptyTrash() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		removed, err := st.EmptyTrash(time.Now())
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		s.writeResponse(w, http.StatusOK, fmt.Sprintf("%d files deleted permanently", removed))
+	}
+}
@@ -0,0 +1,72 @@
+package apiserver
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"yadro.com/course/internal/storage"
+)
+
+const (
+	maxFieldSize = 64 * 1024
+	maxFields    = 100
+)
+
+var errNoFile = errors.New(`multipart form has no "file" part`)
+
+// upload is a multipart upload whose file part is read directly from the
+// request body, so limits are enforced while the content is still arriving
+type upload struct {
+	file        io.Reader
+	filename    string
+	contentType string
+	fields      url.Values
+}
+
+// readUpload reads form fields up to the "file" part, fields sent after the
+// file are ignored
+func readUpload(r *http.Request) (*upload, error) {
+	if err := decodeBody(r); err != nil {
+		return nil, err
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := url.Values{}
+	// parts are counted, a field may be repeated
+	for parts := 0; parts <= maxFields; parts++ {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, errNoFile
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == "file" {
+			file, contentType := storage.DetectContentType(part, part.FileName(), part.Header.Get("Content-Type"))
+			return &upload{file: file, filename: part.FileName(), contentType: contentType, fields: fields}, nil
+		}
+		if err := readField(part, fields); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("too many form fields")
+}
+
+func readField(part *multipart.Part, fields url.Values) error {
+	value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+	if err != nil {
+		return err
+	}
+	if len(value) > maxFieldSize {
+		return errors.New("form field is too large")
+	}
+	fields.Add(part.FormName(), string(value))
+	return nil
+}
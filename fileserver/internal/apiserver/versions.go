@@ -0,0 +1,41 @@
+package apiserver
+
+import "net/http"
+
+func (s *Server) handleListVersions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		filename := r.PathValue("filename")
+
+		versions, err := st.Versions(filename)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, versions)
+	}
+}
+
+func (s *Server) handleRestoreVersion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st, ok := s.bucket(w, r)
+		if !ok {
+			return
+		}
+
+		filename := r.PathValue("filename")
+		version := r.PathValue("version")
+
+		if err := st.Restore(filename, version); err != nil {
+			http.Error(w, "Version not found", http.StatusNotFound)
+			return
+		}
+
+		s.writeResponse(w, http.StatusOK, "File restored")
+	}
+}
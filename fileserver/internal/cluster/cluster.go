@@ -0,0 +1,322 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"yadro.com/course/internal/replication"
+	"yadro.com/course/internal/storage"
+)
+
+// placementName keeps the ring the shipping state was built for
+const placementName = "placement"
+
+// Cluster places every file on its owners. Requests for files this node
+// does not own are forwarded, the owners ship changes to each other like a
+// replication primary to its replicas and the rebalancer hands files over
+// when the peers change.
+type Cluster struct {
+	config  *Config
+	self    string
+	ring    *Ring
+	buckets *storage.Buckets
+	peers   map[string]*replication.Peer
+	shipper *replication.Primary
+	proxy   http.RoundTripper
+}
+
+type placement struct {
+	Peers        []string `json:"peers"`
+	Replicas     int      `json:"replicas"`
+	VirtualNodes int      `json:"virtual_nodes"`
+}
+
+// Status describes the cluster as seen by this node
+type Status struct {
+	Self         string                      `json:"self"`
+	Peers        []string                    `json:"peers"`
+	Replicas     int                         `json:"replicas"`
+	VirtualNodes int                         `json:"virtual_nodes"`
+	Shipping     []replication.ReplicaStatus `json:"shipping"`
+}
+
+func New(config *Config, buckets *storage.Buckets, dir string) (*Cluster, error) {
+	peers := normalize(config.Peers)
+	sort.Strings(peers)
+	c := &Cluster{
+		config:  config,
+		self:    strings.TrimSuffix(config.Self, "/"),
+		ring:    NewRing(peers, config.VirtualNodes),
+		buckets: buckets,
+		peers:   map[string]*replication.Peer{},
+		proxy:   http.DefaultTransport,
+	}
+
+	if err := resetOnChange(dir, &placement{Peers: peers, Replicas: config.Replicas,
+		VirtualNodes: config.VirtualNodes}); err != nil {
+		return nil, err
+	}
+
+	others := slices.DeleteFunc(slices.Clone(peers), func(peer string) bool { return peer == c.self })
+	for _, peer := range others {
+		c.peers[peer] = replication.NewPeer(peer, config.Token)
+	}
+	shipper, err := replication.NewPrimary(&replication.Config{
+		Role:          replication.RolePrimary,
+		Replicas:      others,
+		Token:         config.Token,
+		RetryInterval: config.RetryInterval,
+	}, buckets, dir)
+	if err != nil {
+		return nil, err
+	}
+	// owners keep each other up to date, other nodes only hand files over
+	shipper.Filter = func(peer, bucket, filename string) bool {
+		owners := c.Owners(bucket, filename)
+		return slices.Contains(owners, c.self) && slices.Contains(owners, peer)
+	}
+	c.shipper = shipper
+	return c, nil
+}
+
+// resetOnChange drops the shipping state when the ring changed, so every
+// peer is resynchronized with the files it owns now
+func resetOnChange(dir string, current *placement) error {
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, placementName)
+	prev, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if string(prev) == string(data) {
+		return nil
+	}
+
+	states, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if err := os.Remove(state); err != nil {
+			return err
+		}
+	}
+	if prev != nil {
+		log.Printf("Cluster peers changed, resynchronizing and rebalancing")
+	}
+	return os.WriteFile(path, data, 0640)
+}
+
+// Run ships changes to the other owners and rebalances in the background
+func (c *Cluster) Run() {
+	c.shipper.Run()
+	go func() {
+		interval := c.config.RebalanceInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		for {
+			if moved, err := c.Rebalance(); err != nil {
+				log.Printf("Rebalance failed: %v", err)
+			} else if moved > 0 {
+				log.Printf("Rebalance handed over %d files", moved)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (c *Cluster) Self() string {
+	return c.self
+}
+
+// Owners returns the peers keeping the file, the first one takes the writes
+func (c *Cluster) Owners(bucket, filename string) []string {
+	return c.ring.Owners(bucket+"/"+filename, c.config.Replicas)
+}
+
+// Peers returns the other nodes of the cluster
+func (c *Cluster) Peers() []*replication.Peer {
+	res := make([]*replication.Peer, 0, len(c.peers))
+	for _, peer := range c.peers {
+		res = append(res, peer)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].URL < res[j].URL })
+	return res
+}
+
+// Forward proxies the request to the first of the targets answering, only
+// requests without a body are retried on the next target. The targets serve
+// it locally.
+func (c *Cluster) Forward(w http.ResponseWriter, r *http.Request, targets []string) {
+	if r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody {
+		targets = targets[:1]
+	}
+	for i, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			continue
+		}
+		failed := false
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(u)
+				pr.SetXForwarded()
+				pr.Out.Header.Set(replication.TokenHeader, c.config.Token)
+			},
+			Transport: c.proxy,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("Failed to forward %s %s to %s: %v", r.Method, r.URL.Path, target, err)
+				if i == len(targets)-1 {
+					http.Error(w, "Bad Gateway", http.StatusBadGateway)
+					return
+				}
+				failed = true
+			},
+		}
+		proxy.ServeHTTP(w, r)
+		if !failed {
+			return
+		}
+	}
+	http.Error(w, "Bad Gateway", http.StatusBadGateway)
+}
+
+// List merges the listings of the bucket on every node, the newest copy of
+// a file wins. Unreachable nodes are skipped, their files are kept by other
+// owners too.
+func (c *Cluster) List(bucket string, local []storage.FileInfo) []storage.FileInfo {
+	files := map[string]storage.FileInfo{}
+	for _, f := range local {
+		files[f.Name] = f
+	}
+	for _, peer := range c.Peers() {
+		remote, err := peer.ListFiles(bucket)
+		if err != nil {
+			log.Printf("Failed to list bucket %s on %s: %v", bucket, peer.URL, err)
+			continue
+		}
+		for name, f := range remote {
+			if prev, ok := files[name]; !ok || f.ModTime.After(prev.ModTime) {
+				files[name] = f
+			}
+		}
+	}
+
+	res := make([]storage.FileInfo, 0, len(files))
+	for _, f := range files {
+		res = append(res, f)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// CreateBucket creates the bucket on the other nodes, the ones failing get
+// it with the first file shipped
+func (c *Cluster) CreateBucket(info *storage.BucketInfo) {
+	for _, peer := range c.Peers() {
+		if err := peer.CreateBucket(info); err != nil {
+			log.Printf("Failed to create bucket %s on %s: %v", info.Name, peer.URL, err)
+		}
+	}
+}
+
+// DeleteBucket deletes the bucket on the other nodes
+func (c *Cluster) DeleteBucket(name string) error {
+	for _, peer := range c.Peers() {
+		if err := peer.DeleteBucket(name); err != nil {
+			return fmt.Errorf("%s: %w", peer.URL, err)
+		}
+	}
+	return nil
+}
+
+// Rebalance hands the local files this node does not own over to their
+// owners and removes them once every owner has an identical copy. It returns
+// the number of files handed over.
+func (c *Cluster) Rebalance() (int, error) {
+	moved := 0
+	for _, info := range c.buckets.List() {
+		st, err := c.buckets.Get(info.Name)
+		if err != nil {
+			continue
+		}
+		files, err := st.List()
+		if err != nil {
+			return moved, fmt.Errorf("bucket %s: %w", info.Name, err)
+		}
+
+		listings := map[string]map[string]storage.FileInfo{}
+		for _, f := range files {
+			owners := c.Owners(info.Name, f.Name)
+			if slices.Contains(owners, c.self) {
+				continue
+			}
+			if err := c.handOver(&info, st, &f, owners, listings); err != nil {
+				log.Printf("Failed to hand %s/%s over: %v", info.Name, f.Name, err)
+				continue
+			}
+			// the owners already have the file, removing the local copy is
+			// no change to publish, trash or version
+			if err := st.Evict(f.Name, f.SHA256); errors.Is(err, storage.ErrChanged) {
+				log.Printf("Kept %s/%s, it changed while being handed over", info.Name, f.Name)
+				continue
+			} else if err != nil && !errors.Is(err, storage.ErrNotExist) {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func (c *Cluster) handOver(info *storage.BucketInfo, st *storage.Storage, f *storage.FileInfo, owners []string,
+	listings map[string]map[string]storage.FileInfo) error {
+	for _, owner := range owners {
+		peer, ok := c.peers[owner]
+		if !ok {
+			continue
+		}
+		listing, ok := listings[owner]
+		if !ok {
+			var err error
+			if listing, err = peer.ListFiles(info.Name); err != nil {
+				return err
+			}
+			listings[owner] = listing
+		}
+		if remote, ok := listing[f.Name]; ok && f.SHA256 != "" && remote.SHA256 == f.SHA256 {
+			continue
+		}
+		if err := peer.PutFile(info, st, f.Name); err != nil {
+			return fmt.Errorf("%s: %w", owner, err)
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) Status() Status {
+	peers := normalize(c.config.Peers)
+	sort.Strings(peers)
+	return Status{
+		Self:         c.self,
+		Peers:        peers,
+		Replicas:     c.config.Replicas,
+		VirtualNodes: c.config.VirtualNodes,
+		Shipping:     c.shipper.Status(),
+	}
+}
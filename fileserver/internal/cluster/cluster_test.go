@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"yadro.com/course/internal/replication"
+	"yadro.com/course/internal/storage"
+)
+
+// fakePeer accepts the files handed over to it
+type fakePeer struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (p *fakePeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(replication.TokenHeader) != "token" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/buckets/default/files":
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, "[]")
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/replication/buckets/default/files/"):
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		p.files[strings.TrimPrefix(r.URL.Path, "/replication/buckets/default/files/")] = data
+		p.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	peer := &fakePeer{files: map[string][]byte{}}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	storageConfig := storage.DefaultConfig()
+	storageConfig.Versioning.Enabled = true
+	buckets, err := storage.NewBuckets(t.TempDir(), &storageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := buckets.Default()
+	for i := range 20 {
+		name := fmt.Sprintf("file-%d.txt", i)
+		if err := st.Save(strings.NewReader(name), name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var events []storage.Event
+	buckets.Subscribe(func(e storage.Event) { events = append(events, e) })
+
+	config := DefaultConfig()
+	config.Self = "http://self.test"
+	config.Peers = []string{config.Self, server.URL}
+	config.Replicas = 1
+	config.Token = "token"
+	c, err := New(&config, buckets, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := c.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 || moved != len(peer.files) {
+		t.Fatalf("moved %d files, the peer received %d", moved, len(peer.files))
+	}
+
+	for i := range 20 {
+		name := fmt.Sprintf("file-%d.txt", i)
+		_, err := st.Stat(name)
+		if c.Owners(storage.DefaultBucket, name)[0] == c.Self() {
+			if err != nil {
+				t.Fatalf("owned file %s: %v", name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("%s kept after it was handed over", name)
+		}
+		if !bytes.Equal(peer.files[name], []byte(name)) {
+			t.Fatalf("peer received %q for %s", peer.files[name], name)
+		}
+	}
+
+	// handing over is no deletion for subscribers, the trash or versions
+	if len(events) > 0 {
+		t.Fatalf("rebalancing published %v", events)
+	}
+	if trash, err := st.Trash(); err != nil || len(trash) > 0 {
+		t.Fatalf("handed over files trashed %v: %v", trash, err)
+	}
+	if moved, err := c.Rebalance(); err != nil || moved != 0 {
+		t.Fatalf("second rebalance moved %d files: %v", moved, err)
+	}
+}
@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config joins the server to a cluster of the static list of Peers, Self is
+// the url of this server as it appears in the list. Every file is kept on
+// Replicas of the peers.
+type Config struct {
+	Self              string        `yaml:"self" env:"FILESERVER_CLUSTER_SELF"`
+	Peers             []string      `yaml:"peers" env:"FILESERVER_CLUSTER_PEERS"`
+	Replicas          int           `yaml:"replicas" env:"FILESERVER_CLUSTER_REPLICAS" default:"2"`
+	VirtualNodes      int           `yaml:"virtual_nodes" env:"FILESERVER_CLUSTER_VIRTUAL_NODES" default:"64"`
+	Token             string        `yaml:"token" env:"FILESERVER_CLUSTER_TOKEN"`
+	RetryInterval     time.Duration `yaml:"retry_interval" env:"FILESERVER_CLUSTER_RETRY_INTERVAL" default:"5s"`
+	RebalanceInterval time.Duration `yaml:"rebalance_interval" env:"FILESERVER_CLUSTER_REBALANCE_INTERVAL" default:"1m"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Replicas:          2,
+		VirtualNodes:      64,
+		RetryInterval:     5 * time.Second,
+		RebalanceInterval: time.Minute,
+	}
+}
+
+func (c *Config) Enabled() bool {
+	return len(c.Peers) > 0
+}
+
+func (c *Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Token == "" {
+		return errors.New("cluster requires a token")
+	}
+	if c.Replicas < 1 {
+		return errors.New("cluster replicas must be at least 1")
+	}
+	for _, peer := range c.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("peer url %q must be an absolute http(s) url", peer)
+		}
+	}
+	if !slices.Contains(normalize(c.Peers), strings.TrimSuffix(c.Self, "/")) {
+		return fmt.Errorf("self %q is not one of the peers", c.Self)
+	}
+	return nil
+}
+
+// String hides the token from logged configuration
+func (c Config) String() string {
+	return fmt.Sprintf("{Self:%s Peers:%v Replicas:%d VirtualNodes:%d RetryInterval:%s RebalanceInterval:%s}",
+		c.Self, c.Peers, c.Replicas, c.VirtualNodes, c.RetryInterval, c.RebalanceInterval)
+}
+
+func normalize(peers []string) []string {
+	res := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		peer = strings.TrimSuffix(peer, "/")
+		if !slices.Contains(res, peer) {
+			res = append(res, peer)
+		}
+	}
+	return res
+}
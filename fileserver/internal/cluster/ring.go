@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Ring places keys on peers by consistent hashing. Every peer owns several
+// points of the ring, the virtual nodes, so keys spread evenly and only
+// about 1/n of them move when a peer joins or leaves.
+type Ring struct {
+	points []point
+	peers  int
+}
+
+type point struct {
+	hash uint64
+	peer string
+}
+
+func NewRing(peers []string, virtualNodes int) *Ring {
+	virtualNodes = max(virtualNodes, 1)
+	r := &Ring{peers: len(peers)}
+	for _, peer := range peers {
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hashKey(peer + "#" + strconv.Itoa(i)), peer: peer})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// Owners returns n distinct peers for the key walking the ring clockwise
+// from it, the first one is the primary owner
+func (r *Ring) Owners(key string, n int) []string {
+	n = min(n, r.peers)
+	if n <= 0 {
+		return nil
+	}
+
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	owners := make([]string, 0, n)
+	for i := 0; len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !slices.Contains(owners, p.peer) {
+			owners = append(owners, p.peer)
+		}
+	}
+	return owners
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
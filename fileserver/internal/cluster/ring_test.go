@@ -0,0 +1,58 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestRingOwners(t *testing.T) {
+	peers := []string{"http://a", "http://b", "http://c"}
+	r := NewRing(peers, 64)
+
+	counts := map[string]int{}
+	for i := range 3000 {
+		key := fmt.Sprintf("bucket/file-%d", i)
+		owners := r.Owners(key, 2)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			t.Fatalf("%s owned by %v", key, owners)
+		}
+		if !slices.Equal(owners, r.Owners(key, 2)) {
+			t.Fatalf("%s placed differently on a second lookup", key)
+		}
+		counts[owners[0]]++
+	}
+	for _, peer := range peers {
+		if counts[peer] < 500 {
+			t.Errorf("%s is the primary of only %d of 3000 keys", peer, counts[peer])
+		}
+	}
+
+	if owners := r.Owners("key", 5); len(owners) != 3 {
+		t.Fatalf("more owners than peers: %v", owners)
+	}
+	if owners := NewRing(nil, 64).Owners("key", 2); owners != nil {
+		t.Fatalf("owners without peers: %v", owners)
+	}
+}
+
+func TestRingAddPeer(t *testing.T) {
+	before := NewRing([]string{"http://a", "http://b", "http://c"}, 64)
+	after := NewRing([]string{"http://a", "http://b", "http://c", "http://d"}, 64)
+
+	moved := 0
+	for i := range 4000 {
+		key := fmt.Sprintf("bucket/file-%d", i)
+		prev, cur := before.Owners(key, 1)[0], after.Owners(key, 1)[0]
+		if prev != cur {
+			if cur != "http://d" {
+				t.Fatalf("%s moved from %s to %s instead of the new peer", key, prev, cur)
+			}
+			moved++
+		}
+	}
+	// about a quarter of the keys belong to the new peer
+	if moved < 500 || moved > 1500 {
+		t.Fatalf("%d of 4000 keys moved", moved)
+	}
+}
@@ -0,0 +1,96 @@
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrTooFewShards = errors.New("too few shards left to reconstruct the data")
+
+// Codec computes parity shards from data shards with a systematic
+// Reed-Solomon code: the data shards are stored as is and any DataShards of
+// all shards are enough to recover the others.
+type Codec struct {
+	dataShards   int
+	parityShards int
+	// encode has an identity on top, the rows below compute the parity
+	encode matrix
+}
+
+func NewCodec(dataShards, parityShards int) (*Codec, error) {
+	if dataShards < 1 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("invalid erasure code %d+%d, at most 256 shards of at least 1 data shard", dataShards,
+			parityShards)
+	}
+
+	total := dataShards + parityShards
+	v := vandermonde(total, dataShards)
+	top, err := v[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Codec{dataShards: dataShards, parityShards: parityShards, encode: v.mul(top)}, nil
+}
+
+// Encode fills the parity shards following the data shards, all shards have
+// the same size
+func (c *Codec) Encode(shards [][]byte) {
+	for p := c.dataShards; p < len(shards); p++ {
+		out := shards[p]
+		clear(out)
+		for d := 0; d < c.dataShards; d++ {
+			mulAdd(c.encode[p][d], shards[d], out)
+		}
+	}
+}
+
+// Reconstruct recreates the missing shards, given as nil, of size size
+func (c *Codec) Reconstruct(shards [][]byte, size int) error {
+	var present []int
+	for i, shard := range shards {
+		if shard != nil {
+			present = append(present, i)
+		}
+	}
+	if len(present) < c.dataShards {
+		return ErrTooFewShards
+	}
+
+	missingData := false
+	for d := 0; d < c.dataShards; d++ {
+		missingData = missingData || shards[d] == nil
+	}
+	if missingData {
+		used := present[:c.dataShards]
+		rows := make(matrix, len(used))
+		for i, idx := range used {
+			rows[i] = c.encode[idx]
+		}
+		decode, err := rows.invert()
+		if err != nil {
+			return err
+		}
+		for d := 0; d < c.dataShards; d++ {
+			if shards[d] != nil {
+				continue
+			}
+			out := make([]byte, size)
+			for i, idx := range used {
+				mulAdd(decode[d][i], shards[idx], out)
+			}
+			shards[d] = out
+		}
+	}
+
+	for p := c.dataShards; p < len(shards); p++ {
+		if shards[p] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for d := 0; d < c.dataShards; d++ {
+			mulAdd(c.encode[p][d], shards[d], out)
+		}
+		shards[p] = out
+	}
+	return nil
+}
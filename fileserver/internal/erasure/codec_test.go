@@ -0,0 +1,85 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func encoded(t *testing.T, c *Codec, k, m, size int) [][]byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(int64(k*100 + m)))
+	shards := make([][]byte, k+m)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < k {
+			rng.Read(shards[i])
+		}
+	}
+	c.Encode(shards)
+	return shards
+}
+
+// lost calls fn with every set of at most n of total shard indexes
+func lost(total, n int, fn func([]int)) {
+	var walk func(start int, picked []int)
+	walk = func(start int, picked []int) {
+		fn(picked)
+		if len(picked) == n {
+			return
+		}
+		for i := start; i < total; i++ {
+			walk(i+1, append(picked, i))
+		}
+	}
+	walk(0, nil)
+}
+
+func TestCodecRecoversLostShards(t *testing.T) {
+	for _, code := range []struct{ k, m int }{{1, 1}, {2, 1}, {4, 2}, {3, 3}, {5, 0}} {
+		c, err := NewCodec(code.k, code.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original := encoded(t, c, code.k, code.m, 100)
+
+		lost(code.k+code.m, code.m, func(missing []int) {
+			shards := make([][]byte, len(original))
+			for i := range original {
+				shards[i] = bytes.Clone(original[i])
+			}
+			for _, i := range missing {
+				shards[i] = nil
+			}
+			if err := c.Reconstruct(shards, 100); err != nil {
+				t.Fatalf("%d+%d losing %v: %v", code.k, code.m, missing, err)
+			}
+			for i := range original {
+				if !bytes.Equal(shards[i], original[i]) {
+					t.Fatalf("%d+%d losing %v: shard %d differs", code.k, code.m, missing, i)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecTooManyLost(t *testing.T) {
+	c, err := NewCodec(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := encoded(t, c, 4, 2, 10)
+	shards[0], shards[3], shards[5] = nil, nil, nil
+	if err := c.Reconstruct(shards, 10); !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("expected ErrTooFewShards, got %v", err)
+	}
+}
+
+func TestCodecInvalid(t *testing.T) {
+	for _, code := range []struct{ k, m int }{{0, 2}, {2, -1}, {200, 57}} {
+		if _, err := NewCodec(code.k, code.m); err == nil {
+			t.Errorf("%d+%d accepted", code.k, code.m)
+		}
+	}
+}
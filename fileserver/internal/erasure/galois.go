@@ -0,0 +1,127 @@
+package erasure
+
+import "errors"
+
+var errSingular = errors.New("matrix is singular")
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1, the
+// field used by most Reed-Solomon implementations
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+func gfExp(a byte, n int) byte {
+	switch {
+	case n == 0:
+		return 1
+	case a == 0:
+		return 0
+	}
+	return expTable[int(logTable[a])*n%255]
+}
+
+// mulAdd adds c*in to out
+func mulAdd(c byte, in, out []byte) {
+	t := &mulTable[c]
+	for i, b := range in {
+		out[i] ^= t[b]
+	}
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+// vandermonde returns a matrix whose any cols rows are linearly independent
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = gfExp(byte(r), c)
+		}
+	}
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	res := newMatrix(len(m), len(o[0]))
+	for r := range res {
+		for c := range res[r] {
+			var v byte
+			for i := range o {
+				v ^= mulTable[m[r][i]][o[i][c]]
+			}
+			res[r][c] = v
+		}
+	}
+	return res
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan elimination
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		if v := work[c][c]; v != 1 {
+			inv := gfInv(v)
+			for i := range work[c] {
+				work[c][i] = mulTable[inv][work[c][i]]
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				mulAdd(work[r][c], work[c], work[r])
+			}
+		}
+	}
+
+	res := newMatrix(n, n)
+	for r := range res {
+		copy(res[r], work[r][n:])
+	}
+	return res, nil
+}
@@ -0,0 +1,577 @@
+package erasure
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checksumSize is the CRC-32 following every block in a shard file, a block
+// failing it is treated as missing
+const checksumSize = 4
+
+const tmpSuffix = ".tmp"
+
+// Manifest describes an erasure coded file. The content is cut into stripes
+// of DataShards blocks of BlockSize bytes, each stripe gets ParityShards
+// parity blocks and block i of every stripe is appended to shard file i. The
+// blocks of the last stripe are shortened to fit its data.
+type Manifest struct {
+	ID           string `json:"id"`
+	Size         int64  `json:"size"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	BlockSize    int    `json:"block_size"`
+}
+
+func (m *Manifest) shards() int {
+	return m.DataShards + m.ParityShards
+}
+
+func (m *Manifest) stripeSize() int64 {
+	return int64(m.DataShards) * int64(m.BlockSize)
+}
+
+func (m *Manifest) stripes() int64 {
+	return (m.Size + m.stripeSize() - 1) / m.stripeSize()
+}
+
+// block returns the offset of the blocks of a stripe in the shard files, the
+// length of the blocks and of the data they carry
+func (m *Manifest) block(stripe int64) (int64, int, int) {
+	data := int(min(m.stripeSize(), m.Size-stripe*m.stripeSize()))
+	return stripe * int64(m.BlockSize+checksumSize), (data + m.DataShards - 1) / m.DataShards, data
+}
+
+// Store keeps the shards of erasure coded files spread over directories, one
+// per disk. Shard i of a file goes to the i-th directory after one picked by
+// the file id, so with at least as many directories as shards losing
+// ParityShards directories loses no data.
+type Store struct {
+	dirs         []string
+	dataShards   int
+	parityShards int
+	blockSize    int
+	codec        *Codec
+}
+
+func NewStore(dirs []string, dataShards, parityShards, blockSize int) (*Store, error) {
+	codec, err := NewCodec(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize <= 0 {
+		return nil, errors.New("erasure block size must be positive")
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{
+		dirs:         dirs,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		blockSize:    blockSize,
+		codec:        codec,
+	}, nil
+}
+
+// ErrInvalidID is returned for shard set ids not made by Create
+var ErrInvalidID = errors.New("invalid shard set id")
+
+const idLength = 32
+
+// validID reports whether id is the hex id of a shard set, other names are
+// not shards even if they are found in the directories
+func validID(id string) bool {
+	if len(id) != idLength {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (s *Store) codecFor(m *Manifest) (*Codec, error) {
+	if m.DataShards == s.dataShards && m.ParityShards == s.parityShards {
+		return s.codec, nil
+	}
+	return NewCodec(m.DataShards, m.ParityShards)
+}
+
+func (s *Store) shardPath(id string, i int) string {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	dir := s.dirs[(int(h.Sum32()%uint32(len(s.dirs)))+i)%len(s.dirs)]
+	return filepath.Join(dir, id[:2], id+"."+strconv.Itoa(i))
+}
+
+// findShard returns the path of a shard looking into every directory in
+// case they were reordered, or an empty string
+func (s *Store) findShard(id string, i int) string {
+	path := s.shardPath(id, i)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	for _, dir := range s.dirs {
+		p := filepath.Join(dir, id[:2], id+"."+strconv.Itoa(i))
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// Writer encodes a file while it is written, the shards become visible on
+// Close
+type Writer struct {
+	s        *Store
+	manifest Manifest
+	paths    []string
+	files    []*os.File
+	out      []*bufio.Writer
+	stripe   []byte
+	blocks   [][]byte
+	sum      []byte
+}
+
+func (s *Store) Create() (*Writer, error) {
+	b := make([]byte, idLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		s: s,
+		manifest: Manifest{ID: hex.EncodeToString(b), DataShards: s.dataShards, ParityShards: s.parityShards,
+			BlockSize: s.blockSize},
+		stripe: make([]byte, 0, s.dataShards*s.blockSize),
+		sum:    make([]byte, checksumSize),
+	}
+	for i := 0; i < w.manifest.shards(); i++ {
+		path := s.shardPath(w.manifest.ID, i)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			w.Abort()
+			return nil, err
+		}
+		f, err := os.Create(path + tmpSuffix)
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+		w.paths = append(w.paths, path)
+		w.files = append(w.files, f)
+		w.out = append(w.out, bufio.NewWriter(f))
+		w.blocks = append(w.blocks, make([]byte, s.blockSize))
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), cap(w.stripe)-len(w.stripe))
+		w.stripe = append(w.stripe, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.stripe) == cap(w.stripe) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *Writer) flush() error {
+	k := w.manifest.DataShards
+	length := (len(w.stripe) + k - 1) / k
+	blocks := make([][]byte, len(w.blocks))
+	for i := range blocks {
+		blocks[i] = w.blocks[i][:length]
+		if i < k {
+			clear(blocks[i])
+			copy(blocks[i], w.stripe[min(i*length, len(w.stripe)):min((i+1)*length, len(w.stripe))])
+		}
+	}
+	w.s.codec.Encode(blocks)
+
+	for i, block := range blocks {
+		binary.BigEndian.PutUint32(w.sum, crc32.ChecksumIEEE(block))
+		if _, err := w.out[i].Write(block); err != nil {
+			return err
+		}
+		if _, err := w.out[i].Write(w.sum); err != nil {
+			return err
+		}
+	}
+	w.manifest.Size += int64(len(w.stripe))
+	w.stripe = w.stripe[:0]
+	return nil
+}
+
+// Close writes the last stripe and moves the shards in place
+func (w *Writer) Close() (*Manifest, error) {
+	err := func() error {
+		if len(w.stripe) > 0 {
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+		for i, f := range w.files {
+			if err := w.out[i].Flush(); err != nil {
+				return err
+			}
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+		w.files = nil
+		for _, path := range w.paths {
+			if err := os.Rename(path+tmpSuffix, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &w.manifest, nil
+}
+
+// Abort removes everything written so far
+func (w *Writer) Abort() {
+	for _, f := range w.files {
+		_ = f.Close()
+	}
+	for _, path := range w.paths {
+		_ = os.Remove(path + tmpSuffix)
+		_ = os.Remove(path)
+	}
+}
+
+// Reader reads an erasure coded file reconstructing blocks of missing or
+// corrupted shards
+type Reader struct {
+	m     *Manifest
+	codec *Codec
+	files []*os.File
+	pos   int64
+
+	current int64
+	data    []byte
+	bufs    [][]byte
+}
+
+func (s *Store) Open(m *Manifest) (*Reader, error) {
+	if !validID(m.ID) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidID, m.ID)
+	}
+	codec, err := s.codecFor(m)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{m: m, codec: codec, current: -1, files: make([]*os.File, m.shards())}
+	available := 0
+	for i := range r.files {
+		path := s.findShard(m.ID, i)
+		if path == "" {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		r.files[i] = f
+		available++
+	}
+	if available < m.DataShards {
+		_ = r.Close()
+		return nil, fmt.Errorf("%w: %d of %d shards of %s found", ErrTooFewShards, available, m.shards(), m.ID)
+	}
+	return r, nil
+}
+
+// Name identifies the file in errors
+func (r *Reader) Name() string {
+	return "erasure:" + r.m.ID
+}
+
+// readBlock reads a block of shard i, nil when it is missing or corrupted
+func (r *Reader) readBlock(i int, offset int64, length int) []byte {
+	if r.files[i] == nil {
+		return nil
+	}
+	if r.bufs == nil {
+		r.bufs = make([][]byte, len(r.files))
+	}
+	if cap(r.bufs[i]) < length+checksumSize {
+		r.bufs[i] = make([]byte, r.m.BlockSize+checksumSize)
+	}
+	buf := r.bufs[i][:length+checksumSize]
+	if _, err := r.files[i].ReadAt(buf, offset); err != nil {
+		return nil
+	}
+	if crc32.ChecksumIEEE(buf[:length]) != binary.BigEndian.Uint32(buf[length:]) {
+		return nil
+	}
+	return buf[:length]
+}
+
+// stripe returns the data blocks of a stripe, or all blocks when all is set.
+// The blocks given in skip are recomputed even if they could be read.
+func (r *Reader) stripe(stripe int64, all bool, skip map[int]bool) ([][]byte, int, error) {
+	offset, length, data := r.m.block(stripe)
+	blocks := make([][]byte, r.m.shards())
+	read := 0
+	missingData := false
+	for i := range blocks {
+		if !all && read == r.m.DataShards && i >= r.m.DataShards {
+			break
+		}
+		if !skip[i] {
+			blocks[i] = r.readBlock(i, offset, length)
+		}
+		if blocks[i] != nil {
+			read++
+		} else if i < r.m.DataShards {
+			missingData = true
+		}
+	}
+	// parity is only needed to recover data unless every block is asked for
+	if missingData || all && read < r.m.shards() {
+		if err := r.codec.Reconstruct(blocks, length); err != nil {
+			return nil, 0, fmt.Errorf("stripe %d of %s: %w", stripe, r.m.ID, err)
+		}
+	}
+	return blocks, data, nil
+}
+
+func (r *Reader) load(stripe int64) error {
+	blocks, data, err := r.stripe(stripe, false, nil)
+	if err != nil {
+		r.current = -1
+		return err
+	}
+	r.data = r.data[:0]
+	for _, block := range blocks[:r.m.DataShards] {
+		r.data = append(r.data, block...)
+	}
+	r.data = r.data[:data]
+	r.current = stripe
+	return nil
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= r.m.Size {
+			return n, io.EOF
+		}
+		stripe := off / r.m.stripeSize()
+		if stripe != r.current {
+			if err := r.load(stripe); err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], r.data[off-stripe*r.m.stripeSize():])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.m.Size {
+		return 0, io.EOF
+	}
+	n, err := r.ReadAt(p[:min(int64(len(p)), r.m.Size-r.pos)], r.pos)
+	r.pos += int64(n)
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.m.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("erasure: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *Reader) Close() error {
+	for _, f := range r.files {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+	return nil
+}
+
+// Heal checks every block of the file and rewrites the shards that are
+// missing, misplaced or corrupted. It returns the number of rewritten shards.
+func (s *Store) Heal(m *Manifest) (int, error) {
+	r, err := s.Open(m)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	bad := map[int]bool{}
+	for i, f := range r.files {
+		if f == nil || f.Name() != s.shardPath(m.ID, i) {
+			bad[i] = true
+		}
+	}
+	for stripe := int64(0); stripe < m.stripes(); stripe++ {
+		offset, length, _ := m.block(stripe)
+		for i := range r.files {
+			if !bad[i] && r.readBlock(i, offset, length) == nil {
+				bad[i] = true
+			}
+		}
+	}
+	if len(bad) == 0 {
+		return 0, nil
+	}
+	if len(bad) > m.ParityShards {
+		return 0, fmt.Errorf("%w: %d of %d shards of %s lost", ErrTooFewShards, len(bad), m.shards(), m.ID)
+	}
+
+	files := map[int]*os.File{}
+	out := map[int]*bufio.Writer{}
+	defer func() {
+		for i, f := range files {
+			_ = f.Close()
+			_ = os.Remove(s.shardPath(m.ID, i) + tmpSuffix)
+		}
+	}()
+	for i := range bad {
+		path := s.shardPath(m.ID, i)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			return 0, err
+		}
+		f, err := os.Create(path + tmpSuffix)
+		if err != nil {
+			return 0, err
+		}
+		files[i], out[i] = f, bufio.NewWriter(f)
+	}
+
+	sum := make([]byte, checksumSize)
+	for stripe := int64(0); stripe < m.stripes(); stripe++ {
+		blocks, _, err := r.stripe(stripe, true, bad)
+		if err != nil {
+			return 0, err
+		}
+		for i, w := range out {
+			binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(blocks[i]))
+			if _, err := w.Write(blocks[i]); err != nil {
+				return 0, err
+			}
+			if _, err := w.Write(sum); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for i, f := range files {
+		if err := out[i].Flush(); err != nil {
+			return 0, err
+		}
+		if err := f.Sync(); err != nil {
+			return 0, err
+		}
+		if err := f.Close(); err != nil {
+			return 0, err
+		}
+		delete(files, i)
+		path := s.shardPath(m.ID, i)
+		if err := os.Rename(path+tmpSuffix, path); err != nil {
+			return 0, err
+		}
+		// a copy found in another directory is replaced by the healed one
+		if old := r.files[i]; old != nil && old.Name() != path {
+			_ = os.Remove(old.Name())
+		}
+	}
+	return len(bad), nil
+}
+
+// Remove deletes the shards of the file
+func (s *Store) Remove(id string) error {
+	if !validID(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	var errs []error
+	for _, dir := range s.dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, id[:2], id+".*"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sets returns the ids of the stored files with the time their newest shard
+// was written, shards left by interrupted writes included
+func (s *Store) Sets() (map[string]time.Time, error) {
+	res := map[string]time.Time{}
+	for _, dir := range s.dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if path == dir && errors.Is(err, fs.ErrNotExist) {
+				// a lost disk, its shards are rebuilt by healing
+				return nil
+			}
+			if err != nil || d.IsDir() {
+				return err
+			}
+			id, _, ok := strings.Cut(d.Name(), ".")
+			if !ok || !validID(id) {
+				// not a shard, left alone
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if info.ModTime().After(res[id]) {
+				res[id] = info.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
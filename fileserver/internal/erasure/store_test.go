@@ -0,0 +1,168 @@
+package erasure
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T, dirs, k, m, blockSize int) *Store {
+	t.Helper()
+	root := t.TempDir()
+	paths := make([]string, dirs)
+	for i := range paths {
+		paths[i] = filepath.Join(root, "d"+string(rune('0'+i)))
+	}
+	s, err := NewStore(paths, k, m, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func write(t *testing.T, s *Store, data []byte) *Manifest {
+	t.Helper()
+	w, err := s.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func readAll(t *testing.T, s *Store, m *Manifest) []byte {
+	t.Helper()
+	r, err := s.Open(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	s := newTestStore(t, 6, 4, 2, 100)
+	for _, size := range []int{0, 1, 399, 400, 401, 12345} {
+		data := testData(size)
+		m := write(t, s, data)
+		if m.Size != int64(size) {
+			t.Fatalf("size %d recorded as %d", size, m.Size)
+		}
+		if got := readAll(t, s, m); !bytes.Equal(got, data) {
+			t.Fatalf("size %d: content differs", size)
+		}
+	}
+}
+
+func TestStoreLostDirectories(t *testing.T) {
+	s := newTestStore(t, 6, 4, 2, 100)
+	data := testData(5000)
+	m := write(t, s, data)
+
+	for _, dir := range s.dirs[:2] {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readAll(t, s, m); !bytes.Equal(got, data) {
+		t.Fatal("content differs after losing two directories")
+	}
+
+	rebuilt, err := s.Heal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt != 2 {
+		t.Fatalf("rebuilt %d shards, expected 2", rebuilt)
+	}
+	// the healed shards carry the data again without the others
+	for _, dir := range s.dirs[2:4] {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readAll(t, s, m); !bytes.Equal(got, data) {
+		t.Fatal("content differs after healing")
+	}
+}
+
+func TestStoreCorruptedShard(t *testing.T) {
+	s := newTestStore(t, 3, 2, 1, 100)
+	data := testData(1000)
+	m := write(t, s, data)
+
+	path := s.shardPath(m.ID, 0)
+	shard, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard[10] ^= 0xff
+	if err := os.WriteFile(path, shard, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, s, m); !bytes.Equal(got, data) {
+		t.Fatal("content differs with a corrupted shard")
+	}
+	if rebuilt, err := s.Heal(m); err != nil || rebuilt != 1 {
+		t.Fatalf("heal rebuilt %d shards: %v", rebuilt, err)
+	}
+}
+
+func TestStoreTooManyLost(t *testing.T) {
+	s := newTestStore(t, 3, 2, 1, 100)
+	m := write(t, s, testData(1000))
+	for _, dir := range s.dirs[:2] {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Open(m); err == nil {
+		t.Fatal("opened a file missing two of three shards")
+	}
+}
+
+func TestStoreSetsSkipsStrayFiles(t *testing.T) {
+	s := newTestStore(t, 3, 2, 1, 100)
+	m := write(t, s, testData(10))
+	for _, name := range []string{".foo", "a.b", "x"} {
+		if err := os.WriteFile(filepath.Join(s.dirs[0], name), nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sets, err := s.Sets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 {
+		t.Fatalf("expected only %s, got %v", m.ID, sets)
+	}
+	if _, ok := sets[m.ID]; !ok {
+		t.Fatalf("%s not listed", m.ID)
+	}
+	if err := s.Remove("a"); err == nil {
+		t.Fatal("removed an invalid id")
+	}
+	if err := s.Remove(m.ID); err != nil {
+		t.Fatal(err)
+	}
+}
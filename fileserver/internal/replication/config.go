@@ -0,0 +1,56 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+// Config makes the server a primary shipping its changes to Replicas or a
+// read-only replica accepting them. Both sides share Token.
+type Config struct {
+	Role          string        `yaml:"role" env:"FILESERVER_REPLICATION_ROLE"`
+	Replicas      []string      `yaml:"replicas" env:"FILESERVER_REPLICATION_REPLICAS"`
+	Token         string        `yaml:"token" env:"FILESERVER_REPLICATION_TOKEN"`
+	RetryInterval time.Duration `yaml:"retry_interval" env:"FILESERVER_REPLICATION_RETRY_INTERVAL" default:"5s"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		RetryInterval: 5 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	switch c.Role {
+	case "":
+		return nil
+	case RolePrimary, RoleReplica:
+	default:
+		return fmt.Errorf("unknown replication role %q", c.Role)
+	}
+	if c.Token == "" {
+		return errors.New("replication requires a token")
+	}
+	if c.Role == RolePrimary && len(c.Replicas) == 0 {
+		return errors.New("primary requires at least one replica")
+	}
+	for _, replica := range c.Replicas {
+		u, err := url.Parse(replica)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("replica url %q must be an absolute http(s) url", replica)
+		}
+	}
+	return nil
+}
+
+// String hides the token from logged configuration
+func (c Config) String() string {
+	return fmt.Sprintf("{Role:%s Replicas:%v RetryInterval:%s}", c.Role, c.Replicas, c.RetryInterval)
+}
@@ -0,0 +1,195 @@
+package replication
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+// errBucketMissing is returned when the peer does not have the bucket yet
+var errBucketMissing = errors.New("bucket missing on peer")
+
+// Peer changes the files of another fileserver through its /replication
+// routes
+type Peer struct {
+	URL    string
+	token  string
+	client *http.Client
+}
+
+func NewPeer(u, token string) *Peer {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Minute
+	return &Peer{
+		URL:    strings.TrimSuffix(u, "/"),
+		token:  token,
+		client: &http.Client{Transport: transport},
+	}
+}
+
+// PutFile sends the current state of the file creating the bucket on the
+// peer when needed. A file removed meanwhile is skipped.
+func (p *Peer) PutFile(info *storage.BucketInfo, st *storage.Storage, filename string) error {
+	err := p.putFile(info.Name, st, filename)
+	if errors.Is(err, errBucketMissing) {
+		if err := p.CreateBucket(info); err != nil {
+			return err
+		}
+		err = p.putFile(info.Name, st, filename)
+	}
+	return err
+}
+
+func (p *Peer) putFile(bucket string, st *storage.Storage, filename string) error {
+	fi, err := st.Stat(filename)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	file, err := st.Get(filename)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	req, err := p.request(http.MethodPut, p.fileURL(bucket, filename), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size
+	if fi.ContentType != "" {
+		req.Header.Set("Content-Type", fi.ContentType)
+	}
+	if fi.ExpiresAt != nil {
+		req.Header.Set(ExpiresAtHeader, fi.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	for key, value := range fi.Metadata {
+		req.Header.Set(metadataHeaderPrefix+key, value)
+	}
+	if sum, err := hex.DecodeString(fi.SHA256); err == nil && len(sum) > 0 {
+		// the peer refuses content changed between Stat and Get, the next
+		// attempt sends the new state
+		req.Header.Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	}
+
+	status, err := p.do(req)
+	if status == http.StatusNotFound {
+		return errBucketMissing
+	}
+	return err
+}
+
+func (p *Peer) DeleteFile(bucket, filename string) error {
+	req, err := p.request(http.MethodDelete, p.fileURL(bucket, filename), nil)
+	if err != nil {
+		return err
+	}
+	status, err := p.do(req)
+	if status == http.StatusNotFound {
+		// nothing to delete
+		return nil
+	}
+	return err
+}
+
+func (p *Peer) CreateBucket(info *storage.BucketInfo) error {
+	body, err := json.Marshal(struct {
+		Name string `json:"name"`
+		storage.BucketSettings
+	}{info.Name, info.Settings})
+	if err != nil {
+		return err
+	}
+	req, err := p.request(http.MethodPost, p.URL+"/replication/buckets", strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = p.do(req)
+	return err
+}
+
+func (p *Peer) DeleteBucket(bucket string) error {
+	req, err := p.request(http.MethodDelete, p.URL+"/replication/buckets/"+url.PathEscape(bucket), nil)
+	if err != nil {
+		return err
+	}
+	_, err = p.do(req)
+	return err
+}
+
+// ListFiles returns the files of the bucket on the peer by name, a missing
+// bucket has no files
+func (p *Peer) ListFiles(bucket string) (map[string]storage.FileInfo, error) {
+	req, err := p.request(http.MethodGet, p.URL+"/buckets/"+url.PathEscape(bucket)+"/files?format=json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return map[string]storage.FileInfo{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing files: unexpected status %s", resp.Status)
+	}
+
+	var files []storage.FileInfo
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+	res := make(map[string]storage.FileInfo, len(files))
+	for _, f := range files {
+		res[f.Name] = f
+	}
+	return res, nil
+}
+
+func (p *Peer) fileURL(bucket, filename string) string {
+	return p.URL + "/replication/buckets/" + url.PathEscape(bucket) + "/files/" + url.PathEscape(filename)
+}
+
+// request authenticates the request with the shared token, peers serve such
+// requests locally
+func (p *Peer) request(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(TokenHeader, p.token)
+	return req, nil
+}
+
+// do sends the request and returns the status of the response, statuses
+// other than 2xx are returned as errors too
+func (p *Peer) do(req *http.Request) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s %s: unexpected status %s: %s",
+			req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,389 @@
+package replication
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+const (
+	// TokenHeader authenticates requests between fileservers
+	TokenHeader = "X-Replication-Token"
+	// ExpiresAtHeader carries the expiry of a replicated file as RFC 3339
+	ExpiresAtHeader = "X-Expires-At"
+
+	metadataHeaderPrefix = "X-Meta-"
+	changesPerPage       = 100
+)
+
+// Primary ships the changes of every bucket to the replicas. The change
+// journal of each bucket is the replication queue: a replica is sent the
+// changes after its cursor, the last sequence number it applied, which is
+// persisted so shipping resumes after a restart. A replica without a cursor,
+// or one that fell behind the retained journal, is resynchronized by
+// comparing file listings.
+type Primary struct {
+	config   *Config
+	buckets  *storage.Buckets
+	replicas []*replica
+
+	// Filter, when set, limits the files sent to a replica. The replicas
+	// then keep files the primary does not have.
+	Filter func(replica, bucket, filename string) bool
+}
+
+type replica struct {
+	*Peer
+	path string
+	wake chan struct{}
+
+	mu          sync.Mutex
+	cursors     map[string]uint64
+	lastSuccess time.Time
+	lastError   string
+	resyncs     int
+}
+
+// cursorFile is the persisted state of a replica
+type cursorFile struct {
+	URL     string            `json:"url"`
+	Cursors map[string]uint64 `json:"cursors"`
+}
+
+// ReplicaStatus reports how far a replica lags behind
+type ReplicaStatus struct {
+	URL         string               `json:"url"`
+	LastSuccess *time.Time           `json:"last_success,omitempty"`
+	LastError   string               `json:"last_error,omitempty"`
+	Resyncs     int                  `json:"resyncs"`
+	Buckets     map[string]BucketLag `json:"buckets"`
+}
+
+type BucketLag struct {
+	// Applied is the last change the replica received, Latest the last one
+	// journaled on the primary
+	Applied uint64 `json:"applied"`
+	Latest  uint64 `json:"latest"`
+	Pending uint64 `json:"pending"`
+	// LagSeconds is the age of the oldest change not yet replicated
+	LagSeconds float64 `json:"lag_seconds"`
+	// Resync is set while the bucket waits for a full resynchronization
+	Resync bool `json:"resync,omitempty"`
+}
+
+func NewPrimary(config *Config, buckets *storage.Buckets, dir string) (*Primary, error) {
+	p := &Primary{
+		config:  config,
+		buckets: buckets,
+	}
+
+	for _, u := range config.Replicas {
+		r := &replica{
+			Peer:    NewPeer(u, config.Token),
+			wake:    make(chan struct{}, 1),
+			cursors: map[string]uint64{},
+		}
+		r.path = filepath.Join(dir, cursorName(r.URL))
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+		p.replicas = append(p.replicas, r)
+	}
+	return p, nil
+}
+
+// cursorName names the state file after the replica url
+func cursorName(u string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(u)) + ".json"
+}
+
+func (r *replica) load() error {
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state cursorFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Resynchronizing %s, its replication state is unreadable: %v", r.URL, err)
+		return nil
+	}
+	if state.Cursors != nil {
+		r.cursors = state.Cursors
+	}
+	return nil
+}
+
+// save writes the cursors to a temporary file first so a crash never leaves
+// a partial one
+func (r *replica) save() error {
+	r.mu.Lock()
+	data, err := json.Marshal(cursorFile{URL: r.URL, Cursors: r.cursors})
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func (r *replica) cursor(bucket string) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seq, ok := r.cursors[bucket]
+	return seq, ok
+}
+
+func (r *replica) setCursor(bucket string, seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cursors[bucket] = seq
+}
+
+func (r *replica) dropCursor(bucket string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.cursors, bucket)
+}
+
+// Notify wakes the replicas up, changes are read from the journals
+func (p *Primary) Notify(storage.Event) {
+	for _, r := range p.replicas {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run ships changes to the replicas in the background
+func (p *Primary) Run() {
+	p.buckets.Subscribe(p.Notify)
+	for _, r := range p.replicas {
+		go p.run(r)
+	}
+}
+
+func (p *Primary) run(r *replica) {
+	retry := p.config.RetryInterval
+	if retry <= 0 {
+		retry = 5 * time.Second
+	}
+	for {
+		err := p.sync(r)
+		if saveErr := r.save(); saveErr != nil {
+			log.Printf("Failed to persist replication state of %s: %v", r.URL, saveErr)
+		}
+
+		r.mu.Lock()
+		if err != nil {
+			r.lastError = err.Error()
+		} else {
+			r.lastSuccess, r.lastError = time.Now().UTC(), ""
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Replication to %s failed, retrying in %s: %v", r.URL, retry, err)
+			time.Sleep(retry)
+			continue
+		}
+		select {
+		case <-r.wake:
+		case <-time.After(retry):
+		}
+	}
+}
+
+// sync brings the replica up to date with every bucket and removes the
+// buckets deleted on the primary
+func (p *Primary) sync(r *replica) error {
+	for _, info := range p.buckets.List() {
+		st, err := p.buckets.Get(info.Name)
+		if err != nil {
+			// deleted meanwhile
+			continue
+		}
+		if err := p.syncBucket(r, &info, st); err != nil {
+			return fmt.Errorf("bucket %s: %w", info.Name, err)
+		}
+	}
+
+	r.mu.Lock()
+	known := make([]string, 0, len(r.cursors))
+	for bucket := range r.cursors {
+		known = append(known, bucket)
+	}
+	r.mu.Unlock()
+	for _, bucket := range known {
+		if _, err := p.buckets.Get(bucket); err == nil {
+			continue
+		}
+		if err := r.DeleteBucket(bucket); err != nil {
+			return fmt.Errorf("bucket %s: %w", bucket, err)
+		}
+		r.dropCursor(bucket)
+	}
+	return nil
+}
+
+func (p *Primary) syncBucket(r *replica, info *storage.BucketInfo, st *storage.Storage) error {
+	cursor, ok := r.cursor(info.Name)
+	for ok {
+		page, err := st.Changes(cursor, changesPerPage)
+		if errors.Is(err, storage.ErrChangesCompacted) {
+			log.Printf("Replica %s fell behind the journal of bucket %s, resynchronizing", r.URL, info.Name)
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// only the last change of a file in the page needs shipping, files
+		// are sent in their current state anyway
+		last := map[string]int{}
+		for i, c := range page.Changes {
+			last[c.Name] = i
+		}
+		for i, c := range page.Changes {
+			if last[c.Name] == i {
+				if err := p.apply(r, info, st, &c); err != nil {
+					return err
+				}
+			}
+			r.setCursor(info.Name, c.Seq)
+		}
+		if len(page.Changes) < changesPerPage {
+			return nil
+		}
+		cursor = page.Next
+	}
+	return p.resync(r, info, st)
+}
+
+func (p *Primary) apply(r *replica, info *storage.BucketInfo, st *storage.Storage, c *storage.Change) error {
+	if !p.sends(r, info.Name, c.Name) {
+		return nil
+	}
+	if c.Type == storage.EventDeleted {
+		return r.DeleteFile(info.Name, c.Name)
+	}
+	return r.PutFile(info, st, c.Name)
+}
+
+func (p *Primary) sends(r *replica, bucket, filename string) bool {
+	return p.Filter == nil || p.Filter(r.URL, bucket, filename)
+}
+
+// resync compares the listing of the replica with the bucket, sends what
+// differs and, without a filter, removes what the primary does not have.
+// Changes made meanwhile are shipped afterwards from the journal.
+func (p *Primary) resync(r *replica, info *storage.BucketInfo, st *storage.Storage) error {
+	page, err := st.Changes(math.MaxUint64, 1)
+	if err != nil {
+		return err
+	}
+	latest := page.Latest
+
+	if err := r.CreateBucket(info); err != nil {
+		return err
+	}
+	remote, err := r.ListFiles(info.Name)
+	if err != nil {
+		return err
+	}
+
+	local, err := st.List()
+	if err != nil {
+		return err
+	}
+	for _, f := range local {
+		rf, ok := remote[f.Name]
+		delete(remote, f.Name)
+		if !p.sends(r, info.Name, f.Name) {
+			continue
+		}
+		if ok && f.SHA256 != "" && rf.SHA256 == f.SHA256 && rf.ContentType == f.ContentType &&
+			maps.Equal(rf.Metadata, f.Metadata) {
+			continue
+		}
+		if err := r.PutFile(info, st, f.Name); err != nil {
+			return err
+		}
+	}
+	if p.Filter == nil {
+		for name := range remote {
+			if err := r.DeleteFile(info.Name, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.setCursor(info.Name, latest)
+	r.mu.Lock()
+	r.resyncs++
+	r.mu.Unlock()
+	log.Printf("Resynchronized bucket %s to %s", info.Name, r.URL)
+	return nil
+}
+
+// Status reports the lag of every replica behind every bucket
+func (p *Primary) Status() []ReplicaStatus {
+	now := time.Now()
+	res := make([]ReplicaStatus, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		r.mu.Lock()
+		status := ReplicaStatus{URL: r.URL, LastError: r.lastError, Resyncs: r.resyncs, Buckets: map[string]BucketLag{}}
+		if !r.lastSuccess.IsZero() {
+			lastSuccess := r.lastSuccess
+			status.LastSuccess = &lastSuccess
+		}
+		r.mu.Unlock()
+
+		for _, info := range p.buckets.List() {
+			st, err := p.buckets.Get(info.Name)
+			if err != nil {
+				continue
+			}
+			status.Buckets[info.Name] = bucketLag(r, info.Name, st, now)
+		}
+		res = append(res, status)
+	}
+	return res
+}
+
+func bucketLag(r *replica, bucket string, st *storage.Storage, now time.Time) BucketLag {
+	cursor, ok := r.cursor(bucket)
+	page, err := st.Changes(cursor, 1)
+	if page == nil {
+		log.Printf("Failed to read changes of bucket %s: %v", bucket, err)
+		return BucketLag{Applied: cursor}
+	}
+
+	lag := BucketLag{Applied: cursor, Latest: page.Latest, Resync: !ok || err != nil}
+	if page.Latest > cursor {
+		lag.Pending = page.Latest - cursor
+	}
+	if len(page.Changes) > 0 && lag.Pending > 0 {
+		lag.LagSeconds = now.Sub(page.Changes[0].Time).Seconds()
+	}
+	return lag
+}
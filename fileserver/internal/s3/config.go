@@ -0,0 +1,49 @@
+package s3
+
+import "fmt"
+
+type Credential struct {
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+type Config struct {
+	Enabled     bool         `yaml:"enabled" env:"FILESERVER_S3_ENABLED" default:"false"`
+	BindPort    string       `yaml:"port" env:"FILESERVER_S3_PORT" default:"9002"`
+	BindHost    string       `yaml:"host" env:"FILESERVER_S3_HOST" default:"0.0.0.0"`
+	Region      string       `yaml:"region" env:"FILESERVER_S3_REGION" default:"us-east-1"`
+	Bucket      string       `yaml:"bucket" env:"FILESERVER_S3_BUCKET" default:"files"`
+	AccessKey   string       `yaml:"access_key" env:"FILESERVER_S3_ACCESS_KEY"`
+	SecretKey   string       `yaml:"secret_key" env:"FILESERVER_S3_SECRET_KEY"`
+	Credentials []Credential `yaml:"credentials"`
+	// ReadOnly denies requests changing data, replicas set it
+	ReadOnly bool `yaml:"read_only" env:"FILESERVER_S3_READ_ONLY" default:"false"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Enabled:  false,
+		BindPort: "9002",
+		BindHost: "0.0.0.0",
+		Region:   "us-east-1",
+		Bucket:   "files",
+	}
+}
+
+// secrets returns secret keys indexed by access key
+func (c *Config) secrets() map[string]string {
+	res := make(map[string]string, len(c.Credentials)+1)
+	for _, cred := range c.Credentials {
+		res[cred.AccessKey] = cred.SecretKey
+	}
+	if c.AccessKey != "" {
+		res[c.AccessKey] = c.SecretKey
+	}
+	return res
+}
+
+// String hides secret keys from logged configuration
+func (c Config) String() string {
+	return fmt.Sprintf("{Enabled:%t Address:%s:%s Region:%s Bucket:%s Credentials:%d ReadOnly:%t}",
+		c.Enabled, c.BindHost, c.BindPort, c.Region, c.Bucket, len(c.secrets()), c.ReadOnly)
+}
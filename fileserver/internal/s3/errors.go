@@ -0,0 +1,103 @@
+package s3
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+)
+
+// apiError is an S3 error as described in
+// https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type apiError struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied = &apiError{
+		"AccessDenied", "Access Denied", http.StatusForbidden}
+	errInvalidAccessKeyID = &apiError{
+		"InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records.", http.StatusForbidden}
+	errSignatureMismatch = &apiError{
+		"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.",
+		http.StatusForbidden}
+	errAuthorizationMalformed = &apiError{
+		"AuthorizationHeaderMalformed", "The authorization header is malformed.", http.StatusBadRequest}
+	errUnsupportedAlgorithm = &apiError{
+		"InvalidArgument", "Only AWS4-HMAC-SHA256 signatures are supported.", http.StatusBadRequest}
+	errRequestTimeTooSkewed = &apiError{
+		"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.",
+		http.StatusForbidden}
+	errPresignExpired = &apiError{
+		"AccessDenied", "Request has expired", http.StatusForbidden}
+	errMissingContentSHA256 = &apiError{
+		"InvalidRequest", "Missing required header for this request: x-amz-content-sha256", http.StatusBadRequest}
+	errContentSHA256Mismatch = &apiError{
+		"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.",
+		http.StatusBadRequest}
+	errIncompleteBody = &apiError{
+		"IncompleteBody", "The request body is malformed or shorter than declared.", http.StatusBadRequest}
+	errInvalidDigest = &apiError{
+		"InvalidDigest", "The Content-MD5 you specified is not valid.", http.StatusBadRequest}
+	errBadDigest = &apiError{
+		"BadDigest", "The Content-MD5 you specified did not match what we received.", http.StatusBadRequest}
+	errMalformedXML = &apiError{
+		"MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.",
+		http.StatusBadRequest}
+	errInvalidArgument = &apiError{
+		"InvalidArgument", "Invalid Argument", http.StatusBadRequest}
+	errInvalidKey = &apiError{
+		"InvalidArgument", "Object keys must be a single path element.", http.StatusBadRequest}
+	errNoSuchBucket = &apiError{
+		"NoSuchBucket", "The specified bucket does not exist.", http.StatusNotFound}
+	errNoSuchKey = &apiError{
+		"NoSuchKey", "The specified key does not exist.", http.StatusNotFound}
+	errEntityTooLarge = &apiError{
+		"EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", http.StatusBadRequest}
+	errStorageFull = &apiError{
+		"InsufficientStorage", "The storage quota has been exceeded.", http.StatusInsufficientStorage}
+	errNotImplemented = &apiError{
+		"NotImplemented", "A header or query you provided implies functionality that is not implemented.",
+		http.StatusNotImplemented}
+	errInternal = &apiError{
+		"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, apiErr *apiError) {
+	resp := errorResponse{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		Resource:  r.URL.Path,
+		RequestID: w.Header().Get("x-amz-request-id"),
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(apiErr.Status)
+		return
+	}
+	writeXML(w, apiErr.Status, resp)
+}
+
+func writeXML(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		log.Printf("Failed to write response: %v", err)
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const maxChunkSize = 16 * 1024 * 1024
+
+// hashReader checks the digest of everything read from r once r is exhausted
+type hashReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected []byte
+	mismatch *apiError
+}
+
+func newSHA256Reader(r io.Reader, hexSum string) (io.Reader, *apiError) {
+	expected, err := hex.DecodeString(hexSum)
+	if err != nil || len(expected) != sha256.Size {
+		return nil, errContentSHA256Mismatch
+	}
+	return &hashReader{r: r, hash: sha256.New(), expected: expected, mismatch: errContentSHA256Mismatch}, nil
+}
+
+func newMD5Reader(r io.Reader, base64Sum string) (io.Reader, *apiError) {
+	expected, err := base64.StdEncoding.DecodeString(base64Sum)
+	if err != nil || len(expected) != md5.Size {
+		return nil, errInvalidDigest
+	}
+	return &hashReader{r: r, hash: md5.New(), expected: expected, mismatch: errBadDigest}, nil
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) && !bytes.Equal(h.hash.Sum(nil), h.expected) {
+		return n, h.mismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked request body, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+// When key is set every chunk signature is verified against the chain that
+// starts with the seed signature of the request.
+type chunkedReader struct {
+	r       *bufio.Reader
+	sig     *signature
+	key     []byte
+	prevSig string
+	chunk   []byte
+	done    bool
+	err     error
+}
+
+func newChunkedReader(r io.Reader, sig *signature, key []byte) *chunkedReader {
+	return &chunkedReader{
+		r:       bufio.NewReader(r),
+		sig:     sig,
+		key:     key,
+		prevSig: sig.signature,
+	}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+		c.err = c.nextChunk()
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return errIncompleteBody
+	}
+
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errIncompleteBody
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errIncompleteBody
+	}
+
+	if c.key != nil {
+		chunkSig, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok || !hmac.Equal([]byte(chunkSig), []byte(c.chunkSignature(data))) {
+			return errSignatureMismatch
+		}
+		c.prevSig = chunkSig
+	}
+
+	if size == 0 {
+		c.done = true
+		return c.skipTrailer()
+	}
+
+	if line, err := c.readLine(); err != nil || line != "" {
+		return errIncompleteBody
+	}
+	c.chunk = data
+	return nil
+}
+
+func (c *chunkedReader) chunkSignature(data []byte) string {
+	stringToSign := strings.Join([]string{
+		signAlgorithm + "-PAYLOAD",
+		c.sig.date.Format(amzDateFormat),
+		c.sig.scope(),
+		c.prevSig,
+		emptySHA256,
+		hashHex(data),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+}
+
+// skipTrailer consumes trailing headers, checksums they carry are not
+// verified
+func (c *chunkedReader) skipTrailer() error {
+	for {
+		line, err := c.readLine()
+		if errors.Is(err, io.EOF) || line == "" {
+			return nil
+		}
+		if err != nil {
+			return errIncompleteBody
+		}
+	}
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
@@ -0,0 +1,618 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+const (
+	xmlNamespace       = "http://s3.amazonaws.com/doc/2006-03-01/"
+	timeFormat         = "2006-01-02T15:04:05.000Z"
+	maxKeys            = 1000
+	maxDeleteBodyBytes = 2 * 1024 * 1024
+	// user metadata shares the storage with X-Meta-* of the file server API
+	metadataHeaderPrefix = "X-Amz-Meta-"
+)
+
+// Server exposes the file storage buckets through a subset of the S3 REST API:
+// ListObjects(V2), GetObject, PutObject, HeadObject, DeleteObject and
+// DeleteObjects. Only path-style requests signed with SigV4 are accepted.
+type Server struct {
+	mux     *http.ServeMux
+	config  *Config
+	buckets *storage.Buckets
+	secrets map[string]string
+	started time.Time
+}
+
+func NewServer(config *Config, buckets *storage.Buckets) *Server {
+	s := &Server{
+		mux:     http.NewServeMux(),
+		config:  config,
+		buckets: buckets,
+		secrets: config.secrets(),
+		started: time.Now(),
+	}
+	s.addRoutes()
+	return s
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucketInfo struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name     `xml:"ListAllMyBucketsResult"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Owner   owner        `xml:"Owner"`
+	Buckets []bucketInfo `xml:"Buckets>Bucket"`
+}
+
+type locationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+	Owner        *owner `xml:"Owner,omitempty"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Marker                *string        `xml:"Marker,omitempty"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int           `xml:"KeyCount,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []object       `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type deleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+// listParams are the query parameters understood by ListObjects(V2), any
+// other parameter on a bucket request selects an unsupported subresource
+var listParams = map[string]bool{
+	"list-type": true, "prefix": true, "delimiter": true, "max-keys": true, "marker": true,
+	"continuation-token": true, "start-after": true, "encoding-type": true, "fetch-owner": true,
+}
+
+// objectParams are the query parameters accepted on object requests
+var objectParams = map[string]bool{
+	"versionId": true, "partNumber": true, "x-id": true,
+	"response-content-type": true, "response-content-disposition": true,
+	"response-cache-control": true, "response-content-encoding": true,
+	"response-content-language": true, "response-expires": true,
+}
+
+// etag is the MD5 of the content, files stored before it was recorded get
+// one made of their modification time and size
+func etag(info *storage.FileInfo) string {
+	if info.MD5 != "" {
+		return `"` + info.MD5 + `"`
+	}
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+func hasOnly(query url.Values, allowed map[string]bool) bool {
+	for key := range query {
+		if !allowed[key] && !strings.HasPrefix(key, "X-Amz-") {
+			return false
+		}
+	}
+	return true
+}
+
+// bucket returns the storage of the named bucket, the configured bucket name
+// refers to the default bucket of the file server
+func (s *Server) bucket(w http.ResponseWriter, r *http.Request, bucket string) (*storage.Storage, bool) {
+	name := bucket
+	switch bucket {
+	case s.config.Bucket:
+		name = storage.DefaultBucket
+	case storage.DefaultBucket:
+		name = ""
+	}
+
+	st, err := s.buckets.Get(name)
+	if err != nil {
+		writeError(w, r, errNoSuchBucket)
+		return nil, false
+	}
+	return st, true
+}
+
+func storageError(err error) *apiError {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, storage.ErrInvalidName):
+		return errInvalidKey
+	case errors.Is(err, storage.ErrNotExist):
+		return errNoSuchKey
+	case errors.Is(err, storage.ErrInvalidMetadata):
+		return errInvalidArgument
+	case errors.Is(err, storage.ErrFileTooLarge):
+		return errEntityTooLarge
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return errStorageFull
+	default:
+		log.Printf("S3 storage error: %v", err)
+		return errInternal
+	}
+}
+
+func (s *Server) handleListBuckets() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := listAllMyBucketsResult{
+			Xmlns: xmlNamespace,
+			Owner: owner{ID: "fileserver", DisplayName: "fileserver"},
+		}
+		for _, info := range s.buckets.List() {
+			name, created := info.Name, info.Created
+			if name == storage.DefaultBucket {
+				name, created = s.config.Bucket, s.started
+			}
+			res.Buckets = append(res.Buckets, bucketInfo{Name: name, CreationDate: formatTime(created)})
+		}
+		sort.Slice(res.Buckets, func(i, j int) bool { return res.Buckets[i].Name < res.Buckets[j].Name })
+
+		writeXML(w, http.StatusOK, res)
+	}
+}
+
+func (s *Server) handleBucket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := r.PathValue("bucket")
+		st, ok := s.bucket(w, r, bucket)
+		if !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case query.Has("location"):
+			location := s.config.Region
+			if location == "us-east-1" {
+				location = ""
+			}
+			writeXML(w, http.StatusOK, locationConstraint{Xmlns: xmlNamespace, Location: location})
+		case hasOnly(query, listParams):
+			s.listObjects(w, r, st, bucket)
+		default:
+			writeError(w, r, errNotImplemented)
+		}
+	}
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, st *storage.Storage, bucket string) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	urlEncode := query.Get("encoding-type") == "url"
+
+	limit := maxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, errInvalidArgument)
+			return
+		}
+		limit = min(n, maxKeys)
+	}
+
+	res := listBucketResult{
+		Xmlns:     xmlNamespace,
+		Name:      bucket,
+		Prefix:    prefix,
+		MaxKeys:   limit,
+		Delimiter: delimiter,
+	}
+	if urlEncode {
+		res.EncodingType = "url"
+	}
+
+	var marker string
+	if v2 {
+		res.StartAfter = query.Get("start-after")
+		res.ContinuationToken = query.Get("continuation-token")
+		marker = res.StartAfter
+		if res.ContinuationToken != "" {
+			token, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+			if err != nil {
+				writeError(w, r, errInvalidArgument)
+				return
+			}
+			marker = string(token)
+		}
+	} else {
+		marker = query.Get("marker")
+		res.Marker = &marker
+	}
+
+	files, err := st.List()
+	if err != nil {
+		writeError(w, r, storageError(err))
+		return
+	}
+
+	encode := func(key string) string {
+		if urlEncode {
+			return url.QueryEscape(key)
+		}
+		return key
+	}
+
+	var last string
+	count := 0
+	for i := range files {
+		key := files[i].Name
+		if key <= marker || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		entry, isPrefix := key, false
+		if delimiter != "" {
+			if j := strings.Index(key[len(prefix):], delimiter); j >= 0 {
+				entry, isPrefix = key[:len(prefix)+j+len(delimiter)], true
+				if entry <= marker || entry == last {
+					continue
+				}
+			}
+		}
+
+		if count == limit {
+			res.IsTruncated = true
+			break
+		}
+
+		if isPrefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: encode(entry)})
+		} else {
+			obj := object{
+				Key:          encode(key),
+				LastModified: formatTime(files[i].ModTime),
+				ETag:         etag(&files[i]),
+				Size:         files[i].Size,
+				StorageClass: "STANDARD",
+			}
+			if !v2 || query.Get("fetch-owner") == "true" {
+				obj.Owner = &owner{ID: "fileserver", DisplayName: "fileserver"}
+			}
+			res.Contents = append(res.Contents, obj)
+		}
+		last = entry
+		count++
+	}
+
+	if v2 {
+		res.KeyCount = &count
+		if res.IsTruncated {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else if res.IsTruncated && delimiter != "" {
+		res.NextMarker = encode(last)
+	}
+
+	writeXML(w, http.StatusOK, res)
+}
+
+func (s *Server) handleDeleteObjects() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := r.PathValue("bucket")
+		st, ok := s.bucket(w, r, bucket)
+		if !ok {
+			return
+		}
+		if !r.URL.Query().Has("delete") {
+			writeError(w, r, errNotImplemented)
+			return
+		}
+
+		body := io.Reader(http.MaxBytesReader(w, r.Body, maxDeleteBodyBytes))
+		if sum := r.Header.Get("Content-MD5"); sum != "" {
+			var apiErr *apiError
+			if body, apiErr = newMD5Reader(body, sum); apiErr != nil {
+				writeError(w, r, apiErr)
+				return
+			}
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			writeError(w, r, storageError(err))
+			return
+		}
+
+		var req deleteRequest
+		if err := xml.Unmarshal(data, &req); err != nil || len(req.Objects) > maxKeys {
+			writeError(w, r, errMalformedXML)
+			return
+		}
+
+		res := deleteResult{Xmlns: xmlNamespace}
+		for _, obj := range req.Objects {
+			if err := st.Delete(obj.Key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+				apiErr := storageError(err)
+				res.Errors = append(res.Errors, deleteError{Key: obj.Key, Code: apiErr.Code, Message: apiErr.Message})
+				continue
+			}
+			if !req.Quiet {
+				res.Deleted = append(res.Deleted, deletedObject{Key: obj.Key})
+			}
+		}
+
+		writeXML(w, http.StatusOK, res)
+	}
+}
+
+func (s *Server) handleGetObject() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, key := r.PathValue("bucket"), r.PathValue("key")
+		if key == "" {
+			s.handleBucket()(w, r)
+			return
+		}
+		st, ok := s.bucket(w, r, bucket)
+		if !ok {
+			return
+		}
+		if !hasOnly(r.URL.Query(), objectParams) {
+			writeError(w, r, errNotImplemented)
+			return
+		}
+
+		file, info, err := st.Open(key)
+		if err != nil {
+			writeError(w, r, storageError(err))
+			return
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Printf("Failed to close file: %v", err)
+			}
+		}()
+
+		header := w.Header()
+		header.Set("ETag", etag(info))
+		header.Set("Content-Type", "binary/octet-stream")
+		if info.ContentType != "" {
+			header.Set("Content-Type", info.ContentType)
+		}
+		for key, value := range info.Metadata {
+			header.Set(metadataHeaderPrefix+key, value)
+		}
+		for param, name := range map[string]string{
+			"response-content-type":        "Content-Type",
+			"response-content-disposition": "Content-Disposition",
+			"response-cache-control":       "Cache-Control",
+			"response-content-encoding":    "Content-Encoding",
+			"response-content-language":    "Content-Language",
+			"response-expires":             "Expires",
+		} {
+			if v := r.URL.Query().Get(param); v != "" {
+				header.Set(name, v)
+			}
+		}
+
+		http.ServeContent(w, r, key, info.ModTime, file)
+	}
+}
+
+func (s *Server) handlePutObject() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, key := r.PathValue("bucket"), r.PathValue("key")
+		st, ok := s.bucket(w, r, bucket)
+		if !ok {
+			return
+		}
+		if key == "" || r.Header.Get("X-Amz-Copy-Source") != "" || !hasOnly(r.URL.Query(), objectParams) {
+			writeError(w, r, errNotImplemented)
+			return
+		}
+		if !storage.ValidName(key) {
+			writeError(w, r, errInvalidKey)
+			return
+		}
+
+		body := io.Reader(r.Body)
+		if sum := r.Header.Get("Content-MD5"); sum != "" {
+			var apiErr *apiError
+			if body, apiErr = newMD5Reader(body, sum); apiErr != nil {
+				writeError(w, r, apiErr)
+				return
+			}
+		}
+
+		// the ETag describes this upload even if the object is replaced
+		// before the response
+		sum := md5.New()
+		body, contentType := storage.DetectContentType(io.TeeReader(body, sum), key, r.Header.Get("Content-Type"))
+		meta := &storage.Meta{ContentType: contentType, Metadata: map[string]string{}}
+		for name, values := range r.Header {
+			if k, ok := strings.CutPrefix(name, metadataHeaderPrefix); ok {
+				meta.Metadata[strings.ToLower(k)] = strings.Join(values, ",")
+			}
+		}
+		if err := st.Put(body, key, meta); err != nil {
+			writeError(w, r, storageError(err))
+			return
+		}
+
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Server) handleDeleteObject() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, key := r.PathValue("bucket"), r.PathValue("key")
+		st, ok := s.bucket(w, r, bucket)
+		if !ok {
+			return
+		}
+		if key == "" || !hasOnly(r.URL.Query(), objectParams) {
+			writeError(w, r, errNotImplemented)
+			return
+		}
+
+		if err := st.Delete(key); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			writeError(w, r, storageError(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleNotImplemented() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, errNotImplemented)
+	}
+}
+
+// authenticate verifies the request signature and replaces the body with
+// one that fails if the payload does not match what was signed
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amz-request-id", newRequestID())
+
+		sig, apiErr := parseSignature(r)
+		if apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		secret, apiErr := sig.verify(r, s.secrets, time.Now())
+		if apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		if s.config.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, r, errAccessDenied)
+			return
+		}
+
+		switch sig.payloadHash {
+		case unsignedPayload:
+		case streamingPayload, streamingPayloadTrailer:
+			r.Body = io.NopCloser(newChunkedReader(r.Body, sig, sig.signingKey(secret)))
+			r.ContentLength = decodedLength(r)
+		case streamingUnsignedTrailer:
+			r.Body = io.NopCloser(newChunkedReader(r.Body, sig, nil))
+			r.ContentLength = decodedLength(r)
+		default:
+			body, apiErr := newSHA256Reader(r.Body, sig.payloadHash)
+			if apiErr != nil {
+				writeError(w, r, apiErr)
+				return
+			}
+			r.Body = io.NopCloser(body)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decodedLength(r *http.Request) int64 {
+	n, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "0000000000000000"
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+func (s *Server) addRoutes() {
+	s.mux.HandleFunc("GET /{$}", s.handleListBuckets())
+	s.mux.HandleFunc("GET /{bucket}", s.handleBucket())
+	s.mux.HandleFunc("POST /{bucket}", s.handleDeleteObjects())
+	s.mux.HandleFunc("POST /{bucket}/{$}", s.handleDeleteObjects())
+	s.mux.HandleFunc("GET /{bucket}/{key...}", s.handleGetObject())
+	s.mux.HandleFunc("PUT /{bucket}/{key...}", s.handlePutObject())
+	s.mux.HandleFunc("DELETE /{bucket}/{key...}", s.handleDeleteObject())
+	s.mux.HandleFunc("/", s.handleNotImplemented())
+}
+
+func (s *Server) Run() {
+	if len(s.secrets) == 0 {
+		log.Printf("S3 server has no credentials configured, every request will be denied")
+	}
+
+	serverAddress := s.config.BindHost + ":" + s.config.BindPort
+	log.Printf("S3 server started on address %s", serverAddress)
+	log.Fatal(http.ListenAndServe(serverAddress, s.authenticate(s.mux)))
+}
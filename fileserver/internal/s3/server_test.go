@@ -0,0 +1,45 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"yadro.com/course/internal/storage"
+)
+
+func TestObjectETag(t *testing.T) {
+	storageConfig := storage.DefaultConfig()
+	buckets, err := storage.NewBuckets(t.TempDir(), &storageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	s := NewServer(&config, buckets)
+
+	sum := md5.Sum([]byte("hello, S3"))
+	want := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/files/a.txt", strings.NewReader("hello, S3"))
+	s.mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != want {
+		t.Fatalf("PUT answered %d with ETag %s, expected %s", w.Code, w.Header().Get("ETag"), want)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w = httptest.NewRecorder()
+		s.mux.ServeHTTP(w, httptest.NewRequest(method, "/files/a.txt", nil))
+		if w.Code != http.StatusOK || w.Header().Get("ETag") != want {
+			t.Fatalf("%s answered %d with ETag %s, expected %s", method, w.Code, w.Header().Get("ETag"), want)
+		}
+	}
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files?list-type=2", nil))
+	if !strings.Contains(w.Body.String(), "<ETag>&#34;"+hex.EncodeToString(sum[:])+"&#34;</ETag>") {
+		t.Fatalf("listing without the ETag: %s", w.Body.String())
+	}
+}
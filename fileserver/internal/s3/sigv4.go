@@ -0,0 +1,315 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request verification for AWS Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	signAlgorithm    = "AWS4-HMAC-SHA256"
+	signService      = "s3"
+	signTerminator   = "aws4_request"
+	amzDateFormat    = "20060102T150405Z"
+	scopeDateFormat  = "20060102"
+	maxClockSkew     = 15 * time.Minute
+	maxPresignExpiry = 7 * 24 * time.Hour
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256              = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type signature struct {
+	accessKey     string
+	scopeDate     string
+	region        string
+	signedHeaders []string
+	signature     string
+	date          time.Time
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+}
+
+func (sig *signature) scope() string {
+	return strings.Join([]string{sig.scopeDate, sig.region, signService, signTerminator}, "/")
+}
+
+func (sig *signature) signingKey(secret string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), sig.scopeDate)
+	key = hmacSHA256(key, sig.region)
+	key = hmacSHA256(key, signService)
+	return hmacSHA256(key, signTerminator)
+}
+
+// verify checks the request signature and returns the secret key it was
+// signed with
+func (sig *signature) verify(r *http.Request, secrets map[string]string, now time.Time) (string, *apiError) {
+	secret, ok := secrets[sig.accessKey]
+	if !ok {
+		return "", errInvalidAccessKeyID
+	}
+
+	if sig.presigned {
+		if now.Before(sig.date.Add(-maxClockSkew)) {
+			return "", errRequestTimeTooSkewed
+		}
+		if now.After(sig.date.Add(sig.expires)) {
+			return "", errPresignExpired
+		}
+	} else if d := now.Sub(sig.date); d > maxClockSkew || d < -maxClockSkew {
+		return "", errRequestTimeTooSkewed
+	}
+
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		sig.date.Format(amzDateFormat),
+		sig.scope(),
+		hashHex([]byte(canonicalRequest(r, sig))),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(sig.signingKey(secret), stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return "", errSignatureMismatch
+	}
+
+	return secret, nil
+}
+
+// parseSignature extracts signature parameters either from the Authorization
+// header or from the query string of a presigned URL
+func parseSignature(r *http.Request) (*signature, *apiError) {
+	if r.URL.Query().Has("X-Amz-Algorithm") {
+		return parsePresigned(r)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errAccessDenied
+	}
+	algorithm, params, ok := strings.Cut(auth, " ")
+	if !ok {
+		return nil, errAuthorizationMalformed
+	}
+	if algorithm != signAlgorithm {
+		return nil, errUnsupportedAlgorithm
+	}
+
+	sig := &signature{}
+	var credential, signedHeaders string
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch key {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			sig.signature = value
+		}
+	}
+	if err := sig.parseCredential(credential); err != nil {
+		return nil, err
+	}
+	if signedHeaders == "" || sig.signature == "" {
+		return nil, errAuthorizationMalformed
+	}
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+
+	var date time.Time
+	var err error
+	if amzDate := r.Header.Get("X-Amz-Date"); amzDate != "" {
+		date, err = time.Parse(amzDateFormat, amzDate)
+	} else {
+		date, err = http.ParseTime(r.Header.Get("Date"))
+	}
+	if err != nil {
+		return nil, errAccessDenied
+	}
+	sig.date = date.UTC()
+	if err := sig.checkScope(); err != nil {
+		return nil, err
+	}
+
+	sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if sig.payloadHash == "" {
+		return nil, errMissingContentSHA256
+	}
+
+	return sig, nil
+}
+
+func parsePresigned(r *http.Request) (*signature, *apiError) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signAlgorithm {
+		return nil, errUnsupportedAlgorithm
+	}
+
+	sig := &signature{
+		presigned:   true,
+		signature:   query.Get("X-Amz-Signature"),
+		payloadHash: unsignedPayload,
+	}
+	if err := sig.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	if sig.signature == "" || query.Get("X-Amz-SignedHeaders") == "" {
+		return nil, errAuthorizationMalformed
+	}
+	sig.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+
+	date, err := time.Parse(amzDateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAuthorizationMalformed
+	}
+	sig.date = date
+	if err := sig.checkScope(); err != nil {
+		return nil, err
+	}
+
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignExpiry {
+		return nil, errAuthorizationMalformed
+	}
+	sig.expires = time.Duration(expires) * time.Second
+
+	if hash := query.Get("X-Amz-Content-Sha256"); hash != "" {
+		sig.payloadHash = hash
+	}
+
+	return sig, nil
+}
+
+// parseCredential parses <access key>/<date>/<region>/s3/aws4_request
+func (sig *signature) parseCredential(credential string) *apiError {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != signService || parts[4] != signTerminator {
+		return errAuthorizationMalformed
+	}
+	if _, err := time.Parse(scopeDateFormat, parts[1]); err != nil {
+		return errAuthorizationMalformed
+	}
+
+	sig.accessKey = parts[0]
+	sig.scopeDate = parts[1]
+	sig.region = parts[2]
+	return nil
+}
+
+// checkScope rejects credentials scoped to another day than the request and
+// signatures not covering the host
+func (sig *signature) checkScope() *apiError {
+	if sig.date.Format(scopeDateFormat) != sig.scopeDate {
+		return errAuthorizationMalformed
+	}
+	if !slices.Contains(sig.signedHeaders, "host") {
+		return errAuthorizationMalformed
+	}
+	return nil
+}
+
+func canonicalRequest(r *http.Request, sig *signature) string {
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.RawQuery, sig.presigned),
+		canonicalHeaders(r, sig.signedHeaders),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+func canonicalQuery(rawQuery string, presigned bool) string {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		if presigned && key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = r.Header.Values(name)
+			if len(values) == 0 {
+				values = []string{strconv.FormatInt(r.ContentLength, 10)}
+			}
+		default:
+			values = r.Header.Values(name)
+		}
+		// the values belong to the request header, they are trimmed in a copy
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(trimmed, ","))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// uriEncode encodes every byte except the unreserved characters as required by
+// the canonical request
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	OpDelete      = "delete"
+	OpCopy        = "copy"
+	OpMove        = "move"
+	OpSetMetadata = "set-metadata"
+)
+
+var (
+	ErrInvalidOperation = errors.New("op must be delete, copy, move or set-metadata")
+	// ErrNotApplied is the result of the operations of a batch not applied
+	// because another one of the batch failed
+	ErrNotApplied = errors.New("not applied, another operation of the batch failed")
+)
+
+// Operation is a change of a single file applied as part of a batch
+type Operation struct {
+	Op   string `json:"op"`
+	Name string `json:"name"`
+	// Destination and Overwrite are used by copy and move
+	Destination string `json:"destination,omitempty"`
+	Overwrite   bool   `json:"overwrite,omitempty"`
+	// Metadata replaces the client metadata with set-metadata
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Validate checks the operation can be applied to some files, not that the
+// files are there
+func (op *Operation) Validate() error {
+	if !ValidName(op.Name) {
+		return &fileErr{filepath: op.Name, err: ErrInvalidName}
+	}
+	switch op.Op {
+	case OpDelete:
+	case OpCopy, OpMove:
+		if !ValidName(op.Destination) {
+			return &fileErr{filepath: op.Destination, err: ErrInvalidName}
+		}
+		if op.Destination == op.Name {
+			return &fileErr{filepath: op.Name, err: ErrSameFile}
+		}
+	case OpSetMetadata:
+		if _, err := normalizeMetadata(op.Metadata); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidOperation, op.Op)
+	}
+	return nil
+}
+
+// Apply applies a single operation
+func (s *Storage) Apply(op *Operation) error {
+	if err := op.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.apply(op)
+}
+
+// apply is Apply with the storage lock held
+func (s *Storage) apply(op *Operation) error {
+	filePath, err := s.filePath(op.Name)
+	if err != nil {
+		return err
+	}
+	switch op.Op {
+	case OpDelete:
+		return s.delete(op.Name, filePath)
+	case OpCopy, OpMove:
+		dstPath, err := s.filePath(op.Destination)
+		if err != nil {
+			return err
+		}
+		if op.Op == OpCopy {
+			return s.copy(op.Name, filePath, op.Destination, dstPath, op.Overwrite)
+		}
+		return s.move(op.Name, filePath, op.Destination, dstPath, op.Overwrite)
+	case OpSetMetadata:
+		_, err := s.writeMetadata(op.Name, filePath, func(map[string]string) map[string]string {
+			return op.Metadata
+		})
+		return err
+	}
+	return ErrInvalidOperation
+}
+
+// ApplyAll applies the operations in order while holding the storage lock.
+// Every operation is checked against the files and the quota as the earlier
+// ones leave them before the first one is applied, so when one of them is
+// bound to fail none is applied. Only a failure of the disk or the erasure
+// directories can stop a batch halfway: the operations before the failing
+// one stay applied, the ones after it are not applied. The result holds an
+// error or nil for every operation.
+func (s *Storage) ApplyAll(ops []Operation) []error {
+	res := make([]error, len(ops))
+	failed := false
+	for i := range ops {
+		if res[i] = ops[i].Validate(); res[i] != nil {
+			failed = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !failed {
+		failed = s.check(ops, res)
+	}
+	for i := range ops {
+		if failed {
+			if res[i] == nil {
+				res[i] = ErrNotApplied
+			}
+			continue
+		}
+		if res[i] = s.apply(&ops[i]); res[i] != nil {
+			failed = true
+		}
+	}
+	return res
+}
+
+// checkedFile is a file as the checked operations leave it, size is the
+// stored size or -1 when there is no file on disk
+type checkedFile struct {
+	exists bool
+	size   int64
+}
+
+// check simulates the operations on the files they touch and on the usage
+// of the storage, and records why the failing ones would fail. Must be called
+// with the storage lock held.
+func (s *Storage) check(ops []Operation, res []error) bool {
+	files := map[string]checkedFile{}
+	file := func(name string) checkedFile {
+		if f, ok := files[name]; ok {
+			return f
+		}
+		filePath, _ := s.filePath(name)
+		f := checkedFile{exists: s.exists(name, filePath), size: -1}
+		// expired files are still on disk and accounted until replaced
+		if info, err := os.Stat(filePath); err == nil {
+			f.size = info.Size()
+		}
+		files[name] = f
+		return f
+	}
+	usage := s.Usage()
+	remove := func(name string) {
+		if size := file(name).size; size >= 0 {
+			usage.Bytes -= size
+			usage.Files--
+		}
+		files[name] = checkedFile{size: -1}
+	}
+	// replace mirrors commit, the destination is replaced after the quota
+	// allows it
+	replace := func(name string, size int64) error {
+		old := file(name).size
+		if err := s.checkQuota(usage.Bytes, usage.Files, old, size); err != nil {
+			return err
+		}
+		usage.Bytes += size - max(old, 0)
+		if old < 0 {
+			usage.Files++
+		}
+		files[name] = checkedFile{exists: true, size: size}
+		return nil
+	}
+
+	failed := false
+	for i, op := range ops {
+		switch {
+		case !file(op.Name).exists:
+			res[i] = &fileErr{filepath: op.Name, err: ErrNotExist}
+		case (op.Op == OpCopy || op.Op == OpMove) && !op.Overwrite && file(op.Destination).exists:
+			res[i] = &fileErr{filepath: op.Destination, err: ErrExist}
+		}
+		if res[i] != nil {
+			failed = true
+			continue
+		}
+		switch op.Op {
+		case OpDelete:
+			remove(op.Name)
+		case OpCopy:
+			res[i] = replace(op.Destination, file(op.Name).size)
+		case OpMove:
+			src, before := file(op.Name), usage
+			remove(op.Name)
+			if res[i] = replace(op.Destination, src.size); res[i] != nil {
+				// a refused move leaves the source in place
+				files[op.Name], usage = src, before
+			}
+		}
+		if res[i] != nil {
+			failed = true
+		}
+	}
+	return failed
+}
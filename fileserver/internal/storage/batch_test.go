@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyAllFileQuota(t *testing.T) {
+	_, s := newTestBuckets(t, func(c *Config) {
+		c.Quota.MaxFiles = 2
+	})
+	save(t, s, "a.txt", []byte("aaaa"))
+	save(t, s, "b.txt", []byte("bbb"))
+
+	// the file limit is reached only if the copy comes before the delete
+	errs := s.ApplyAll([]Operation{
+		{Op: OpCopy, Name: "b.txt", Destination: "c.txt"},
+		{Op: OpDelete, Name: "a.txt"},
+	})
+	if !errors.Is(errs[0], ErrQuotaExceeded) || !errors.Is(errs[1], ErrNotApplied) {
+		t.Fatalf("unexpected results %v", errs)
+	}
+	if _, err := s.Stat("a.txt"); err != nil {
+		t.Fatal("a.txt deleted by a failed batch")
+	}
+
+	errs = s.ApplyAll([]Operation{
+		{Op: OpDelete, Name: "a.txt"},
+		{Op: OpCopy, Name: "b.txt", Destination: "c.txt"},
+	})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("unexpected results %v", errs)
+	}
+
+	// the move frees a file for one copy, not for two
+	errs = s.ApplyAll([]Operation{
+		{Op: OpMove, Name: "b.txt", Destination: "c.txt", Overwrite: true},
+		{Op: OpCopy, Name: "c.txt", Destination: "d.txt"},
+		{Op: OpCopy, Name: "c.txt", Destination: "e.txt"},
+	})
+	if errs[0] != ErrNotApplied || errs[1] != ErrNotApplied || !errors.Is(errs[2], ErrQuotaExceeded) {
+		t.Fatalf("unexpected results %v", errs)
+	}
+	if usage := s.Usage(); usage.Files != 2 {
+		t.Fatalf("usage changed by a failed batch: %+v", usage)
+	}
+}
+
+func TestApplyAllSizeQuota(t *testing.T) {
+	_, s := newTestBuckets(t, func(c *Config) {
+		c.Quota.MaxBytes = 10
+	})
+	save(t, s, "a.txt", []byte("aaaa"))
+	save(t, s, "b.txt", []byte("bbb"))
+
+	errs := s.ApplyAll([]Operation{
+		{Op: OpCopy, Name: "a.txt", Destination: "c.txt"},
+		{Op: OpDelete, Name: "b.txt"},
+	})
+	if !errors.Is(errs[0], ErrQuotaExceeded) || !errors.Is(errs[1], ErrNotApplied) {
+		t.Fatalf("unexpected results %v", errs)
+	}
+
+	// replacing b.txt with a copy of a.txt grows the usage to 8 bytes
+	errs = s.ApplyAll([]Operation{
+		{Op: OpCopy, Name: "a.txt", Destination: "b.txt", Overwrite: true},
+		{Op: OpCopy, Name: "b.txt", Destination: "c.txt"},
+	})
+	if errs[0] != ErrNotApplied || !errors.Is(errs[1], ErrQuotaExceeded) {
+		t.Fatalf("unexpected results %v", errs)
+	}
+	errs = s.ApplyAll([]Operation{
+		{Op: OpCopy, Name: "a.txt", Destination: "b.txt", Overwrite: true},
+		{Op: OpSetMetadata, Name: "b.txt", Metadata: map[string]string{"copy": "true"}},
+	})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("unexpected results %v", errs)
+	}
+	if usage := s.Usage(); usage.Files != 2 || usage.Bytes != 8 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
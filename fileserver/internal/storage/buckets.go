@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBucket is the bucket served under /files, its files are kept right
+// in the storage root as they were before buckets existed
+const DefaultBucket = "default"
+
+const bucketInfoName = "bucket.json"
+
+var (
+	ErrBucketNotFound   = errors.New("bucket not found")
+	ErrBucketExists     = errors.New("bucket already exists")
+	ErrBucketNotEmpty   = errors.New("bucket is not empty")
+	ErrInvalidBucket    = errors.New("bucket names must be 3-63 characters of lowercase letters, digits, '-' and '.'")
+	ErrDefaultBucket    = errors.New("default bucket can not be deleted")
+	bucketNameValidator = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+)
+
+type BucketInfo struct {
+	Name     string         `json:"name"`
+	Created  time.Time      `json:"created"`
+	Settings BucketSettings `json:"settings"`
+}
+
+// Buckets keeps isolated storages, each bucket other than the default one
+// lives in .fileserver/buckets/<name> with its own internal directory and
+// settings
+type Buckets struct {
+	dir    string
+	config *Config
+
+	mu      sync.RWMutex
+	buckets map[string]*Storage
+	infos   map[string]BucketInfo
+
+	listenersMu sync.RWMutex
+	listeners   []func(Event)
+}
+
+func NewBuckets(path string, config *Config) (*Buckets, error) {
+	defaultStorage, err := NewStorage(path, config)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Buckets{
+		dir:     filepath.Join(path, internalDir, "buckets"),
+		config:  config,
+		buckets: map[string]*Storage{DefaultBucket: defaultStorage},
+		infos:   map[string]BucketInfo{DefaultBucket: {Name: DefaultBucket, Created: dirCreated(path)}},
+	}
+	b.attach(DefaultBucket, defaultStorage)
+	if err := os.MkdirAll(b.dir, 0750); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := b.load(e.Name()); err != nil {
+			log.Printf("Skipping bucket %s: %v", e.Name(), err)
+		}
+	}
+
+	return b, nil
+}
+
+func dirCreated(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (b *Buckets) load(name string) error {
+	data, err := os.ReadFile(filepath.Join(b.dir, name, internalDir, bucketInfoName))
+	if err != nil {
+		return err
+	}
+
+	var info BucketInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+
+	s, err := NewStorage(filepath.Join(b.dir, name), info.Settings.apply(b.config))
+	if err != nil {
+		return err
+	}
+	b.attach(name, s)
+	b.buckets[name] = s
+	b.infos[name] = info
+	return nil
+}
+
+// Default returns the storage of the default bucket
+func (b *Buckets) Default() *Storage {
+	s, _ := b.Get(DefaultBucket)
+	return s
+}
+
+func (b *Buckets) Get(name string) (*Storage, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s, ok := b.buckets[name]
+	if !ok {
+		return nil, &fileErr{filepath: name, err: ErrBucketNotFound}
+	}
+	return s, nil
+}
+
+func (b *Buckets) Info(name string) (*BucketInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	info, ok := b.infos[name]
+	if !ok {
+		return nil, &fileErr{filepath: name, err: ErrBucketNotFound}
+	}
+	return &info, nil
+}
+
+// List returns all buckets sorted by name
+func (b *Buckets) List() []BucketInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	res := make([]BucketInfo, 0, len(b.infos))
+	for _, info := range b.infos {
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Storages returns every bucket storage, used by background jobs
+func (b *Buckets) Storages() []*Storage {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	res := make([]*Storage, 0, len(b.buckets))
+	for _, s := range b.buckets {
+		res = append(res, s)
+	}
+	return res
+}
+
+func (b *Buckets) Create(name string, settings BucketSettings) (*BucketInfo, error) {
+	if !bucketNameValidator.MatchString(name) {
+		return nil, &fileErr{filepath: name, err: ErrInvalidBucket}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.buckets[name]; ok {
+		return nil, &fileErr{filepath: name, err: ErrBucketExists}
+	}
+
+	info := BucketInfo{Name: name, Created: time.Now().UTC(), Settings: settings}
+	path := filepath.Join(b.dir, name)
+	s, err := NewStorage(path, settings.apply(b.config))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(path, internalDir, bucketInfoName), data, s.tmpDir); err != nil {
+		return nil, err
+	}
+
+	b.attach(name, s)
+	b.buckets[name] = s
+	b.infos[name] = info
+	return &info, nil
+}
+
+// Delete removes the bucket with everything in it. Unless force is set only
+// empty buckets can be removed.
+func (b *Buckets) Delete(name string, force bool) error {
+	if name == DefaultBucket {
+		return &fileErr{filepath: name, err: ErrDefaultBucket}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.buckets[name]
+	if !ok {
+		return &fileErr{filepath: name, err: ErrBucketNotFound}
+	}
+	if !force {
+		files, err := s.List()
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			return &fileErr{filepath: name, err: ErrBucketNotEmpty}
+		}
+	}
+
+	delete(b.buckets, name)
+	delete(b.infos, name)
+	s.journal.close()
+
+	// shards are kept outside the bucket directory, the ones missed here are
+	// left to the healer
+	sets, err := s.shardSets()
+	if err != nil {
+		log.Printf("Failed to find shards of bucket %s: %v", name, err)
+	}
+	if err := os.RemoveAll(filepath.Join(b.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, m := range sets {
+		s.removeShards(&Meta{Erasure: m})
+	}
+	return nil
+}
+
+// RewrapKeys wraps the data keys of every bucket with key and returns how many
+// keys were rewrapped
+func (b *Buckets) RewrapKeys(key *MasterKey) (int, error) {
+	total := 0
+	for _, s := range b.Storages() {
+		count, err := s.RewrapKeys(key)
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// RunTrashPurger periodically empties the trash of every bucket, it never
+// returns
+func (b *Buckets) RunTrashPurger() {
+	b.runPeriodically(b.config.Trash.PurgeInterval, time.Hour, func(s *Storage) {
+		if !s.config.Trash.Enabled {
+			return
+		}
+		removed, err := s.EmptyTrash(time.Now().Add(-s.config.Trash.Retention))
+		if err != nil {
+			log.Printf("Failed to purge trash of %s: %v", s.path, err)
+		} else if removed > 0 {
+			log.Printf("Purged %d files from trash of %s", removed, s.path)
+		}
+	})
+}
+
+// RunExpirySweeper periodically removes expired files of every bucket, it
+// never returns
+func (b *Buckets) RunExpirySweeper() {
+	b.runPeriodically(b.config.Expiry.SweepInterval, time.Minute, func(s *Storage) {
+		removed, err := s.RemoveExpired()
+		if err != nil {
+			log.Printf("Failed to remove expired files of %s: %v", s.path, err)
+		} else if removed > 0 {
+			log.Printf("Removed %d expired files of %s", removed, s.path)
+		}
+	})
+}
+
+// RunScrubber periodically checks the files of every bucket for corruption, it
+// never returns
+func (b *Buckets) RunScrubber() {
+	b.runPeriodically(b.config.Scrub.Interval, 24*time.Hour, func(s *Storage) {
+		report, err := s.Scrub()
+		if err != nil {
+			log.Printf("Failed to scrub %s: %v", s.path, err)
+		} else if len(report.Corrupted) > 0 {
+			log.Printf("Found %d corrupted files in %s", len(report.Corrupted), s.path)
+		}
+	})
+}
+
+func (b *Buckets) runPeriodically(interval, fallback time.Duration, job func(s *Storage)) {
+	if interval <= 0 {
+		interval = fallback
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, s := range b.Storages() {
+			job(s)
+		}
+		<-ticker.C
+	}
+}
+
+// ServiceDir returns the directory .fileserver/<name> of the default bucket for
+// server wide data, creating it if needed
+func (b *Buckets) ServiceDir(name string) (string, error) {
+	dir := filepath.Join(b.Default().path, internalDir, name)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// RunWatcher reconciles every bucket with changes made directly in its
+// directory, it never returns unless the watcher is off
+func (b *Buckets) RunWatcher() {
+	switch b.config.Watch.Mode {
+	case WatchOff:
+		return
+	case WatchPoll:
+	default:
+		// returns only when inotify can not be used
+		err := b.watchNotify()
+		log.Printf("Watching storage with inotify failed, polling instead: %v", err)
+	}
+
+	b.runPeriodically(b.config.Watch.PollInterval, 30*time.Second, reconcile)
+}
+
+func reconcile(s *Storage) {
+	changed, err := s.Reconcile()
+	if err != nil {
+		log.Printf("Failed to reconcile %s: %v", s.path, err)
+	} else if changed > 0 {
+		log.Printf("Reconciled %d files changed directly in %s", changed, s.path)
+	}
+}
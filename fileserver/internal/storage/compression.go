@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+const (
+	// CompressionGzip stores the file gzip compressed
+	CompressionGzip = "gzip"
+	// CompressionIdentity stores the file as is even if it matches one of
+	// the compression patterns
+	CompressionIdentity = "identity"
+)
+
+var ErrNotCompressed = errors.New("file is not stored compressed")
+
+// compress decides whether the file is stored compressed, an explicit choice
+// of the client wins over the configured patterns
+func (s *Storage) compress(filename string, meta *Meta) bool {
+	switch meta.Compression {
+	case CompressionGzip:
+		return true
+	case CompressionIdentity:
+		return false
+	}
+	for _, pattern := range s.config.Compression.Patterns {
+		if ok, _ := filepath.Match(pattern, filename); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// openContent opens a stored file returning the content as it was uploaded
+func (s *Storage) openContent(path string, meta *Meta) (io.ReadSeekCloser, error) {
+	file, err := s.openStored(path, meta)
+	if err != nil || meta.Compression != CompressionGzip {
+		return file, err
+	}
+	return &gzipFile{file: file, size: meta.ContentLength}, nil
+}
+
+// openStored opens a stored file decrypting but not decompressing it
+func (s *Storage) openStored(path string, meta *Meta) (io.ReadSeekCloser, error) {
+	file, size, err := s.openRaw(path, meta)
+	if err != nil || meta.Encryption == nil {
+		return file, err
+	}
+	content, err := s.keys.decrypt(file, size, meta.Encryption)
+	if err != nil {
+		closeFile(file)
+		return nil, &fileErr{filepath: path, err: err}
+	}
+	return content, nil
+}
+
+// gzipFile decompresses a stored file on the fly. Seeking backwards restarts
+// decompression from the beginning, which is good enough for the occasional
+// range request.
+type gzipFile struct {
+	file   io.ReadSeekCloser
+	reader *gzip.Reader
+	size   int64
+	// pos is the position seeked to, offset is the position of reader
+	pos    int64
+	offset int64
+}
+
+func (g *gzipFile) Read(p []byte) (int, error) {
+	if g.pos >= g.size {
+		return 0, io.EOF
+	}
+	if g.reader == nil || g.offset > g.pos {
+		if err := g.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if g.offset < g.pos {
+		n, err := io.CopyN(io.Discard, g.reader, g.pos-g.offset)
+		g.offset += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := g.reader.Read(p)
+	g.offset += int64(n)
+	g.pos = g.offset
+	return n, err
+}
+
+func (g *gzipFile) rewind() error {
+	if _, err := g.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	g.offset = 0
+	if g.reader == nil {
+		reader, err := gzip.NewReader(g.file)
+		if err != nil {
+			return err
+		}
+		g.reader = reader
+		return nil
+	}
+	return g.reader.Reset(g.file)
+}
+
+func (g *gzipFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += g.pos
+	case io.SeekEnd:
+		offset += g.size
+	}
+	if offset < 0 {
+		return 0, errors.New("gzip: negative position")
+	}
+	g.pos = offset
+	return offset, nil
+}
+
+func (g *gzipFile) Close() error {
+	return g.file.Close()
+}
@@ -0,0 +1,157 @@
+package storage
+
+import "time"
+
+type VersioningConfig struct {
+	Enabled     bool `yaml:"enabled" json:"enabled" env:"FILESERVER_VERSIONING_ENABLED" default:"false"`
+	MaxVersions int  `yaml:"max_versions" json:"max_versions" env:"FILESERVER_VERSIONING_MAX_VERSIONS" default:"10"`
+}
+
+type TrashConfig struct {
+	Enabled       bool          `yaml:"enabled" env:"FILESERVER_TRASH_ENABLED" default:"true"`
+	Retention     time.Duration `yaml:"retention" env:"FILESERVER_TRASH_RETENTION" default:"168h"`
+	PurgeInterval time.Duration `yaml:"purge_interval" env:"FILESERVER_TRASH_PURGE_INTERVAL" default:"1h"`
+}
+
+type ExpiryConfig struct {
+	SweepInterval time.Duration `yaml:"sweep_interval" env:"FILESERVER_EXPIRY_SWEEP_INTERVAL" default:"1m"`
+}
+
+// QuotaConfig limits the storage size, zero values mean no limit
+type QuotaConfig struct {
+	MaxBytes    int64 `yaml:"max_bytes" json:"max_bytes" env:"FILESERVER_QUOTA_MAX_BYTES" default:"0"`
+	MaxFiles    int   `yaml:"max_files" json:"max_files" env:"FILESERVER_QUOTA_MAX_FILES" default:"0"`
+	MaxFileSize int64 `yaml:"max_file_size" json:"max_file_size" env:"FILESERVER_QUOTA_MAX_FILE_SIZE" default:"0"`
+}
+
+// CompressionConfig lists glob patterns of file names stored compressed
+// unless the client asks otherwise
+type CompressionConfig struct {
+	Patterns []string `yaml:"patterns" env:"FILESERVER_COMPRESSION_PATTERNS"`
+}
+
+// EncryptionConfig enables encryption at rest when a master key file is set.
+// Keys replaced by a rotation can be kept as previous keys until all data
+// keys are rewrapped.
+type EncryptionConfig struct {
+	KeyFile          string   `yaml:"key_file" env:"FILESERVER_ENCRYPTION_KEY_FILE"`
+	PreviousKeyFiles []string `yaml:"previous_key_files" env:"FILESERVER_ENCRYPTION_PREVIOUS_KEY_FILES"`
+}
+
+// ScrubConfig sets how often stored files are checked against their SHA-256,
+// corrupted files are moved to .fileserver/quarantine unless quarantine is off
+type ScrubConfig struct {
+	Interval   time.Duration `yaml:"interval" env:"FILESERVER_SCRUB_INTERVAL" default:"24h"`
+	Quarantine bool          `yaml:"quarantine" env:"FILESERVER_SCRUB_QUARANTINE" default:"true"`
+}
+
+// SearchConfig limits full-text search to text files up to the given size
+type SearchConfig struct {
+	TextMaxFileSize int64 `yaml:"text_max_file_size" env:"FILESERVER_SEARCH_TEXT_MAX_FILE_SIZE" default:"8388608"`
+}
+
+// JournalConfig sets how many changes are kept for /changes consumers, older
+// ones are compacted. Zero keeps every change.
+type JournalConfig struct {
+	MaxEntries int `yaml:"max_entries" env:"FILESERVER_JOURNAL_MAX_ENTRIES" default:"100000"`
+}
+
+// ErasureConfig stores file contents Reed-Solomon coded across the given
+// directories, one per disk, instead of in the storage root. Every file is
+// split into DataShards data and ParityShards parity shards and survives the
+// loss of any ParityShards of them. Lost shards are rebuilt every
+// HealInterval or by running the server with -heal.
+type ErasureConfig struct {
+	Dirs         []string      `yaml:"dirs" env:"FILESERVER_ERASURE_DIRS"`
+	DataShards   int           `yaml:"data_shards" env:"FILESERVER_ERASURE_DATA_SHARDS" default:"4"`
+	ParityShards int           `yaml:"parity_shards" env:"FILESERVER_ERASURE_PARITY_SHARDS" default:"2"`
+	BlockSize    int           `yaml:"block_size" env:"FILESERVER_ERASURE_BLOCK_SIZE" default:"65536"`
+	HealInterval time.Duration `yaml:"heal_interval" env:"FILESERVER_ERASURE_HEAL_INTERVAL" default:"24h"`
+}
+
+const (
+	WatchAuto = "auto"
+	WatchPoll = "poll"
+	WatchOff  = "off"
+)
+
+// WatchConfig sets how files changed directly in the storage directories are
+// noticed: "auto" uses inotify where available and falls back to polling
+// every PollInterval, "poll" always polls and "off" disables the watcher
+type WatchConfig struct {
+	Mode         string        `yaml:"mode" env:"FILESERVER_WATCH_MODE" default:"auto"`
+	PollInterval time.Duration `yaml:"poll_interval" env:"FILESERVER_WATCH_POLL_INTERVAL" default:"30s"`
+}
+
+type Config struct {
+	Versioning  VersioningConfig  `yaml:"versioning"`
+	Trash       TrashConfig       `yaml:"trash"`
+	Expiry      ExpiryConfig      `yaml:"expiry"`
+	Quota       QuotaConfig       `yaml:"quota"`
+	Compression CompressionConfig `yaml:"compression"`
+	Encryption  EncryptionConfig  `yaml:"encryption"`
+	Scrub       ScrubConfig       `yaml:"scrub"`
+	Search      SearchConfig      `yaml:"search"`
+	Journal     JournalConfig     `yaml:"journal"`
+	Watch       WatchConfig       `yaml:"watch"`
+	Erasure     ErasureConfig     `yaml:"erasure"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Versioning: VersioningConfig{
+			Enabled:     false,
+			MaxVersions: 10,
+		},
+		Trash: TrashConfig{
+			Enabled:       true,
+			Retention:     7 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+		Expiry: ExpiryConfig{
+			SweepInterval: time.Minute,
+		},
+		Scrub: ScrubConfig{
+			Interval:   24 * time.Hour,
+			Quarantine: true,
+		},
+		Search: SearchConfig{
+			TextMaxFileSize: 8 * 1024 * 1024,
+		},
+		Journal: JournalConfig{
+			MaxEntries: 100000,
+		},
+		Watch: WatchConfig{
+			Mode:         WatchAuto,
+			PollInterval: 30 * time.Second,
+		},
+		Erasure: ErasureConfig{
+			DataShards:   4,
+			ParityShards: 2,
+			BlockSize:    64 * 1024,
+			HealInterval: 24 * time.Hour,
+		},
+	}
+}
+
+// BucketSettings override the server configuration for a single bucket
+type BucketSettings struct {
+	Versioning    *VersioningConfig `json:"versioning,omitempty"`
+	Quota         *QuotaConfig      `json:"quota,omitempty"`
+	TrashDisabled bool              `json:"trash_disabled,omitempty"`
+}
+
+// apply returns a copy of config with the overrides applied
+func (b *BucketSettings) apply(config *Config) *Config {
+	res := *config
+	if b.Versioning != nil {
+		res.Versioning = *b.Versioning
+	}
+	if b.Quota != nil {
+		res.Quota = *b.Quota
+	}
+	if b.TrashDisabled {
+		res.Trash.Enabled = false
+	}
+	return &res
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// sniffLen is the amount of content http.DetectContentType looks at
+const sniffLen = 512
+
+const genericContentType = "application/octet-stream"
+
+// DetectContentType picks the content type of a file: the type declared by
+// the client unless it is missing or generic, then the type registered for the
+// file extension and finally the type sniffed from the first bytes of the
+// content. The returned reader yields the complete content of r.
+func DetectContentType(r io.Reader, filename, declared string) (io.Reader, string) {
+	if mediaType, _, err := mime.ParseMediaType(declared); err == nil && mediaType != genericContentType {
+		return r, declared
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(filename)); contentType != "" && contentType != genericContentType {
+		return r, contentType
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	// a short read just means a small file, the error is reported by the
+	// next read of the returned reader
+	head, _ := br.Peek(sniffLen)
+	return br, http.DetectContentType(head)
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrSameFile = errors.New("source and destination are the same file")
+
+// TransferCheck decides under the storage lock whether a copy or a move may
+// proceed, dst is nil when the destination does not exist
+type TransferCheck func(src, dst *FileInfo) error
+
+// Copy stores the file under another name as well, metadata and expiry
+// included. The content is shared through a hard link, stored files are
+// never changed in place. Unless overwrite is set an existing destination
+// fails the copy with ErrExist. A failing check stops the copy with its
+// error. It reports whether an existing destination was replaced.
+func (s *Storage) Copy(src, dst string, overwrite bool, check TransferCheck) (bool, error) {
+	srcPath, dstPath, err := s.transferPaths(src, dst)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replaced, err := s.checkTransfer(src, srcPath, dst, dstPath, check)
+	if err != nil {
+		return false, err
+	}
+	return replaced, s.copy(src, srcPath, dst, dstPath, overwrite)
+}
+
+// Move renames the file like Copy. With versioning the source gets a delete
+// marker and the destination a new version, the history stays with each name.
+func (s *Storage) Move(src, dst string, overwrite bool, check TransferCheck) (bool, error) {
+	srcPath, dstPath, err := s.transferPaths(src, dst)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replaced, err := s.checkTransfer(src, srcPath, dst, dstPath, check)
+	if err != nil {
+		return false, err
+	}
+	return replaced, s.move(src, srcPath, dst, dstPath, overwrite)
+}
+
+// checkTransfer runs check and reports whether the destination exists. Must
+// be called with the storage lock held.
+func (s *Storage) checkTransfer(src, srcPath, dst, dstPath string, check TransferCheck) (bool, error) {
+	replaced := s.exists(dst, dstPath)
+	if check == nil || !s.exists(src, srcPath) {
+		// a missing source fails the transfer itself
+		return replaced, nil
+	}
+	srcInfo, err := s.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	var dstInfo *FileInfo
+	if replaced {
+		if dstInfo, err = s.Stat(dst); err != nil {
+			return false, err
+		}
+	}
+	return replaced, check(srcInfo, dstInfo)
+}
+
+func (s *Storage) transferPaths(src, dst string) (string, string, error) {
+	srcPath, err := s.filePath(src)
+	if err != nil {
+		return "", "", err
+	}
+	dstPath, err := s.filePath(dst)
+	if err != nil {
+		return "", "", err
+	}
+	if src == dst {
+		return "", "", &fileErr{filepath: dstPath, err: ErrSameFile}
+	}
+	return srcPath, dstPath, nil
+}
+
+// transferred returns the metadata and the stored size of the source and the
+// SHA-256 to record in versions after checking the destination can be
+// written. Must be called with the storage lock held.
+func (s *Storage) transferred(src, srcPath, dst, dstPath string, overwrite bool) (*Meta, int64, string, error) {
+	if !s.exists(src, srcPath) {
+		return nil, 0, "", &fileErr{filepath: srcPath, err: ErrNotExist}
+	}
+	if !overwrite && s.exists(dst, dstPath) {
+		return nil, 0, "", &fileErr{filepath: dstPath, err: ErrExist}
+	}
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	meta, err := s.readMeta(src)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	sum := meta.SHA256
+	// files stored before digests were recorded
+	if sum == "" && s.config.Versioning.Enabled {
+		if sum, err = s.contentSHA256(srcPath, meta); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	return meta, info.Size(), sum, nil
+}
+
+// copy is Copy with the storage lock held
+func (s *Storage) copy(src, srcPath, dst, dstPath string, overwrite bool) error {
+	meta, size, sum, err := s.transferred(src, srcPath, dst, dstPath, overwrite)
+	if err != nil {
+		return err
+	}
+
+	tmpName := filepath.Join(s.tmpDir, "copy-"+newID(time.Now()))
+	if meta.Erasure != nil {
+		// files never share shards, removing one would break the other
+		if meta.Erasure, err = s.copyShards(srcPath, meta); err != nil {
+			return err
+		}
+		err = createSparse(tmpName, size)
+	} else {
+		err = linkOrCopy(srcPath, tmpName)
+	}
+	if err != nil {
+		s.removeShards(meta)
+		return err
+	}
+	defer removeIfExists(tmpName)
+
+	err = s.commit(tmpName, dstPath, size, sum, meta, nil)
+	if err != nil && fileExists(tmpName) {
+		s.removeShards(meta)
+	}
+	return err
+}
+
+// move is Move with the storage lock held
+func (s *Storage) move(src, srcPath, dst, dstPath string, overwrite bool) error {
+	meta, size, sum, err := s.transferred(src, srcPath, dst, dstPath, overwrite)
+	if err != nil {
+		return err
+	}
+
+	// the source is accounted gone first so a rename is not refused for
+	// adding a file
+	s.fileReplaced(size, -1)
+	if err := s.commit(srcPath, dstPath, size, sum, meta, nil); err != nil {
+		s.fileReplaced(-1, size)
+		return err
+	}
+	removeIfExists(s.metaPath(src))
+	s.changed(src)
+
+	if s.config.Versioning.Enabled {
+		return s.addDeleteMarker(src)
+	}
+	return nil
+}
+
+// createSparse creates a file of the given size taking no space, the
+// placeholder of erasure coded content
+func createSparse(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		closeFile(f)
+		removeIfExists(path)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTransferCheck(t *testing.T) {
+	_, s := newTestBuckets(t, nil)
+	save(t, s, "a.txt", []byte("aaaa"))
+	save(t, s, "b.txt", []byte("bbb"))
+
+	replaced, err := s.Copy("a.txt", "c.txt", true, nil)
+	if err != nil || replaced {
+		t.Fatalf("copy to a new file reported replaced %t: %v", replaced, err)
+	}
+	replaced, err = s.Copy("b.txt", "c.txt", true, func(src, dst *FileInfo) error {
+		if src.Name != "b.txt" || dst == nil || dst.Name != "c.txt" || dst.Size != 4 {
+			t.Fatalf("checked %+v and %+v", src, dst)
+		}
+		return nil
+	})
+	if err != nil || !replaced {
+		t.Fatalf("copy over a file reported replaced %t: %v", replaced, err)
+	}
+
+	// a failing check leaves both files alone
+	refused := errors.New("refused")
+	_, err = s.Move("a.txt", "d.txt", true, func(src, dst *FileInfo) error {
+		if dst != nil {
+			t.Fatalf("missing destination checked as %+v", dst)
+		}
+		return refused
+	})
+	if !errors.Is(err, refused) {
+		t.Fatalf("expected the check error, got %v", err)
+	}
+	if _, err := s.Stat("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("d.txt"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("refused move created d.txt: %v", err)
+	}
+
+	// a missing source fails the transfer, not the check
+	_, err = s.Move("e.txt", "d.txt", true, func(src, dst *FileInfo) error { return refused })
+	if !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,418 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	encryptionChunkSize = 64 * 1024
+	keySize             = 32
+)
+
+var (
+	ErrInvalidKey       = errors.New("master key must be 32 bytes, raw or hex or base64 encoded")
+	ErrUnknownKey       = errors.New("file is encrypted with an unknown master key")
+	ErrCorruptedContent = errors.New("encrypted content is corrupted")
+)
+
+// Encryption describes how a stored file is encrypted. The content is split
+// into chunks sealed with AES-256-GCM under a random data key, the data key
+// is kept wrapped by the master key. Chunks are numbered by their nonce and
+// the last one is marked, so chunks can be decrypted independently while
+// reordering and truncation are still detected.
+type Encryption struct {
+	KeyID     string `json:"key_id"`
+	DataKey   []byte `json:"data_key,omitempty"`
+	ChunkSize int    `json:"chunk_size"`
+}
+
+// MasterKey wraps the data keys of encrypted files
+type MasterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func LoadMasterKey(path string) (*MasterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(data)
+	if err != nil {
+		return nil, &fileErr{filepath: path, err: err}
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &MasterKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == keySize {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ID identifies the key without revealing it
+func (k *MasterKey) ID() string {
+	return k.id
+}
+
+func (k *MasterKey) wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, dataKey, []byte(k.id)), nil
+}
+
+func (k *MasterKey) unwrap(wrapped []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(wrapped) < size {
+		return nil, ErrCorruptedContent
+	}
+	dataKey, err := k.aead.Open(nil, wrapped[:size], wrapped[size:], []byte(k.id))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptedContent, err)
+	}
+	return dataKey, nil
+}
+
+// keyRing holds the master key new files are encrypted with together with
+// previous keys that are still needed to read older files
+type keyRing struct {
+	current *MasterKey
+	keys    map[string]*MasterKey
+}
+
+// loadKeyRing returns nil when encryption is not configured
+func loadKeyRing(config *EncryptionConfig) (*keyRing, error) {
+	if config.KeyFile == "" {
+		return nil, nil
+	}
+
+	current, err := LoadMasterKey(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	k := &keyRing{current: current, keys: map[string]*MasterKey{current.id: current}}
+	for _, path := range config.PreviousKeyFiles {
+		key, err := LoadMasterKey(path)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[key.id] = key
+	}
+	return k, nil
+}
+
+func (k *keyRing) dataKey(enc *Encryption) ([]byte, error) {
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+	key, ok := k.keys[enc.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, enc.KeyID)
+	}
+	return key.unwrap(enc.DataKey)
+}
+
+// encrypt returns a writer encrypting into w under a new data key. The writer
+// must be closed to write the last chunk.
+func (k *keyRing) encrypt(w io.Writer) (io.WriteCloser, *Encryption, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := k.current.wrap(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc := &Encryption{KeyID: k.current.id, DataKey: wrapped, ChunkSize: encryptionChunkSize}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encryptionChunkSize)}, enc, nil
+}
+
+// decrypt returns a reader of the plaintext of file
+func (k *keyRing) decrypt(file storedFile, size int64, enc *Encryption) (io.ReadSeekCloser, error) {
+	dataKey, err := k.dataKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if enc.ChunkSize <= 0 {
+		return nil, ErrCorruptedContent
+	}
+
+	sealed := int64(enc.ChunkSize + aead.Overhead())
+	full, rest := size/sealed, size%sealed
+
+	d := &decryptReader{
+		file:       file,
+		aead:       aead,
+		chunkSize:  int64(enc.ChunkSize),
+		sealed:     sealed,
+		storedSize: size,
+		current:    -1,
+	}
+	switch {
+	case rest == 0 && full > 0:
+		d.chunks, d.size = full, full*d.chunkSize
+	case rest >= int64(aead.Overhead()):
+		d.chunks, d.size = full+1, full*d.chunkSize+rest-int64(aead.Overhead())
+	default:
+		return nil, ErrCorruptedContent
+	}
+	return d, nil
+}
+
+func chunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	out   []byte
+	index int64
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is sealed only once more data arrives, the last chunk
+		// is sealed by Close
+		if len(e.buf) == cap(e.buf) {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(e.index), e.buf, chunkAAD(last))
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+type decryptReader struct {
+	file       storedFile
+	aead       cipher.AEAD
+	chunkSize  int64
+	sealed     int64
+	chunks     int64
+	size       int64
+	storedSize int64
+	pos        int64
+
+	current int64
+	plain   []byte
+	buf     []byte
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	index := d.pos / d.chunkSize
+	if index != d.current {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-index*d.chunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) load(index int64) error {
+	offset := index * d.sealed
+	length := min(d.sealed, d.storedSize-offset)
+	if cap(d.buf) < int(length) {
+		d.buf = make([]byte, d.sealed)
+	}
+	buf := d.buf[:length]
+	if _, err := d.file.ReadAt(buf, offset); err != nil {
+		return err
+	}
+
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(index), buf, chunkAAD(index == d.chunks-1))
+	if err != nil {
+		d.current = -1
+		return fmt.Errorf("%w: chunk %d of %s", ErrCorruptedContent, index, d.file.Name())
+	}
+	d.plain, d.current = plain, index
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("decrypt: negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.file.Close()
+}
+
+// RewrapKeys wraps the data keys of all files, versions, trashed and
+// quarantined files with key, file contents are not touched. It returns how
+// many keys were rewrapped, keys already wrapped with key are skipped so an
+// interrupted rotation can be run again.
+func (s *Storage) RewrapKeys(key *MasterKey) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	rewrap := func(enc *Encryption) (bool, error) {
+		if enc == nil || enc.KeyID == key.id {
+			return false, nil
+		}
+		dataKey, err := s.keys.dataKey(enc)
+		if err != nil {
+			return false, err
+		}
+		wrapped, err := key.wrap(dataKey)
+		if err != nil {
+			return false, err
+		}
+		enc.KeyID, enc.DataKey = key.id, wrapped
+		count++
+		return true, nil
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(s.metaDir, "*.json"))
+	if err != nil {
+		return count, err
+	}
+	for _, pattern := range []string{
+		filepath.Join(s.trashDir, "*.meta"),
+		filepath.Join(s.quarantineDir, "*.meta"),
+	} {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return count, err
+		}
+		metaFiles = append(metaFiles, paths...)
+	}
+	for _, path := range metaFiles {
+		meta, err := readMetaFile(path)
+		if err != nil {
+			return count, err
+		}
+		changed, err := rewrap(meta.Encryption)
+		if err != nil {
+			return count, &fileErr{filepath: path, err: err}
+		}
+		if !changed {
+			continue
+		}
+		if err := s.writeMetaFile(path, meta); err != nil {
+			return count, err
+		}
+	}
+
+	entries, err := os.ReadDir(s.versionsDir)
+	if err != nil {
+		return count, err
+	}
+	for _, e := range entries {
+		versions, err := s.readManifest(e.Name())
+		if err != nil {
+			return count, err
+		}
+		changed := false
+		for i := range versions {
+			ok, err := rewrap(versions[i].Encryption)
+			if err != nil {
+				return count, &fileErr{filepath: e.Name(), err: err}
+			}
+			changed = changed || ok
+		}
+		if changed {
+			if err := s.writeManifest(e.Name(), versions); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// public returns a copy of the encryption details safe to show to clients
+func (e *Encryption) public() *Encryption {
+	if e == nil {
+		return nil
+	}
+	res := *e
+	res.DataKey = nil
+	return &res
+}
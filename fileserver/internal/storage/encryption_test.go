@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeKey(t *testing.T, dir, name string) *MasterKey {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	master, err := LoadMasterKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master
+}
+
+func TestRewrapKeys(t *testing.T) {
+	keys := t.TempDir()
+	oldKey := writeKey(t, keys, "old.key")
+	newKey := writeKey(t, keys, "new.key")
+
+	root := t.TempDir()
+	config := DefaultConfig()
+	config.Versioning.Enabled = true
+	config.Encryption.KeyFile = filepath.Join(keys, "old.key")
+	b, err := NewBuckets(root, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := b.Default()
+
+	save(t, s, "live.txt", []byte("first"))
+	if err := s.Update(bytes.NewReader([]byte("second")), "live.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	save(t, s, "trashed.txt", []byte("trashed"))
+	if err := s.Delete("trashed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	save(t, s, "corrupt.txt", []byte("corrupt"))
+	stored, err := os.ReadFile(filepath.Join(s.path, "corrupt.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[len(stored)-1] ^= 0xff
+	if err := os.WriteFile(filepath.Join(s.path, "corrupt.txt"), stored, 0640); err != nil {
+		t.Fatal(err)
+	}
+	report, err := s.Scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0].QuarantineID == "" {
+		t.Fatalf("corrupted file not quarantined: %+v", report.Corrupted)
+	}
+
+	meta, err := s.readMeta("live.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Encryption == nil || meta.Encryption.KeyID != oldKey.ID() {
+		t.Fatalf("file is not encrypted with the current key: %+v", meta.Encryption)
+	}
+
+	count, err := b.RewrapKeys(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Fatal("no keys rewrapped")
+	}
+	if count, err := b.RewrapKeys(newKey); err != nil || count != 0 {
+		t.Fatalf("second rotation rewrapped %d keys: %v", count, err)
+	}
+
+	// the old key is no longer needed
+	config.Encryption.KeyFile = filepath.Join(keys, "new.key")
+	b, err = NewBuckets(root, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = b.Default()
+
+	if got := content(t, s, "live.txt"); string(got) != "second" {
+		t.Fatalf("live file reads %q", got)
+	}
+	versions, err := s.Versions("live.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versions {
+		r, err := s.GetVersion("live.txt", v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("version %s: %v", v.ID, err)
+		}
+	}
+
+	trash, err := s.Trash()
+	if err != nil || len(trash) != 1 {
+		t.Fatalf("trash %v: %v", trash, err)
+	}
+	if _, err := s.RestoreFromTrash(trash[0].ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := content(t, s, "trashed.txt"); !bytes.Equal(got, []byte("trashed")) {
+		t.Fatalf("restored file reads %q", got)
+	}
+
+	meta, err = readMetaFile(filepath.Join(s.quarantineDir, report.Corrupted[0].QuarantineID+".meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Encryption.KeyID != newKey.ID() {
+		t.Fatalf("quarantined file is wrapped with %s", meta.Encryption.KeyID)
+	}
+	if _, err := s.keys.dataKey(meta.Encryption); err != nil {
+		t.Fatal(err)
+	}
+}
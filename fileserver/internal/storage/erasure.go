@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"yadro.com/course/internal/erasure"
+)
+
+// healGrace keeps shard sets not referenced by any file alone for a while,
+// they may belong to an upload being committed
+const healGrace = time.Hour
+
+var ErrErasureDisabled = errors.New("file is erasure coded but no erasure directories are configured")
+
+// storedFile is the content of a file as stored, either the file itself or
+// its erasure coded shards
+type storedFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Name() string
+}
+
+// openRaw opens a stored file as is and returns its stored size
+func (s *Storage) openRaw(path string, meta *Meta) (storedFile, int64, error) {
+	if meta.Erasure != nil {
+		if s.erasure == nil {
+			return nil, 0, &fileErr{filepath: path, err: ErrErasureDisabled}
+		}
+		// the placeholder tells a missing file apart from lost shards
+		if _, err := os.Stat(path); err != nil {
+			return nil, 0, err
+		}
+		r, err := s.erasure.Open(meta.Erasure)
+		if err != nil {
+			return nil, 0, &fileErr{filepath: path, err: err}
+		}
+		return r, meta.Erasure.Size, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		closeFile(file)
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// remove deletes a file, its metadata and shards permanently. Must be called
+// with the storage lock held.
+func (s *Storage) remove(filename, filePath string) error {
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil {
+		return err
+	}
+	removeIfExists(s.metaPath(filename))
+	s.dropShards(filename, meta)
+	return nil
+}
+
+// dropShards removes the shards of a file that is gone. Shards possibly used
+// by versions of the file are left to the healer, which removes them once
+// nothing refers to them.
+func (s *Storage) dropShards(filename string, meta *Meta) {
+	if s.erasure == nil || meta == nil || meta.Erasure == nil || s.config.Versioning.Enabled {
+		return
+	}
+	if versions, err := s.readManifest(filename); err != nil || len(versions) > 0 {
+		return
+	}
+	s.removeShards(meta)
+}
+
+// removeShards removes shards no file refers to
+func (s *Storage) removeShards(meta *Meta) {
+	if s.erasure == nil || meta.Erasure == nil {
+		return
+	}
+	if err := s.erasure.Remove(meta.Erasure.ID); err != nil {
+		log.Printf("Failed to remove shards %s: %v", meta.Erasure.ID, err)
+	}
+}
+
+// copyShards writes the shards of a file again and returns the new set
+func (s *Storage) copyShards(path string, meta *Meta) (*erasure.Manifest, error) {
+	if s.erasure == nil {
+		return nil, &fileErr{filepath: path, err: ErrErasureDisabled}
+	}
+	r, err := s.erasure.Open(meta.Erasure)
+	if err != nil {
+		return nil, &fileErr{filepath: path, err: err}
+	}
+	defer closeFile(r)
+
+	w, err := s.erasure.Create()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return nil, &fileErr{filepath: path, err: err}
+	}
+	return w.Close()
+}
+
+// shardSets returns the shard sets referenced by stored, trashed and
+// quarantined files and by versions
+func (s *Storage) shardSets() (map[string]*erasure.Manifest, error) {
+	res := map[string]*erasure.Manifest{}
+	add := func(m *erasure.Manifest) {
+		if m != nil {
+			res[m.ID] = m
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pattern := range []string{
+		filepath.Join(s.metaDir, "*.json"),
+		filepath.Join(s.trashDir, "*.meta"),
+		filepath.Join(s.quarantineDir, "*.meta"),
+	} {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			meta, err := readMetaFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			add(meta.Erasure)
+		}
+	}
+
+	entries, err := os.ReadDir(s.versionsDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		versions, err := s.readManifest(e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("versions of %s: %w", e.Name(), err)
+		}
+		for _, v := range versions {
+			add(v.Erasure)
+		}
+	}
+	return res, nil
+}
+
+// HealReport describes a run of the healer
+type HealReport struct {
+	// Sets counts the shard sets checked
+	Sets int `json:"sets"`
+	// Rebuilt counts the shards rewritten because they were missing,
+	// corrupted or in the wrong directory
+	Rebuilt int `json:"rebuilt"`
+	// Unrecoverable lists the sets that lost more shards than there is parity
+	Unrecoverable []string `json:"unrecoverable"`
+	// Removed counts the shard sets no file referred to anymore
+	Removed int `json:"removed"`
+}
+
+// Heal rebuilds the lost shards of every erasure coded file of every bucket
+// and removes shards no file refers to. Buckets share the erasure
+// directories, so sets are collected from all of them first.
+func (b *Buckets) Heal() (*HealReport, error) {
+	var store *erasure.Store
+	referenced := map[string]*erasure.Manifest{}
+	for _, s := range b.Storages() {
+		if s.erasure == nil {
+			continue
+		}
+		store = s.erasure
+		sets, err := s.shardSets()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path, err)
+		}
+		for id, m := range sets {
+			referenced[id] = m
+		}
+	}
+	report := &HealReport{Unrecoverable: []string{}}
+	if store == nil {
+		return report, nil
+	}
+
+	stored, err := store.Sets()
+	if err != nil {
+		return nil, err
+	}
+	for id, m := range referenced {
+		report.Sets++
+		rebuilt, err := store.Heal(m)
+		report.Rebuilt += rebuilt
+		if err != nil {
+			log.Printf("Failed to heal shards %s: %v", id, err)
+			report.Unrecoverable = append(report.Unrecoverable, id)
+		}
+	}
+
+	threshold := time.Now().Add(-healGrace)
+	for id, modified := range stored {
+		if _, ok := referenced[id]; ok || modified.After(threshold) {
+			continue
+		}
+		if err := store.Remove(id); err != nil {
+			log.Printf("Failed to remove unreferenced shards %s: %v", id, err)
+			continue
+		}
+		report.Removed++
+	}
+	return report, nil
+}
+
+// RunHealer periodically heals the erasure coded files, it never returns
+func (b *Buckets) RunHealer() {
+	if len(b.config.Erasure.Dirs) == 0 {
+		return
+	}
+	interval := b.config.Erasure.HealInterval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	for {
+		report, err := b.Heal()
+		if err != nil {
+			log.Printf("Failed to heal erasure coded files: %v", err)
+		} else if report.Rebuilt > 0 || report.Removed > 0 || len(report.Unrecoverable) > 0 {
+			log.Printf("Healed erasure coded files: rebuilt %d shards of %d sets, removed %d unreferenced sets, %d unrecoverable",
+				report.Rebuilt, report.Sets, report.Removed, len(report.Unrecoverable))
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBuckets(t *testing.T, configure func(*Config)) (*Buckets, *Storage) {
+	t.Helper()
+	config := DefaultConfig()
+	if configure != nil {
+		configure(&config)
+	}
+	b, err := NewBuckets(t.TempDir(), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, b.Default()
+}
+
+func save(t *testing.T, s *Storage, name string, data []byte) {
+	t.Helper()
+	if err := s.Save(bytes.NewReader(data), name, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func content(t *testing.T, s *Storage, name string) []byte {
+	t.Helper()
+	f, err := s.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestErasureLostDirectory(t *testing.T) {
+	root := t.TempDir()
+	dirs := []string{filepath.Join(root, "d1"), filepath.Join(root, "d2"), filepath.Join(root, "d3")}
+	b, s := newTestBuckets(t, func(c *Config) {
+		c.Erasure = ErasureConfig{Dirs: dirs, DataShards: 2, ParityShards: 1, BlockSize: 1000}
+	})
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	save(t, s, "file.bin", data)
+
+	if err := os.RemoveAll(dirs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content(t, s, "file.bin"), data) {
+		t.Fatal("content differs after losing a shard directory")
+	}
+
+	report, err := b.Heal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sets != 1 || report.Rebuilt != 1 || len(report.Unrecoverable) > 0 {
+		t.Fatalf("unexpected heal report %+v", report)
+	}
+	if err := os.RemoveAll(dirs[2]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content(t, s, "file.bin"), data) {
+		t.Fatal("content differs after healing and losing another directory")
+	}
+
+	// deleting the file for good removes its shards
+	if err := s.Delete("file.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.EmptyTrash(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	sets, err := s.erasure.Sets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 0 {
+		t.Fatalf("shards left after the file was purged: %v", sets)
+	}
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"log"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventCreated EventType = "created"
+	EventUpdated EventType = "updated"
+	EventDeleted EventType = "deleted"
+)
+
+// Event describes a change of a stored file, deleted files are described by
+// their last state
+type Event struct {
+	Type   EventType `json:"event"`
+	Bucket string    `json:"bucket"`
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256,omitempty"`
+	Time   time.Time `json:"timestamp"`
+}
+
+// changed brings the indexes up to date after the file was written or
+// removed, records the change in the journal and publishes it. Must be called
+// with the storage lock held.
+func (s *Storage) changed(filename string) {
+	prev, cur := s.reindex(filename)
+
+	e := Event{Bucket: s.bucket, Name: filename, Time: time.Now().UTC()}
+	switch {
+	case cur != nil && prev == nil:
+		e.Type, e.Size, e.SHA256 = EventCreated, cur.Size, cur.SHA256
+	case cur != nil:
+		e.Type, e.Size, e.SHA256 = EventUpdated, cur.Size, cur.SHA256
+	case prev != nil:
+		e.Type, e.Size, e.SHA256 = EventDeleted, prev.Size, prev.SHA256
+	default:
+		return
+	}
+
+	if err := s.journal.append(e); err != nil {
+		log.Printf("Failed to journal %s of %s: %v", e.Type, filename, err)
+	}
+	if s.notify != nil {
+		s.notify(e)
+	}
+}
+
+// Subscribe registers fn to be called on every change in every bucket. fn is
+// called while the bucket is locked, in the order of the changes, so it must
+// return quickly and must not use the storage.
+func (b *Buckets) Subscribe(fn func(Event)) {
+	b.listenersMu.Lock()
+	defer b.listenersMu.Unlock()
+
+	b.listeners = append(b.listeners, fn)
+}
+
+func (b *Buckets) publish(e Event) {
+	b.listenersMu.RLock()
+	defer b.listenersMu.RUnlock()
+
+	for _, fn := range b.listeners {
+		fn(e)
+	}
+}
+
+// attach makes the storage publish its changes as the named bucket
+func (b *Buckets) attach(name string, s *Storage) {
+	s.bucket = name
+	s.notify = b.publish
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// expired reports whether the file has passed its expiry time. Expired files
+// are treated as missing even before the sweeper removes them.
+func (s *Storage) expired(filename string, now time.Time) bool {
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		log.Printf("Failed to read metadata of %s: %v", filename, err)
+		return false
+	}
+	return meta.expired(now)
+}
+
+// RemoveExpired permanently deletes every file past its expiry time and
+// returns how many were removed
+func (s *Storage) RemoveExpired() (int, error) {
+	entries, err := os.ReadDir(s.metaDir)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for _, e := range entries {
+		filename, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !s.expired(filename, now) {
+			continue
+		}
+
+		filePath := filepath.Join(s.path, filename)
+		info, err := os.Stat(filePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to remove expired file %s: %v", filename, err)
+			continue
+		}
+		if info != nil {
+			if err := s.remove(filename, filePath); err != nil {
+				log.Printf("Failed to remove expired file %s: %v", filename, err)
+				continue
+			}
+			s.fileReplaced(info.Size(), -1)
+		}
+		removeIfExists(s.metaPath(filename))
+		s.changed(filename)
+		if s.config.Versioning.Enabled {
+			if err := s.addDeleteMarker(filename); err != nil {
+				log.Printf("Failed to record deletion of %s: %v", filename, err)
+			}
+		}
+		removed++
+	}
+	return removed, nil
+}
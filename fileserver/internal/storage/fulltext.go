@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxTextMatchLines = 20
+	maxSnippetLength  = 200
+)
+
+var ErrInvalidTextQuery = errors.New(`query must contain words, "quoted phrases" or prefixes ending with *`)
+
+// TextMatch is a file matching a full-text query with the lines that matched
+type TextMatch struct {
+	Name  string     `json:"name"`
+	Lines []TextLine `json:"lines"`
+}
+
+type TextLine struct {
+	Line    int    `json:"line"`
+	Snippet string `json:"snippet"`
+}
+
+// textIndex maps words to the text files containing them. Changes mark a
+// file stale and a background goroutine indexes stale files, a search first
+// indexes the ones still stale. Files are read without holding mu, so changes
+// never wait for indexing or searches.
+type textIndex struct {
+	mu       sync.Mutex
+	postings map[string]map[string]struct{}
+	terms    map[string][]string
+	stale    map[string]struct{}
+	// running is set while the indexer goroutine drains stale
+	running bool
+	// pass serializes indexing passes so a search waits for the files taken
+	// by the indexer
+	pass sync.Mutex
+}
+
+// textClause is a word, a prefix or a phrase of a query
+type textClause struct {
+	terms  []string
+	prefix bool
+}
+
+// IsText reports whether files of the content type hold text
+func IsText(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-ndjson",
+		"application/yaml", "application/x-sh", "application/toml":
+		return true
+	}
+	return false
+}
+
+// markStale schedules the file to be indexed again
+func (s *Storage) markStale(filename string) {
+	t := &s.text
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stale == nil {
+		t.stale = map[string]struct{}{}
+	}
+	t.stale[filename] = struct{}{}
+	if !t.running {
+		t.running = true
+		go s.runTextIndexer()
+	}
+}
+
+// runTextIndexer indexes stale files until none are left
+func (s *Storage) runTextIndexer() {
+	t := &s.text
+	for {
+		t.mu.Lock()
+		if len(t.stale) == 0 {
+			t.running = false
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+		s.indexStale()
+	}
+}
+
+// tokenize splits text into lower case words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func parseTextQuery(query string) ([]textClause, error) {
+	var clauses []textClause
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		if rest, ok := strings.CutPrefix(query, `"`); ok {
+			phrase, after, found := strings.Cut(rest, `"`)
+			if !found {
+				return nil, ErrInvalidTextQuery
+			}
+			if terms := tokenize(phrase); len(terms) > 0 {
+				clauses = append(clauses, textClause{terms: terms})
+			}
+			query = after
+			continue
+		}
+
+		word, after, _ := strings.Cut(query, " ")
+		prefix := strings.HasSuffix(word, "*")
+		terms := tokenize(word)
+		for i, term := range terms {
+			// "log-rot*" is the word log followed by the prefix rot
+			clauses = append(clauses, textClause{terms: []string{term}, prefix: prefix && i == len(terms)-1})
+		}
+		query = after
+	}
+	if len(clauses) == 0 {
+		return nil, ErrInvalidTextQuery
+	}
+	return clauses, nil
+}
+
+// SearchText finds text files containing every word, prefix and phrase of
+// the query. Phrases must be on a single line.
+func (s *Storage) SearchText(query string, limit int) ([]TextMatch, error) {
+	clauses, err := parseTextQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	s.indexStale()
+
+	t := &s.text
+	t.mu.Lock()
+	candidates := t.candidates(clauses)
+	t.mu.Unlock()
+
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := []TextMatch{}
+	for _, name := range names {
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+		lines, err := s.matchLines(name, clauses)
+		if err != nil {
+			log.Printf("Failed to search %s: %v", name, err)
+			continue
+		}
+		if lines != nil {
+			res = append(res, TextMatch{Name: name, Lines: lines})
+		}
+	}
+	return res, nil
+}
+
+// indexStale indexes the files changed since the last pass
+func (s *Storage) indexStale() {
+	t := &s.text
+	t.pass.Lock()
+	defer t.pass.Unlock()
+
+	t.mu.Lock()
+	stale := t.stale
+	t.stale = nil
+	t.mu.Unlock()
+
+	// removed files and files failing to read lose their terms
+	indexed := make(map[string][]string, len(stale))
+	for name := range stale {
+		terms, err := s.fileTerms(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to index %s: %v", name, err)
+		}
+		indexed[name] = terms
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.postings == nil {
+		t.postings, t.terms = map[string]map[string]struct{}{}, map[string][]string{}
+	}
+	for name, terms := range indexed {
+		t.remove(name)
+		for _, term := range terms {
+			if t.postings[term] == nil {
+				t.postings[term] = map[string]struct{}{}
+			}
+			t.postings[term][name] = struct{}{}
+		}
+		if len(terms) > 0 {
+			t.terms[name] = terms
+		}
+	}
+}
+
+func (t *textIndex) remove(name string) {
+	for _, term := range t.terms[name] {
+		delete(t.postings[term], name)
+		if len(t.postings[term]) == 0 {
+			delete(t.postings, term)
+		}
+	}
+	delete(t.terms, name)
+}
+
+// fileTerms returns the distinct words of a text file, other files and files
+// over the size limit have none
+func (s *Storage) fileTerms(name string) ([]string, error) {
+	file, info, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile(file)
+	if !IsText(info.ContentType) || info.Size > s.config.Search.TextMaxFileSize {
+		return nil, nil
+	}
+
+	seen := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), int(s.config.Search.TextMaxFileSize)+1)
+	for scanner.Scan() {
+		for _, term := range tokenize(scanner.Text()) {
+			seen[term] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	terms := make([]string, 0, len(seen))
+	for term := range seen {
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// candidates returns the files containing all words of the query, phrases
+// are checked against the content later
+func (t *textIndex) candidates(clauses []textClause) map[string]struct{} {
+	var res map[string]struct{}
+	for _, c := range clauses {
+		for i, term := range c.terms {
+			files := t.postings[term]
+			if c.prefix && i == len(c.terms)-1 {
+				files = map[string]struct{}{}
+				for indexed, postings := range t.postings {
+					if strings.HasPrefix(indexed, term) {
+						for name := range postings {
+							files[name] = struct{}{}
+						}
+					}
+				}
+			}
+			if res == nil {
+				res = make(map[string]struct{}, len(files))
+				for name := range files {
+					res[name] = struct{}{}
+				}
+				continue
+			}
+			for name := range res {
+				if _, ok := files[name]; !ok {
+					delete(res, name)
+				}
+			}
+		}
+	}
+	return res
+}
+
+// matchLines reads a candidate file and returns the lines matching any
+// clause, nil when some clause matches no line
+func (s *Storage) matchLines(name string, clauses []textClause) ([]TextLine, error) {
+	file, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile(file)
+
+	found := make([]bool, len(clauses))
+	lines := []TextLine{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), int(s.config.Search.TextMaxFileSize)+1)
+	for number := 1; scanner.Scan(); number++ {
+		words := tokenize(scanner.Text())
+		matched := false
+		for i, c := range clauses {
+			if c.match(words) {
+				found[i], matched = true, true
+			}
+		}
+		if matched && len(lines) < maxTextMatchLines {
+			lines = append(lines, TextLine{Line: number, Snippet: snippet(scanner.Text())})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, ok := range found {
+		if !ok {
+			return nil, nil
+		}
+	}
+	return lines, nil
+}
+
+// match reports whether the clause terms appear consecutively in words
+func (c *textClause) match(words []string) bool {
+	for start := 0; start+len(c.terms) <= len(words); start++ {
+		ok := true
+		for i, term := range c.terms {
+			word := words[start+i]
+			if c.prefix && i == len(c.terms)-1 {
+				ok = strings.HasPrefix(word, term)
+			} else {
+				ok = word == term
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func snippet(line string) string {
+	line = strings.TrimSpace(line)
+	if len(line) <= maxSnippetLength {
+		return line
+	}
+	// cut on a rune boundary
+	cut := maxSnippetLength
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut] + "…"
+}
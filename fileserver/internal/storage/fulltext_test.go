@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextIndexedInBackground(t *testing.T) {
+	_, s := newTestBuckets(t, nil)
+	text := &Meta{ContentType: "text/plain; charset=utf-8"}
+	if err := s.Save(strings.NewReader("hello\ngo gophers\n"), "a.txt", text); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload is indexed without a search asking for it
+	indexed := func() bool {
+		s.text.mu.Lock()
+		defer s.text.mu.Unlock()
+		_, ok := s.text.postings["gophers"]["a.txt"]
+		return ok
+	}
+	for deadline := time.Now().Add(5 * time.Second); !indexed(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("a.txt not indexed")
+		}
+	}
+
+	// searches see the changes made right before them
+	if err := s.Update(strings.NewReader("goodbye gophers"), "a.txt", text); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := s.SearchText(`"goodbye gophers"`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Name != "a.txt" || matches[0].Lines[0].Line != 1 {
+		t.Fatalf("unexpected matches %+v", matches)
+	}
+	if matches, err := s.SearchText("hello", 0); err != nil || len(matches) > 0 {
+		t.Fatalf("replaced content matched %+v: %v", matches, err)
+	}
+
+	if err := s.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if matches, err := s.SearchText("gophers", 0); err != nil || len(matches) > 0 {
+		t.Fatalf("deleted file matched %+v: %v", matches, err)
+	}
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SearchQuery selects files by their attributes, zero fields match any file
+type SearchQuery struct {
+	// Name is a glob pattern matched against the whole file name
+	Name           string
+	NameRegexp     *regexp.Regexp
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// ContentType matches the media type exactly or, as "image/*", by its
+	// top level type
+	ContentType string
+	// Metadata matches client metadata, an empty value only requires the key
+	// to be set
+	Metadata map[string]string
+	Limit    int
+}
+
+// index keeps the information about stored files in memory so searching does
+// not touch the disk
+type index struct {
+	mu    sync.RWMutex
+	files map[string]FileInfo
+}
+
+// loadIndex builds the index from the metadata persisted for the files, so
+// files written, changed or removed while the server was not running differ
+// from it until they are reconciled
+func (s *Storage) loadIndex() error {
+	files, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	s.index.files = make(map[string]FileInfo, len(files))
+	for _, f := range files {
+		meta, err := s.readMeta(f.Name)
+		if err != nil {
+			return err
+		}
+		if meta.empty() {
+			// every stored file is described, this one was written directly
+			continue
+		}
+		if meta.StoredModTime != nil {
+			f.ModTime, f.storedSize = *meta.StoredModTime, meta.StoredSize
+		}
+		s.index.files[f.Name] = f
+		s.markStale(f.Name)
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(s.metaDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range metaFiles {
+		filename := strings.TrimSuffix(filepath.Base(path), ".json")
+		if _, ok := s.index.files[filename]; ok || !ValidName(filename) || fileExists(filepath.Join(s.path, filename)) {
+			continue
+		}
+		// the file was removed
+		meta, err := readMetaFile(path)
+		if err != nil {
+			return err
+		}
+		s.index.files[filename] = FileInfo{Name: filename, Size: meta.size(meta.StoredSize), Meta: meta.public(),
+			storedSize: meta.StoredSize}
+	}
+	return nil
+}
+
+// reindex brings the indexes up to date after the file was written or removed
+// and returns the previous and the current file information, nil when the
+// file did not exist. Must be called with the storage lock held.
+func (s *Storage) reindex(filename string) (*FileInfo, *FileInfo) {
+	s.markStale(filename)
+
+	info, err := s.Stat(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to index %s: %v", filename, err)
+	}
+
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+
+	var prev *FileInfo
+	if f, ok := s.index.files[filename]; ok {
+		prev = &f
+	}
+	if err != nil {
+		delete(s.index.files, filename)
+		return prev, nil
+	}
+	s.index.files[filename] = *info
+	return prev, info
+}
+
+// Search returns the files matching the query sorted by name
+func (s *Storage) Search(q *SearchQuery) []FileInfo {
+	s.index.mu.RLock()
+	defer s.index.mu.RUnlock()
+
+	now := time.Now()
+	res := []FileInfo{}
+	for _, f := range s.index.files {
+		if !f.expired(now) && q.match(&f) {
+			res = append(res, f)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	return res
+}
+
+func (q *SearchQuery) match(f *FileInfo) bool {
+	if q.Name != "" {
+		if ok, _ := filepath.Match(q.Name, f.Name); !ok {
+			return false
+		}
+	}
+	if q.NameRegexp != nil && !q.NameRegexp.MatchString(f.Name) {
+		return false
+	}
+	if f.Size < q.MinSize || q.MaxSize > 0 && f.Size > q.MaxSize {
+		return false
+	}
+	if !q.ModifiedAfter.IsZero() && !f.ModTime.After(q.ModifiedAfter) ||
+		!q.ModifiedBefore.IsZero() && !f.ModTime.Before(q.ModifiedBefore) {
+		return false
+	}
+	if q.ContentType != "" && !matchContentType(q.ContentType, f.ContentType) {
+		return false
+	}
+	for k, v := range q.Metadata {
+		value, ok := f.Metadata[strings.ToLower(k)]
+		if !ok || v != "" && value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func matchContentType(pattern, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return mediaType == strings.ToLower(pattern)
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// journalSegmentEntries is the number of changes per journal file, compaction
+// removes whole files
+const journalSegmentEntries = 1000
+
+var ErrChangesCompacted = errors.New("changes after the given sequence number were compacted, list the files to resynchronize")
+
+// Change is a journal entry, sequence numbers grow by one with every change
+type Change struct {
+	Seq uint64 `json:"seq"`
+	Event
+}
+
+type ChangesPage struct {
+	Changes []Change `json:"changes"`
+	// Next is the sequence number to continue from
+	Next uint64 `json:"next"`
+	// Oldest is the first retained change, consumers behind it have missed
+	// changes
+	Oldest uint64 `json:"oldest"`
+	Latest uint64 `json:"latest"`
+}
+
+// journal is an append only log of changes kept in .fileserver/journal as
+// files of JSON lines named after their first sequence number
+type journal struct {
+	mu         sync.Mutex
+	dir        string
+	maxEntries int
+	segments   []journalSegment
+	file       *os.File
+	last       uint64
+}
+
+type journalSegment struct {
+	first uint64
+	count int
+}
+
+func openJournal(dir string, maxEntries int) (*journal, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{dir: dir, maxEntries: maxEntries}
+	for _, path := range paths {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		j.segments = append(j.segments, journalSegment{first: first})
+	}
+	sort.Slice(j.segments, func(a, b int) bool { return j.segments[a].first < j.segments[b].first })
+	if len(j.segments) == 0 {
+		return j, nil
+	}
+
+	for i := 0; i < len(j.segments)-1; i++ {
+		j.segments[i].count = int(j.segments[i+1].first - j.segments[i].first)
+	}
+	current := &j.segments[len(j.segments)-1]
+	count, err := j.recover(current.first)
+	if err != nil {
+		return nil, err
+	}
+	current.count = count
+	j.last = current.first + uint64(count) - 1
+
+	j.file, err = os.OpenFile(j.path(current.first), os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// recover counts the changes of the current journal file dropping a line
+// left partially written by a crash
+func (j *journal) recover(first uint64) (int, error) {
+	data, err := os.ReadFile(j.path(first))
+	if err != nil {
+		return 0, err
+	}
+
+	count, valid := 0, 0
+	for rest := data; len(rest) > 0; {
+		line, after, ok := bytes.Cut(rest, []byte("\n"))
+		var c Change
+		if !ok || json.Unmarshal(line, &c) != nil || c.Seq != first+uint64(count) {
+			break
+		}
+		count++
+		valid += len(line) + 1
+		rest = after
+	}
+	if valid < len(data) {
+		if err := os.Truncate(j.path(first), int64(valid)); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+func (j *journal) path(first uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d.log", first))
+}
+
+func (j *journal) append(e Event) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.segments) == 0 || j.segments[len(j.segments)-1].count >= journalSegmentEntries {
+		if err := j.rotate(j.last + 1); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(Change{Seq: j.last + 1, Event: e})
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	j.last++
+	j.segments[len(j.segments)-1].count++
+
+	j.compact()
+	return nil
+}
+
+// rotate starts a new journal file. Must be called with the journal lock held.
+func (j *journal) rotate(first uint64) error {
+	file, err := os.OpenFile(j.path(first), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		closeFile(j.file)
+	}
+	j.file = file
+	j.segments = append(j.segments, journalSegment{first: first})
+	return nil
+}
+
+// compact removes the oldest journal files while the rest still hold at least
+// maxEntries changes. Must be called with the journal lock held.
+func (j *journal) compact() {
+	if j.maxEntries <= 0 {
+		return
+	}
+	total := 0
+	for _, seg := range j.segments {
+		total += seg.count
+	}
+	for len(j.segments) > 1 && total-j.segments[0].count >= j.maxEntries {
+		removeIfExists(j.path(j.segments[0].first))
+		total -= j.segments[0].count
+		j.segments = j.segments[1:]
+	}
+}
+
+// changes returns up to limit changes after since. When changes after since
+// were already compacted the page describes the retained window and
+// ErrChangesCompacted is returned.
+func (j *journal) changes(since uint64, limit int) (*ChangesPage, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	page := &ChangesPage{Changes: []Change{}, Next: since, Oldest: j.last + 1, Latest: j.last}
+	if len(j.segments) > 0 {
+		page.Oldest = j.segments[0].first
+	}
+	// Oldest is at least 1
+	if since < page.Oldest-1 {
+		return page, ErrChangesCompacted
+	}
+
+	for _, seg := range j.segments {
+		if len(page.Changes) >= limit {
+			break
+		}
+		if seg.first+uint64(seg.count)-1 <= since {
+			continue
+		}
+		if err := j.read(seg.first, since, limit, page); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+func (j *journal) read(first, since uint64, limit int, page *ChangesPage) error {
+	file, err := os.Open(j.path(first))
+	if err != nil {
+		return err
+	}
+	defer closeFile(file)
+
+	reader := bufio.NewReader(file)
+	for len(page.Changes) < limit {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var c Change
+		if err := json.Unmarshal(line, &c); err != nil {
+			return &fileErr{filepath: file.Name(), err: err}
+		}
+		if c.Seq > since {
+			page.Changes = append(page.Changes, c)
+			page.Next = c.Seq
+		}
+	}
+	return nil
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file != nil {
+		closeFile(j.file)
+		j.file = nil
+	}
+}
+
+// Changes returns up to limit changes of the storage after the sequence
+// number since
+func (s *Storage) Changes(since uint64, limit int) (*ChangesPage, error) {
+	return s.journal.changes(since, limit)
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"yadro.com/course/internal/erasure"
+)
+
+const (
+	maxMetadataKeys = 64
+	maxMetadataSize = 8 * 1024
+)
+
+var (
+	ErrInvalidMetadata = errors.New("metadata keys must be letters, digits, '-' or '_', values must not contain control characters and all metadata must fit in 8KiB")
+
+	metadataKeyRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,128}$`)
+)
+
+// Meta is service data persisted alongside a file in
+// .fileserver/meta/<filename>.json
+type Meta struct {
+	ContentType string     `json:"content_type,omitempty"`
+	SHA256      string     `json:"sha256,omitempty"`
+	MD5         string     `json:"md5,omitempty"` // the ETag S3 clients expect
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Compression string     `json:"compression,omitempty"`
+	// ContentLength is the size of the uploaded content when it differs from
+	// the size of the file on disk
+	ContentLength int64       `json:"content_length,omitempty"`
+	Encryption    *Encryption `json:"encryption,omitempty"`
+	// Erasure is set when the content is kept as shards in the erasure
+	// directories, the file in the storage root only reserves its size
+	Erasure *erasure.Manifest `json:"erasure,omitempty"`
+	// Metadata is set by clients, keys are lower case
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// StoredSize and StoredModTime describe the file on disk when the
+	// metadata was written, files changed while the server was not running
+	// differ from them
+	StoredSize    int64      `json:"stored_size,omitempty"`
+	StoredModTime *time.Time `json:"stored_mod_time,omitempty"`
+}
+
+func (m *Meta) empty() bool {
+	return m == nil || m.ContentType == "" && m.SHA256 == "" && m.ExpiresAt == nil && m.Compression == "" &&
+		m.ContentLength == 0 && m.Encryption == nil && m.Erasure == nil &&
+		len(m.Metadata) == 0
+}
+
+func (m *Meta) expired(now time.Time) bool {
+	return m != nil && m.ExpiresAt != nil && !m.ExpiresAt.After(now)
+}
+
+// encoded reports whether the file on disk differs from the uploaded content
+func (m *Meta) encoded() bool {
+	return m.Compression != "" || m.Encryption != nil || m.Erasure != nil
+}
+
+// size returns the content size of a file taking storedSize bytes on disk
+func (m *Meta) size(storedSize int64) int64 {
+	if m.encoded() {
+		return m.ContentLength
+	}
+	return storedSize
+}
+
+// public returns a copy of the metadata without secrets
+func (m *Meta) public() Meta {
+	res := *m
+	res.Encryption = m.Encryption.public()
+	res.StoredSize, res.StoredModTime = 0, nil
+	return res
+}
+
+func (s *Storage) metaPath(filename string) string {
+	return filepath.Join(s.metaDir, filename+".json")
+}
+
+// readMeta returns metadata of the file, files without metadata get an empty
+// one
+func (s *Storage) readMeta(filename string) (*Meta, error) {
+	return readMetaFile(s.metaPath(filename))
+}
+
+func readMetaFile(path string) (*Meta, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Meta{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta Meta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// writeMeta stores metadata of the file or removes it when there is nothing to
+// store. Must be called with the storage lock held.
+func (s *Storage) writeMeta(filename string, meta *Meta) error {
+	if meta.empty() {
+		removeIfExists(s.metaPath(filename))
+		return nil
+	}
+
+	stamped := *meta
+	if info, err := os.Stat(filepath.Join(s.path, filename)); err == nil {
+		modTime := info.ModTime().UTC()
+		stamped.StoredSize, stamped.StoredModTime = info.Size(), &modTime
+	}
+	return s.writeMetaFile(s.metaPath(filename), &stamped)
+}
+
+func (s *Storage) writeMetaFile(path string, meta *Meta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, s.tmpDir)
+}
+
+// Meta returns metadata of a stored file
+func (s *Storage) Meta(filename string) (*Meta, error) {
+	info, err := s.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &info.Meta, nil
+}
+
+// SetMetadata replaces the client metadata of a file without touching its
+// content
+func (s *Storage) SetMetadata(filename string, metadata map[string]string) (map[string]string, error) {
+	return s.updateMetadata(filename, func(map[string]string) map[string]string {
+		return metadata
+	})
+}
+
+// PatchMetadata merges changes into the client metadata of a file, keys with
+// a nil value are removed
+func (s *Storage) PatchMetadata(filename string, changes map[string]*string) (map[string]string, error) {
+	return s.updateMetadata(filename, func(current map[string]string) map[string]string {
+		res := make(map[string]string, len(current)+len(changes))
+		for k, v := range current {
+			res[k] = v
+		}
+		for k, v := range changes {
+			k = strings.ToLower(k)
+			if v == nil {
+				delete(res, k)
+			} else {
+				res[k] = *v
+			}
+		}
+		return res
+	})
+}
+
+func (s *Storage) updateMetadata(filename string, update func(map[string]string) map[string]string) (map[string]string, error) {
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeMetadata(filename, filePath, update)
+}
+
+// writeMetadata replaces the client metadata of a file with the one returned
+// by update. Must be called with the storage lock held.
+func (s *Storage) writeMetadata(filename, filePath string, update func(map[string]string) map[string]string) (
+	map[string]string, error) {
+	if !s.exists(filename, filePath) {
+		return nil, &fileErr{filepath: filePath, err: ErrNotExist}
+	}
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := normalizeMetadata(update(meta.Metadata))
+	if err != nil {
+		return nil, err
+	}
+	meta.Metadata = metadata
+	err = s.writeMeta(filename, meta)
+	s.changed(filename)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		return map[string]string{}, nil
+	}
+	return metadata, nil
+}
+
+// normalizeMetadata lower cases the keys of client metadata and checks it
+// fits the limits, empty metadata is returned as nil
+func normalizeMetadata(metadata map[string]string) (map[string]string, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	if len(metadata) > maxMetadataKeys {
+		return nil, ErrInvalidMetadata
+	}
+
+	res := make(map[string]string, len(metadata))
+	size := 0
+	for k, v := range metadata {
+		k = strings.ToLower(k)
+		if !metadataKeyRegexp.MatchString(k) || strings.ContainsFunc(v, unicode.IsControl) {
+			return nil, ErrInvalidMetadata
+		}
+		size += len(k) + len(v)
+		res[k] = v
+	}
+	if size > maxMetadataSize {
+		return nil, ErrInvalidMetadata
+	}
+	return res, nil
+}
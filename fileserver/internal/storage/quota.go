@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	ErrFileTooLarge  = errors.New("file is too large")
+)
+
+// Usage is the space taken by stored files together with the configured
+// limits, zero limits are not enforced
+type Usage struct {
+	Bytes       int64 `json:"bytes"`
+	Files       int   `json:"files"`
+	MaxBytes    int64 `json:"max_bytes,omitempty"`
+	MaxFiles    int   `json:"max_files,omitempty"`
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+}
+
+// usage tracks stored bytes and files. Uploads in progress reserve the bytes
+// they have written so concurrent uploads can not overrun the quota together.
+type usage struct {
+	mu       sync.Mutex
+	bytes    int64
+	files    int
+	reserved int64
+}
+
+// loadUsage computes the usage from the files in the storage root
+func (s *Storage) loadUsage() error {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+
+	var bytes int64
+	files := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		bytes += info.Size()
+		files++
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	s.usage.bytes, s.usage.files = bytes, files
+	return nil
+}
+
+func (s *Storage) Usage() Usage {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	return Usage{
+		Bytes:       s.usage.bytes,
+		Files:       s.usage.files,
+		MaxBytes:    s.config.Quota.MaxBytes,
+		MaxFiles:    s.config.Quota.MaxFiles,
+		MaxFileSize: s.config.Quota.MaxFileSize,
+	}
+}
+
+func (s *Storage) reserve(n int64) error {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if limit := s.config.Quota.MaxBytes; limit > 0 && s.usage.bytes+s.usage.reserved+n > limit {
+		return fmt.Errorf("%w: total size limit is %d bytes", ErrQuotaExceeded, limit)
+	}
+	s.usage.reserved += n
+	return nil
+}
+
+func (s *Storage) release(n int64) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	s.usage.reserved -= n
+}
+
+// checkFileCount fails when one more file would exceed the file limit
+func (s *Storage) checkFileCount() error {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if limit := s.config.Quota.MaxFiles; limit > 0 && s.usage.files >= limit {
+		return fmt.Errorf("%w: file count limit is %d", ErrQuotaExceeded, limit)
+	}
+	return nil
+}
+
+// fileReplaced accounts a file of size newSize replacing one of size oldSize,
+// a negative size means there was no file
+func (s *Storage) fileReplaced(oldSize, newSize int64) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	if oldSize >= 0 {
+		s.usage.bytes -= oldSize
+		s.usage.files--
+	}
+	if newSize >= 0 {
+		s.usage.bytes += newSize
+		s.usage.files++
+	}
+}
+
+// quotaWriter fails the upload as soon as it goes over the size limits. The
+// upload replaces a file of allowance bytes, only the growth over it is
+// reserved in the total size, checkReplace settles the net change.
+type quotaWriter struct {
+	s         *Storage
+	allowance int64
+	written   int64
+	reserved  int64
+}
+
+// newQuotaWriter returns the quota writer of an upload to filePath
+func (s *Storage) newQuotaWriter(filePath string) *quotaWriter {
+	q := &quotaWriter{s: s}
+	if info, err := os.Stat(filePath); err == nil {
+		q.allowance = info.Size()
+	}
+	return q
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if limit := q.s.config.Quota.MaxFileSize; limit > 0 && q.written+n > limit {
+		return 0, fmt.Errorf("%w: size limit is %d bytes", ErrFileTooLarge, limit)
+	}
+	if grow := q.written + n - q.allowance - q.reserved; grow > 0 {
+		if err := q.s.reserve(grow); err != nil {
+			return 0, err
+		}
+		q.reserved += grow
+	}
+	q.written += n
+	return len(p), nil
+}
+
+// release gives back the reserved bytes once the upload is accounted
+func (q *quotaWriter) release() {
+	q.s.release(q.reserved)
+	q.reserved = 0
+}
+
+// checkReplace fails when replacing a file of size oldSize with one of size
+// newSize would exceed the quota, a negative oldSize means a new file
+func (s *Storage) checkReplace(oldSize, newSize int64) error {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+
+	return s.checkQuota(s.usage.bytes, s.usage.files, oldSize, newSize)
+}
+
+// checkQuota is checkReplace for storage holding the given bytes and files
+func (s *Storage) checkQuota(bytes int64, files int, oldSize, newSize int64) error {
+	if oldSize < 0 {
+		if limit := s.config.Quota.MaxFiles; limit > 0 && files >= limit {
+			return fmt.Errorf("%w: file count limit is %d", ErrQuotaExceeded, limit)
+		}
+		oldSize = 0
+	}
+	if limit := s.config.Quota.MaxBytes; limit > 0 && newSize > oldSize && bytes-oldSize+newSize > limit {
+		return fmt.Errorf("%w: total size limit is %d bytes", ErrQuotaExceeded, limit)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestUpdateWithinQuota(t *testing.T) {
+	_, s := newTestBuckets(t, func(c *Config) {
+		c.Quota.MaxBytes = 100
+	})
+	save(t, s, "a.txt", bytes.Repeat([]byte("a"), 60))
+
+	// the replaced file leaves room for its successor
+	if err := s.Update(bytes.NewReader(bytes.Repeat([]byte("b"), 60)), "a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(bytes.NewReader(bytes.Repeat([]byte("c"), 100)), "a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(bytes.NewReader(bytes.Repeat([]byte("d"), 101)), "a.txt", nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := s.Save(bytes.NewReader([]byte("e")), "e.txt", nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if usage := s.Usage(); usage.Bytes != 100 || usage.Files != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	if s.usage.reserved != 0 {
+		t.Fatalf("%d bytes left reserved", s.usage.reserved)
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Reconcile brings metadata and indexes in line with files created, changed
+// or removed directly in the storage directory and returns how many such
+// changes were found. The changes are published like the ones made through
+// the API.
+func (s *Storage) Reconcile() (int, error) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return 0, err
+	}
+
+	names := map[string]struct{}{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			names[e.Name()] = struct{}{}
+		}
+	}
+	s.index.mu.RLock()
+	for name := range s.index.files {
+		names[name] = struct{}{}
+	}
+	s.index.mu.RUnlock()
+
+	count := 0
+	for name := range names {
+		changed, err := s.reconcileFile(name)
+		if err != nil {
+			log.Printf("Failed to reconcile %s in %s: %v", name, s.path, err)
+		}
+		if changed {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// reconcileFile checks a single file against the index. A file that is new
+// or whose size or modification time differ was written out of band: its
+// content is taken as is, described by a fresh checksum and content type
+// while client metadata is kept.
+func (s *Storage) reconcileFile(filename string) (bool, error) {
+	if !ValidName(filename) {
+		return false, nil
+	}
+	filePath := filepath.Join(s.path, filename)
+
+	info, err := os.Stat(filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if info != nil && info.IsDir() {
+		info = nil
+	}
+	if info != nil && s.expired(filename, time.Now()) {
+		// left to the expiry sweeper
+		return false, nil
+	}
+
+	if info == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		indexed, ok := s.indexed(filename)
+		if !ok || fileExists(filePath) {
+			return false, nil
+		}
+		removeIfExists(s.metaPath(filename))
+		s.fileReplaced(indexed.storedSize, -1)
+		s.changed(filename)
+		return true, nil
+	}
+
+	if indexed, ok := s.indexed(filename); ok && unchanged(&indexed, info) {
+		return false, nil
+	}
+
+	// hashing happens without blocking writers, the file is checked again
+	// under the lock
+	contentType, sum, err := describeFile(filePath, filename)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := os.Stat(filePath)
+	if err != nil || !current.ModTime().Equal(info.ModTime()) || current.Size() != info.Size() {
+		// changed again, the next check picks it up
+		return false, nil
+	}
+	indexed, ok := s.indexed(filename)
+	if ok && unchanged(&indexed, current) {
+		return false, nil
+	}
+
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		return false, err
+	}
+	err = s.writeMeta(filename, &Meta{
+		ContentType: contentType,
+		SHA256:      sum,
+		ExpiresAt:   meta.ExpiresAt,
+		Metadata:    meta.Metadata,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	oldSize := int64(-1)
+	if ok {
+		oldSize = indexed.storedSize
+	}
+	s.fileReplaced(oldSize, current.Size())
+	s.changed(filename)
+	return true, nil
+}
+
+func (s *Storage) indexed(filename string) (FileInfo, bool) {
+	s.index.mu.RLock()
+	defer s.index.mu.RUnlock()
+
+	f, ok := s.index.files[filename]
+	return f, ok
+}
+
+func unchanged(indexed *FileInfo, info os.FileInfo) bool {
+	return indexed.ModTime.Equal(info.ModTime()) && indexed.storedSize == info.Size()
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// describeFile detects the content type of a file and computes its SHA-256
+func describeFile(path, filename string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer closeFile(f)
+
+	content, contentType := DetectContentType(f, filename, "")
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", "", err
+	}
+	return contentType, hex.EncodeToString(hash.Sum(nil)), nil
+}
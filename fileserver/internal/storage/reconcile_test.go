@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReconcileAtStartup(t *testing.T) {
+	keys := t.TempDir()
+	writeKey(t, keys, "master.key")
+	root := t.TempDir()
+	config := DefaultConfig()
+	config.Encryption.KeyFile = filepath.Join(keys, "master.key")
+	b, err := NewBuckets(root, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := b.Default()
+	save(t, s, "kept.txt", []byte("kept"))
+	save(t, s, "changed.txt", []byte("encrypted"))
+	save(t, s, "removed.txt", []byte("removed"))
+	page, err := s.Changes(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server is down while the directory is changed
+	later := time.Now().Add(time.Minute)
+	for name, content := range map[string]string{"changed.txt": "plain", "added.txt": "added"} {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(root, "removed.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = NewBuckets(root, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = b.Default()
+
+	// encrypted files left alone are not taken for changed ones
+	if got := content(t, s, "kept.txt"); string(got) != "kept" {
+		t.Fatalf("kept.txt reads %q", got)
+	}
+	for name, want := range map[string]string{"changed.txt": "plain", "added.txt": "added"} {
+		if got := content(t, s, name); string(got) != want {
+			t.Fatalf("%s reads %q", name, got)
+		}
+		info, err := s.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(want))
+		if info.SHA256 != hex.EncodeToString(sum[:]) || info.Encryption != nil {
+			t.Fatalf("%s described as %+v", name, info.Meta)
+		}
+	}
+	if _, err := s.Stat("removed.txt"); err == nil {
+		t.Fatal("removed.txt still listed")
+	}
+	if _, err := os.Stat(s.metaPath("removed.txt")); err == nil {
+		t.Fatal("metadata of removed.txt kept")
+	}
+	if usage := s.Usage(); usage.Files != 3 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	changes, err := s.Changes(page.Next, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := map[string]EventType{}
+	for _, c := range changes.Changes {
+		events[c.Name] = c.Type
+	}
+	want := map[string]EventType{"changed.txt": EventUpdated, "added.txt": EventCreated, "removed.txt": EventDeleted}
+	if len(events) != len(want) {
+		t.Fatalf("journaled %v, expected %v", events, want)
+	}
+	for name, typ := range want {
+		if events[name] != typ {
+			t.Fatalf("journaled %v, expected %v", events, want)
+		}
+	}
+}
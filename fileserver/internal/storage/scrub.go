@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ScrubReport is the outcome of checking stored files against their SHA-256
+type ScrubReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Checked  int       `json:"checked"`
+	// Recorded counts files stored before checksums were kept, their current
+	// checksum is recorded
+	Recorded  int           `json:"recorded"`
+	Corrupted []CorruptFile `json:"corrupted"`
+}
+
+// CorruptFile is a file whose content no longer matches its checksum, unless
+// quarantine is disabled it is moved to .fileserver/quarantine/<id>.data
+type CorruptFile struct {
+	Name         string    `json:"name"`
+	Expected     string    `json:"expected"`
+	Actual       string    `json:"actual,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	QuarantineID string    `json:"quarantine_id,omitempty"`
+	Detected     time.Time `json:"detected"`
+}
+
+// LastScrub returns the report of the latest scrub or nil if none has run
+func (s *Storage) LastScrub() *ScrubReport {
+	return s.lastScrub.Load()
+}
+
+// Scrub re-hashes every stored file and quarantines the ones whose content
+// does not match the recorded checksum
+func (s *Storage) Scrub() (*ScrubReport, error) {
+	s.scrubMu.Lock()
+	defer s.scrubMu.Unlock()
+
+	files, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScrubReport{Started: time.Now().UTC(), Corrupted: []CorruptFile{}}
+	for _, f := range files {
+		if err := s.scrubFile(f.Name, report); err != nil {
+			log.Printf("Failed to scrub %s: %v", f.Name, err)
+		}
+	}
+	report.Finished = time.Now().UTC()
+
+	s.lastScrub.Store(report)
+	return report, nil
+}
+
+func (s *Storage) scrubFile(filename string, report *ScrubReport) error {
+	filePath := filepath.Join(s.path, filename)
+
+	// the file is opened under the lock so the content and the metadata
+	// belong together, hashing happens without blocking writers
+	s.mu.Lock()
+	meta, err := s.readMeta(filename)
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(filePath)
+	}
+	var content io.ReadSeekCloser
+	if err == nil {
+		content, err = s.openContent(filePath, meta)
+	}
+	s.mu.Unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	hash := sha256.New()
+	if err == nil {
+		_, err = io.Copy(hash, content)
+		closeFile(content)
+	} else if !errors.Is(err, ErrCorruptedContent) {
+		return err
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	report.Checked++
+
+	if err == nil && actual == meta.SHA256 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the file may have been replaced while it was hashed
+	current, statErr := os.Stat(filePath)
+	currentMeta, metaErr := s.readMeta(filename)
+	if statErr != nil || metaErr != nil || !os.SameFile(info, current) || currentMeta.SHA256 != meta.SHA256 {
+		return nil
+	}
+
+	if err == nil && meta.SHA256 == "" {
+		meta.SHA256 = actual
+		report.Recorded++
+		// only the checksum is recorded, the file itself has not changed
+		defer s.reindex(filename)
+		return s.writeMeta(filename, meta)
+	}
+
+	corrupt := CorruptFile{Name: filename, Expected: meta.SHA256, Detected: time.Now().UTC()}
+	if err != nil {
+		corrupt.Error = err.Error()
+	} else {
+		corrupt.Actual = actual
+	}
+	log.Printf("Corrupted file %s in %s: expected sha256 %s, got %s%s",
+		filename, s.path, corrupt.Expected, corrupt.Actual, corrupt.Error)
+
+	if s.config.Scrub.Quarantine {
+		corrupt.QuarantineID = newID(corrupt.Detected)
+		if err := s.quarantine(filename, filePath, current.Size(), &corrupt); err != nil {
+			corrupt.QuarantineID = ""
+			report.Corrupted = append(report.Corrupted, corrupt)
+			return err
+		}
+	}
+	report.Corrupted = append(report.Corrupted, corrupt)
+	return nil
+}
+
+// quarantine moves a corrupted file and its metadata out of the storage,
+// keeping them for inspection. Must be called with the storage lock held.
+func (s *Storage) quarantine(filename, filePath string, size int64, corrupt *CorruptFile) error {
+	base := filepath.Join(s.quarantineDir, corrupt.QuarantineID)
+	if err := os.Rename(filePath, base+".data"); err != nil {
+		return err
+	}
+	s.fileReplaced(size, -1)
+	defer s.changed(filename)
+	if err := os.Rename(s.metaPath(filename), base+".meta"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	data, err := json.Marshal(corrupt)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(base+".json", data, s.tmpDir)
+}
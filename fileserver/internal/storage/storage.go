@@ -1,82 +1,420 @@
 package storage
 
 import (
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"yadro.com/course/internal/erasure"
+)
+
+// internalDir holds service data inside the storage root, it is never listed
+// and can not be used as a file name
+const internalDir = ".fileserver"
+
+var (
+	ErrExist       = fs.ErrExist
+	ErrNotExist    = fs.ErrNotExist
+	ErrInvalidName = errors.New("invalid file name")
+	ErrChanged     = errors.New("file changed meanwhile")
 )
 
 type Storage struct {
-	path string
+	path          string
+	tmpDir        string
+	metaDir       string
+	versionsDir   string
+	trashDir      string
+	quarantineDir string
+	config        *Config
+	keys          *keyRing
+	erasure       *erasure.Store
+	usage         usage
+	index         index
+	text          textIndex
+	journal       *journal
+	// bucket names the storage in events published through notify
+	bucket string
+	notify func(Event)
+
+	mu        sync.Mutex
+	scrubMu   sync.Mutex
+	lastScrub atomic.Pointer[ScrubReport]
+}
+
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	Meta
+	// storedSize is the size on disk, it tells files changed directly in the
+	// storage directory apart
+	storedSize int64
 }
 
 type fileErr struct {
 	filepath string
-	msg      string
+	err      error
 }
 
 func (e *fileErr) Error() string {
-	return fmt.Sprintf("Error with file: %s, reason: %s", e.filepath, e.msg)
+	return fmt.Sprintf("Error with file: %s, reason: %v", e.filepath, e.err)
 }
 
-func NewStorage(path string) (*Storage, error) {
-	if err := os.MkdirAll(path, 0750); err != nil {
+func (e *fileErr) Unwrap() error {
+	return e.err
+}
+
+func NewStorage(path string, config *Config) (*Storage, error) {
+	s := &Storage{
+		path:          path,
+		tmpDir:        filepath.Join(path, internalDir, "tmp"),
+		metaDir:       filepath.Join(path, internalDir, "meta"),
+		versionsDir:   filepath.Join(path, internalDir, "versions"),
+		trashDir:      filepath.Join(path, internalDir, "trash"),
+		quarantineDir: filepath.Join(path, internalDir, "quarantine"),
+		config:        config,
+	}
+
+	for _, dir := range []string{s.tmpDir, s.metaDir, s.versionsDir, s.trashDir, s.quarantineDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := loadKeyRing(&config.Encryption)
+	if err != nil {
 		return nil, err
 	}
+	s.keys = keys
 
-	return &Storage{
-		path: path,
-	}, nil
+	if ec := config.Erasure; len(ec.Dirs) > 0 {
+		s.erasure, err = erasure.NewStore(ec.Dirs, ec.DataShards, ec.ParityShards, ec.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	s.journal, err = openJournal(filepath.Join(path, internalDir, "journal"), config.Journal.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	// changes made while the server was not running are journaled like the
+	// ones the watcher finds
+	if changed, err := s.Reconcile(); err != nil {
+		return nil, err
+	} else if changed > 0 {
+		log.Printf("Reconciled %d files changed directly in %s", changed, s.path)
+	}
+	// reconciling accounted the changes against the persisted state, the
+	// usage is taken from the disk as it is now
+	if err := s.loadUsage(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
-func (s *Storage) Save(file *os.File, filename string) error {
-	filePath := filepath.Join(s.path, filename)
+func (s *Storage) filePath(filename string) (string, error) {
+	if !ValidName(filename) {
+		return "", &fileErr{filepath: filename, err: ErrInvalidName}
+	}
+	return filepath.Join(s.path, filename), nil
+}
 
-	if _, err := os.Stat(filePath); err == nil {
-		return &fileErr{filepath: filePath, msg: "file already exists"}
+// ValidName reports whether filename can be stored: it must be a single path
+// element and must not clash with the internal directory
+func ValidName(filename string) bool {
+	return filename != "" && filename != "." && filename != ".." &&
+		filename != internalDir && !strings.ContainsAny(filename, `/\`)
+}
+
+// exists reports whether the file is stored and not expired
+func (s *Storage) exists(filename, filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil && !s.expired(filename, time.Now())
+}
+
+func (s *Storage) Save(file io.Reader, filename string, meta *Meta) error {
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return err
 	}
 
-	return saveFile(file, filePath)
+	if s.exists(filename, filePath) {
+		return &fileErr{filepath: filePath, err: ErrExist}
+	}
+	// fail before the content is received when no more files fit
+	if err := s.checkFileCount(); err != nil {
+		return err
+	}
+
+	return s.saveFile(file, filePath, meta, func() error {
+		if s.exists(filename, filePath) {
+			return &fileErr{filepath: filePath, err: ErrExist}
+		}
+		return nil
+	})
+}
+
+// Get opens the content of the file, compressed files are decompressed while
+// being read
+func (s *Storage) Get(filename string) (io.ReadSeekCloser, error) {
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		return nil, err
+	}
+	if meta.expired(time.Now()) {
+		return nil, &fileErr{filepath: filePath, err: ErrNotExist}
+	}
+	return s.openContent(filePath, meta)
 }
 
-func (s *Storage) Get(filename string) (*os.File, error) {
-	filePath := filepath.Join(s.path, filename)
-	return os.Open(filePath)
+// Open opens the content of the file like Get and describes it like Stat, the
+// description matches the content even if the file is replaced meanwhile
+func (s *Storage) Open(filename string) (io.ReadSeekCloser, *FileInfo, error) {
+	return s.open(filename, false)
 }
 
-func (s *Storage) Update(file *os.File, filename string) error {
-	filePath := filepath.Join(s.path, filename)
-	if _, err := os.Stat(filePath); err != nil {
-		return &fileErr{filepath: filePath, msg: "file does not exist"}
+// OpenCompressed is Open for the gzip stream of a file stored compressed, so
+// it can be sent to clients as is. Other files fail with ErrNotCompressed.
+func (s *Storage) OpenCompressed(filename string) (io.ReadSeekCloser, *FileInfo, error) {
+	return s.open(filename, true)
+}
+
+func (s *Storage) open(filename string, compressed bool) (io.ReadSeekCloser, *FileInfo, error) {
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, &fileErr{filepath: filePath, err: ErrNotExist}
+	}
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.expired(time.Now()) {
+		return nil, nil, &fileErr{filepath: filePath, err: ErrNotExist}
+	}
+	var content io.ReadSeekCloser
+	switch {
+	case !compressed:
+		content, err = s.openContent(filePath, meta)
+	case meta.Compression != CompressionGzip:
+		err = &fileErr{filepath: filePath, err: ErrNotCompressed}
+	default:
+		content, err = s.openStored(filePath, meta)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, &FileInfo{Name: filename, Size: meta.size(info.Size()), ModTime: info.ModTime(),
+		Meta: meta.public(), storedSize: info.Size()}, nil
+}
+
+func (s *Storage) Update(file io.Reader, filename string, meta *Meta) error {
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return err
+	}
+	if !s.exists(filename, filePath) {
+		return &fileErr{filepath: filePath, err: ErrNotExist}
+	}
+
+	return s.saveFile(file, filePath, meta, func() error {
+		if !s.exists(filename, filePath) {
+			return &fileErr{filepath: filePath, err: ErrNotExist}
+		}
+		return nil
+	})
+}
+
+// Put creates the file or replaces its content if it already exists
+func (s *Storage) Put(file io.Reader, filename string, meta *Meta) error {
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return err
 	}
 
-	return saveFile(file, filePath)
+	return s.saveFile(file, filePath, meta, nil)
 }
 
 func (s *Storage) Delete(filename string) error {
-	filePath := filepath.Join(s.path, filename)
-	return os.Remove(filePath)
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.delete(filename, filePath)
+}
+
+// delete removes the file or moves it to the trash. Must be called with the
+// storage lock held.
+func (s *Storage) delete(filename, filePath string) error {
+	if s.expired(filename, time.Now()) {
+		return &fileErr{filepath: filePath, err: ErrNotExist}
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+
+	if s.config.Trash.Enabled {
+		err = s.moveToTrash(filename, filePath)
+	} else {
+		err = s.remove(filename, filePath)
+	}
+	if err != nil {
+		return err
+	}
+	s.fileReplaced(info.Size(), -1)
+	s.changed(filename)
+
+	if s.config.Versioning.Enabled {
+		return s.addDeleteMarker(filename)
+	}
+	return nil
+}
+
+// Evict removes a file this node no longer keeps, such as one handed over to
+// another node. Unlike Delete it is not an event for subscribers nor the
+// journal, the file is not moved to the trash and gets no delete marker. The
+// file is kept with ErrChanged when its SHA-256 is no longer checksum, an
+// empty checksum removes any content.
+func (s *Storage) Evict(filename, checksum string) error {
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if checksum != "" {
+		meta, err := s.readMeta(filename)
+		if err != nil {
+			return err
+		}
+		if meta.SHA256 != checksum {
+			return &fileErr{filepath: filePath, err: ErrChanged}
+		}
+	}
+
+	if err := s.remove(filename, filePath); err != nil {
+		return err
+	}
+	s.fileReplaced(info.Size(), -1)
+	s.reindex(filename)
+	return nil
+}
+
+func (s *Storage) Stat(filename string) (*FileInfo, error) {
+	filePath, err := s.filePath(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fileErr{filepath: filePath, err: ErrNotExist}
+	}
+
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		return nil, err
+	}
+	if meta.expired(time.Now()) {
+		return nil, &fileErr{filepath: filePath, err: ErrNotExist}
+	}
+
+	return &FileInfo{Name: filename, Size: meta.size(info.Size()), ModTime: info.ModTime(), Meta: meta.public(),
+		storedSize: info.Size()}, nil
+}
+
+// List returns information about all stored files sorted by name
+func (s *Storage) List() ([]FileInfo, error) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	res := make([]FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// file was removed after reading the directory
+			continue
+		}
+		meta, err := s.readMeta(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if meta.expired(now) {
+			continue
+		}
+		res = append(res, FileInfo{Name: e.Name(), Size: meta.size(info.Size()), ModTime: info.ModTime(), Meta: meta.public(),
+			storedSize: info.Size()})
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res, nil
 }
 
 func (s *Storage) GetFiles() ([]string, error) {
-	files, err := os.ReadDir(s.path)
+	files, err := s.List()
 	if err != nil {
 		return nil, err
 	}
 
 	res := make([]string, 0, len(files))
 	for _, f := range files {
-		if !f.IsDir() {
-			res = append(res, f.Name())
-		}
+		res = append(res, f.Name)
 	}
 
-	sort.Strings(res)
-
 	return res, nil
 }
 
@@ -88,20 +426,184 @@ func (s *Storage) GetFilesAsString() (string, error) {
 	return strings.Join(filesList, "\n"), nil
 }
 
-func closeFile(f *os.File) {
+// CreateTemp creates a temporary file next to the stored files, the caller
+// removes it
+func (s *Storage) CreateTemp(pattern string) (*os.File, error) {
+	return os.CreateTemp(s.tmpDir, pattern)
+}
+
+func closeFile(f io.Closer) {
 	if err := f.Close(); err != nil {
 		log.Fatal("Failed to close file")
 	}
 }
 
-// saveFile saves file with given name OR overrides it
-func saveFile(file *os.File, filePath string) error {
-	outFile, err := os.Create(filePath)
+// saveFile saves file with given name OR overrides it. The content is written
+// to a temporary file first, so a failed upload never leaves a partial file.
+// check is called under the storage lock right before the file is replaced.
+func (s *Storage) saveFile(file io.Reader, filePath string, meta *Meta, check func() error) error {
+	stored := Meta{}
+	if meta != nil {
+		stored = *meta
+	}
+	metadata, err := normalizeMetadata(stored.Metadata)
+	if err != nil {
+		return err
+	}
+	stored.Metadata = metadata
+
+	quota := s.newQuotaWriter(filePath)
+	defer quota.release()
+	tmpName, size, sum, err := s.writeTemp(file, filepath.Base(filePath), &stored, quota)
 	if err != nil {
 		return err
 	}
-	defer closeFile(outFile)
+	defer removeIfExists(tmpName)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	_, err = io.Copy(outFile, file)
+	err = s.commit(tmpName, filePath, size, sum, &stored, check)
+	if err != nil && fileExists(tmpName) {
+		s.removeShards(&stored)
+	}
 	return err
 }
+
+// writeTemp stores the upload in a temporary file compressing and encrypting
+// it as configured, meta records how the content is stored. With erasure
+// coding the content goes to shards and the temporary file only takes its
+// size. It returns the file name, the number of bytes written to disk and the
+// SHA-256 of the content. The bytes reserved by quota stay reserved until the
+// caller releases them.
+func (s *Storage) writeTemp(file io.Reader, filename string, meta *Meta, quota *quotaWriter) (string, int64, string, error) {
+	tmpFile, err := os.CreateTemp(s.tmpDir, "upload-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+	var shards *erasure.Writer
+	fail := func(err error) (string, int64, string, error) {
+		closeFile(tmpFile)
+		removeIfExists(tmpFile.Name())
+		if shards != nil {
+			shards.Abort()
+		}
+		return "", 0, "", err
+	}
+
+	hash := sha256.New()
+	out := io.MultiWriter(quota, tmpFile)
+	meta.Erasure = nil
+	if s.erasure != nil {
+		if shards, err = s.erasure.Create(); err != nil {
+			return fail(err)
+		}
+		out = io.MultiWriter(quota, shards)
+	}
+	// writers are closed innermost first to flush their trailers
+	var writers []io.WriteCloser
+
+	meta.Encryption = nil
+	if s.keys != nil {
+		w, enc, err := s.keys.encrypt(out)
+		if err != nil {
+			return fail(err)
+		}
+		out, meta.Encryption = w, enc
+		writers = append(writers, w)
+	}
+	compress := s.compress(filename, meta)
+	meta.Compression = ""
+	if compress {
+		w := gzip.NewWriter(out)
+		out, meta.Compression = w, CompressionGzip
+		writers = append(writers, w)
+	}
+
+	md5Hash := md5.New()
+	length, err := io.Copy(io.MultiWriter(out, hash, md5Hash), file)
+	for i := len(writers) - 1; i >= 0 && err == nil; i-- {
+		err = writers[i].Close()
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if shards != nil {
+		if meta.Erasure, err = shards.Close(); err != nil {
+			shards = nil
+			return fail(err)
+		}
+		// sparse, it keeps the quota and the listings right
+		if err := tmpFile.Truncate(quota.written); err != nil {
+			s.removeShards(meta)
+			return fail(err)
+		}
+	}
+	if err := tmpFile.Close(); err != nil {
+		s.removeShards(meta)
+		return fail(err)
+	}
+
+	meta.ContentLength = 0
+	if meta.encoded() {
+		meta.ContentLength = length
+	}
+	meta.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	meta.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	return tmpFile.Name(), quota.written, meta.SHA256, nil
+}
+
+// commit moves src in place of filePath and replaces the file metadata. Must
+// be called with the storage lock held.
+func (s *Storage) commit(src, filePath string, size int64, sum string, meta *Meta, check func() error) error {
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	oldSize := int64(-1)
+	if info, err := os.Stat(filePath); err == nil {
+		oldSize = info.Size()
+	}
+	if err := s.checkReplace(oldSize, size); err != nil {
+		return err
+	}
+
+	filename := filepath.Base(filePath)
+	old, err := s.readMeta(filename)
+	if err != nil {
+		return err
+	}
+	if s.config.Versioning.Enabled {
+		// files stored before versioning was enabled get their current content
+		// recorded as the first version
+		if err := s.snapshotUnversioned(filename, filePath); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(src, filePath); err != nil {
+		return err
+	}
+	if oldSize >= 0 {
+		s.dropShards(filename, old)
+	}
+	s.fileReplaced(oldSize, size)
+	err = s.writeMeta(filename, meta)
+	s.changed(filename)
+	if err != nil {
+		return err
+	}
+
+	if s.config.Versioning.Enabled {
+		return s.addVersion(filename, filePath, meta.size(size), sum, meta)
+	}
+	return nil
+}
+
+func removeIfExists(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to remove %s: %v", path, err)
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestEvict(t *testing.T) {
+	b, s := newTestBuckets(t, func(c *Config) {
+		c.Versioning.Enabled = true
+	})
+	var events []Event
+	b.Subscribe(func(e Event) { events = append(events, e) })
+
+	save(t, s, "kept.txt", []byte("kept"))
+	save(t, s, "evicted.txt", []byte("evicted"))
+	info, err := s.Stat("kept.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := s.Usage()
+	events = nil
+
+	if err := s.Evict("kept.txt", "0000"); !errors.Is(err, ErrChanged) {
+		t.Fatalf("expected ErrChanged, got %v", err)
+	}
+	if err := s.Evict("kept.txt", info.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Evict("evicted.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Evict("evicted.txt", ""); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	if len(events) > 0 {
+		t.Fatalf("evicting published %v", events)
+	}
+	if files, err := s.List(); err != nil || len(files) > 0 {
+		t.Fatalf("files left %v: %v", files, err)
+	}
+	if trash, err := s.Trash(); err != nil || len(trash) > 0 {
+		t.Fatalf("evicted files trashed %v: %v", trash, err)
+	}
+	versions, err := s.Versions("kept.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versions {
+		if v.DeleteMarker {
+			t.Fatal("evicting added a delete marker")
+		}
+	}
+	if usage := s.Usage(); usage.Files != before.Files-2 || usage.Bytes != before.Bytes-int64(len("keptevicted")) {
+		t.Fatalf("usage %+v after evicting from %+v", usage, before)
+	}
+}
+
+func TestOpenCompressed(t *testing.T) {
+	_, s := newTestBuckets(t, func(c *Config) {
+		c.Compression.Patterns = []string{"*.log"}
+	})
+	data := bytes.Repeat([]byte("compressed line\n"), 100)
+	save(t, s, "a.log", data)
+	save(t, s, "a.txt", data)
+
+	file, info, err := s.OpenCompressed("a.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(got, data) || info.Size != int64(len(data)) || info.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("described as %+v", info)
+	}
+
+	if _, _, err := s.OpenCompressed("a.txt"); !errors.Is(err, ErrNotCompressed) {
+		t.Fatalf("expected ErrNotCompressed, got %v", err)
+	}
+	if _, _, err := s.OpenCompressed("b.log"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ConflictFail      = "fail"
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+	ConflictSkip      = "skip"
+)
+
+var (
+	ErrTrashEntryNotFound = errors.New("trash entry not found")
+	ErrInvalidConflict    = errors.New("invalid conflict policy")
+)
+
+// TrashEntry describes a deleted file. Its content is kept in
+// .fileserver/trash/<id>.data next to the <id>.json record and the file
+// metadata in <id>.meta until it is restored, deleted permanently or purged
+// after the retention period.
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+func (s *Storage) trashData(id string) string {
+	return filepath.Join(s.trashDir, id+".data")
+}
+
+func (s *Storage) trashRecord(id string) string {
+	return filepath.Join(s.trashDir, id+".json")
+}
+
+func (s *Storage) trashMeta(id string) string {
+	return filepath.Join(s.trashDir, id+".meta")
+}
+
+// moveToTrash moves the file into the trash. Must be called with the storage
+// lock held.
+func (s *Storage) moveToTrash(filename, filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := TrashEntry{ID: newID(now), Name: filename, Size: meta.size(info.Size()), DeletedAt: now}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(filePath, s.trashData(entry.ID)); err != nil {
+		return err
+	}
+	if err := os.Rename(s.metaPath(filename), s.trashMeta(entry.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return writeFileAtomic(s.trashRecord(entry.ID), data, s.tmpDir)
+}
+
+// Trash returns deleted files, most recently deleted first
+func (s *Storage) Trash() ([]TrashEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.trashEntries()
+}
+
+func (s *Storage) trashEntries() ([]TrashEntry, error) {
+	files, err := os.ReadDir(s.trashDir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]TrashEntry, 0, len(files)/2)
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+		entry, err := s.trashEntry(id)
+		if err != nil {
+			log.Printf("Skipping broken trash entry %s: %v", id, err)
+			continue
+		}
+		res = append(res, *entry)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID > res[j].ID })
+	return res, nil
+}
+
+func (s *Storage) trashEntry(id string) (*TrashEntry, error) {
+	if !ValidName(id) {
+		return nil, &fileErr{filepath: id, err: ErrTrashEntryNotFound}
+	}
+
+	data, err := os.ReadFile(s.trashRecord(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &fileErr{filepath: id, err: ErrTrashEntryNotFound}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// RestoreFromTrash puts a deleted file back and returns the name it was
+// restored under. When a file with the original name exists the conflict
+// policy decides whether to fail, overwrite it or pick a free name.
+func (s *Storage) RestoreFromTrash(id, conflict string) (string, error) {
+	if conflict == "" {
+		conflict = ConflictFail
+	}
+	if conflict != ConflictFail && conflict != ConflictOverwrite && conflict != ConflictRename {
+		return "", &fileErr{filepath: id, err: ErrInvalidConflict}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.trashEntry(id)
+	if err != nil {
+		return "", err
+	}
+
+	name := entry.Name
+	if _, err := os.Stat(filepath.Join(s.path, name)); err == nil {
+		switch conflict {
+		case ConflictFail:
+			return "", &fileErr{filepath: name, err: ErrExist}
+		case ConflictRename:
+			name = s.freeName(name)
+		}
+	}
+
+	meta, err := readMetaFile(s.trashMeta(id))
+	if err != nil {
+		return "", err
+	}
+	if meta.expired(time.Now()) {
+		// restoring is an explicit request to get the file back
+		meta.ExpiresAt = nil
+	}
+
+	info, err := os.Stat(s.trashData(id))
+	if err != nil {
+		return "", err
+	}
+	sum := ""
+	if s.config.Versioning.Enabled {
+		if sum, err = s.contentSHA256(s.trashData(id), meta); err != nil {
+			return "", err
+		}
+	}
+	if err := s.commit(s.trashData(id), filepath.Join(s.path, name), info.Size(), sum, meta, nil); err != nil {
+		return "", err
+	}
+
+	s.removeTrashEntry(id)
+	return name, nil
+}
+
+// freeName returns "name (N).ext" with the smallest N that is not taken
+func (s *Storage) freeName(name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := os.Stat(filepath.Join(s.path, candidate)); errors.Is(err, fs.ErrNotExist) {
+			return candidate
+		}
+	}
+}
+
+// DeleteFromTrash removes a trashed file permanently
+func (s *Storage) DeleteFromTrash(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.trashEntry(id)
+	if err != nil {
+		return err
+	}
+	s.purgeTrashEntry(entry)
+	return nil
+}
+
+// EmptyTrash permanently removes every trashed file deleted before the given
+// time and returns how many were removed
+func (s *Storage) EmptyTrash(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.trashEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.DeletedAt.Before(before) {
+			s.purgeTrashEntry(&entry)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// purgeTrashEntry removes a trashed file for good, shards included
+func (s *Storage) purgeTrashEntry(entry *TrashEntry) {
+	if meta, err := readMetaFile(s.trashMeta(entry.ID)); err == nil {
+		s.dropShards(entry.Name, meta)
+	}
+	s.removeTrashEntry(entry.ID)
+}
+
+func (s *Storage) removeTrashEntry(id string) {
+	removeIfExists(s.trashData(id))
+	removeIfExists(s.trashMeta(id))
+	removeIfExists(s.trashRecord(id))
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"yadro.com/course/internal/erasure"
+)
+
+const manifestName = "versions.json"
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// Version is an immutable revision of a file. Versions are kept under
+// .fileserver/versions/<filename>/ as hard links to the content that was
+// current at the time, together with a JSON manifest ordered oldest first.
+type Version struct {
+	ID           string            `json:"id"`
+	Size         int64             `json:"size"`
+	SHA256       string            `json:"sha256,omitempty"`
+	Created      time.Time         `json:"created"`
+	DeleteMarker bool              `json:"delete_marker,omitempty"`
+	ContentType  string            `json:"content_type,omitempty"`
+	Compression  string            `json:"compression,omitempty"`
+	Encryption   *Encryption       `json:"encryption,omitempty"`
+	Erasure      *erasure.Manifest `json:"erasure,omitempty"`
+}
+
+// newID returns a unique identifier that sorts by creation time
+func newID(t time.Time) string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", t.UnixNano())
+	}
+	return fmt.Sprintf("%016x%s", t.UnixNano(), hex.EncodeToString(b))
+}
+
+func (s *Storage) versionDir(filename string) string {
+	return filepath.Join(s.versionsDir, filename)
+}
+
+func (s *Storage) readManifest(filename string) ([]Version, error) {
+	data, err := os.ReadFile(filepath.Join(s.versionDir(filename), manifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (s *Storage) writeManifest(filename string, versions []Version) error {
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.versionDir(filename), manifestName), data, s.tmpDir)
+}
+
+// addVersion records the current content of filePath as the newest version
+// and drops the oldest ones above the configured limit. Must be called with
+// the storage lock held.
+func (s *Storage) addVersion(filename, filePath string, size int64, sum string, meta *Meta) error {
+	versions, err := s.readManifest(filename)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	v := Version{
+		ID:          newID(now),
+		Size:        size,
+		SHA256:      sum,
+		Created:     now,
+		ContentType: meta.ContentType,
+		Compression: meta.Compression,
+		Encryption:  meta.Encryption,
+		Erasure:     meta.Erasure,
+	}
+	if err := os.MkdirAll(s.versionDir(filename), 0750); err != nil {
+		return err
+	}
+	if err := linkOrCopy(filePath, filepath.Join(s.versionDir(filename), v.ID)); err != nil {
+		return err
+	}
+
+	return s.writeVersions(filename, append(versions, v))
+}
+
+// addDeleteMarker records that the file was deleted. Must be called with the
+// storage lock held.
+func (s *Storage) addDeleteMarker(filename string) error {
+	versions, err := s.readManifest(filename)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := os.MkdirAll(s.versionDir(filename), 0750); err != nil {
+		return err
+	}
+	return s.writeVersions(filename, append(versions, Version{ID: newID(now), Created: now, DeleteMarker: true}))
+}
+
+// snapshotUnversioned records the existing content of a file that has no
+// version history yet. Must be called with the storage lock held.
+func (s *Storage) snapshotUnversioned(filename, filePath string) error {
+	info, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.readManifest(filename)
+	if err != nil || len(versions) > 0 {
+		return err
+	}
+
+	meta, err := s.readMeta(filename)
+	if err != nil {
+		return err
+	}
+	sum, err := s.contentSHA256(filePath, meta)
+	if err != nil {
+		return err
+	}
+
+	v := Version{
+		ID:          newID(info.ModTime()),
+		Size:        meta.size(info.Size()),
+		SHA256:      sum,
+		Created:     info.ModTime(),
+		ContentType: meta.ContentType,
+		Compression: meta.Compression,
+		Encryption:  meta.Encryption,
+		Erasure:     meta.Erasure,
+	}
+	if err := os.MkdirAll(s.versionDir(filename), 0750); err != nil {
+		return err
+	}
+	if err := linkOrCopy(filePath, filepath.Join(s.versionDir(filename), v.ID)); err != nil {
+		return err
+	}
+	return s.writeManifest(filename, []Version{v})
+}
+
+// writeVersions saves the manifest keeping at most MaxVersions entries
+func (s *Storage) writeVersions(filename string, versions []Version) error {
+	if limit := s.config.Versioning.MaxVersions; limit > 0 && len(versions) > limit {
+		for _, v := range versions[:len(versions)-limit] {
+			if !v.DeleteMarker {
+				removeIfExists(filepath.Join(s.versionDir(filename), v.ID))
+			}
+		}
+		versions = versions[len(versions)-limit:]
+	}
+	return s.writeManifest(filename, versions)
+}
+
+// Versions returns the history of the file, newest first
+func (s *Storage) Versions(filename string) ([]Version, error) {
+	if _, err := s.filePath(filename); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	versions, err := s.readManifest(filename)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, &fileErr{filepath: filename, err: ErrNotExist}
+	}
+
+	res := make([]Version, len(versions))
+	for i, v := range versions {
+		v.Encryption = v.Encryption.public()
+		res[len(versions)-1-i] = v
+	}
+	return res, nil
+}
+
+func (s *Storage) GetVersion(filename, versionID string) (io.ReadSeekCloser, error) {
+	if _, err := s.filePath(filename); err != nil {
+		return nil, err
+	}
+
+	file, _, err := s.openVersion(filename, versionID)
+	return file, err
+}
+
+// openVersion opens the content of a version together with its description
+func (s *Storage) openVersion(filename, versionID string) (io.ReadSeekCloser, *Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.findVersion(filename, versionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := s.openContent(filepath.Join(s.versionDir(filename), v.ID), v.meta())
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, v, nil
+}
+
+func (s *Storage) findVersion(filename, versionID string) (*Version, error) {
+	versions, err := s.readManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		if versions[i].ID == versionID && !versions[i].DeleteMarker {
+			return &versions[i], nil
+		}
+	}
+	return nil, &fileErr{filepath: filename, err: ErrVersionNotFound}
+}
+
+// Restore makes the content of an old version current again. The restored
+// content becomes a new version, the history itself is never rewritten.
+func (s *Storage) Restore(filename, versionID string) error {
+	if _, err := s.filePath(filename); err != nil {
+		return err
+	}
+	file, v, err := s.openVersion(filename, versionID)
+	if err != nil {
+		return err
+	}
+	defer closeFile(file)
+
+	// client metadata and the expiry are not versioned, the current ones are
+	// kept
+	current, err := s.readMeta(filename)
+	if err != nil {
+		return err
+	}
+	if current.expired(time.Now()) {
+		current.ExpiresAt = nil
+	}
+	content, contentType := io.Reader(file), v.ContentType
+	if contentType == "" {
+		// versions recorded before their content types were
+		content, contentType = DetectContentType(file, filename, "")
+	}
+	return s.Put(content, filename, &Meta{ContentType: contentType, ExpiresAt: current.ExpiresAt,
+		Metadata: current.Metadata})
+}
+
+// meta describes how the version is stored
+func (v *Version) meta() *Meta {
+	return &Meta{SHA256: v.SHA256, Compression: v.Compression, ContentLength: v.Size, Encryption: v.Encryption,
+		Erasure: v.Erasure}
+}
+
+// contentSHA256 hashes the content of a stored file
+func (s *Storage) contentSHA256(path string, meta *Meta) (string, error) {
+	f, err := s.openContent(path, meta)
+	if err != nil {
+		return "", err
+	}
+	defer closeFile(f)
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// linkOrCopy hard links src to dst falling back to a copy when the file
+// system does not support links
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer closeFile(in)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		closeFile(out)
+		return err
+	}
+	return out.Close()
+}
+
+// writeFileAtomic replaces path with data so readers never see a partially
+// written file
+func writeFileAtomic(path string, data []byte, tmpDir string) error {
+	tmpFile, err := os.CreateTemp(tmpDir, "meta-*")
+	if err != nil {
+		return err
+	}
+	defer removeIfExists(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		closeFile(tmpFile)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreKeepsContentType(t *testing.T) {
+	_, s := newTestBuckets(t, func(c *Config) {
+		c.Versioning.Enabled = true
+	})
+	err := s.Save(strings.NewReader("<p>first</p>"), "a.dat", &Meta{ContentType: "application/x-first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	err = s.Update(strings.NewReader("second"), "a.dat", &Meta{ContentType: "text/plain", ExpiresAt: &expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := s.Versions("a.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := versions[len(versions)-1]
+	if first.ContentType != "application/x-first" {
+		t.Fatalf("version recorded as %+v", first)
+	}
+	if err := s.Restore("a.dat", first.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat("a.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := content(t, s, "a.dat"); string(got) != "<p>first</p>" {
+		t.Fatalf("restored %q", got)
+	}
+	if info.ContentType != "application/x-first" || info.ExpiresAt == nil || !info.ExpiresAt.Equal(expires) {
+		t.Fatalf("restored as %+v", info.Meta)
+	}
+}
@@ -0,0 +1,145 @@
+//go:build linux
+
+package storage
+
+import (
+	"io"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_MOVED_TO |
+		syscall.IN_MOVED_FROM | syscall.IN_DELETE
+	// watchDelay gathers the events of a burst of writes into one check
+	watchDelay = 200 * time.Millisecond
+)
+
+type watchEvent struct {
+	wd   int32
+	mask uint32
+	name string
+}
+
+// watchNotify reconciles the files inotify reports as changed in the bucket
+// directories. Buckets created later are picked up every poll interval. It
+// only returns when inotify fails.
+func (b *Buckets) watchNotify() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	events := make(chan watchEvent, 1024)
+	errs := make(chan error, 1)
+	go readInotify(fd, events, errs)
+
+	watches := map[int32]*Storage{}
+	watched := map[*Storage]bool{}
+	watchNew := func() error {
+		for _, s := range b.Storages() {
+			if watched[s] {
+				continue
+			}
+			wd, err := syscall.InotifyAddWatch(fd, s.path, watchMask)
+			if err != nil {
+				return &fileErr{filepath: s.path, err: err}
+			}
+			watches[int32(wd)], watched[s] = s, true
+			// changes made while nobody was watching
+			reconcile(s)
+		}
+		return nil
+	}
+	if err := watchNew(); err != nil {
+		return err
+	}
+
+	interval := b.config.Watch.PollInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := map[*Storage]map[string]struct{}{}
+	full := map[*Storage]bool{}
+	var flush <-chan time.Time
+	for {
+		select {
+		case e := <-events:
+			switch s, ok := watches[e.wd]; {
+			case e.mask&syscall.IN_Q_OVERFLOW != 0:
+				// events were lost, check everything
+				for _, s := range watches {
+					full[s] = true
+				}
+			case e.mask&syscall.IN_IGNORED != 0:
+				// the bucket was deleted
+				delete(watches, e.wd)
+				delete(watched, s)
+				continue
+			case ok && e.name != "":
+				if pending[s] == nil {
+					pending[s] = map[string]struct{}{}
+				}
+				pending[s][e.name] = struct{}{}
+			}
+			if flush == nil {
+				flush = time.After(watchDelay)
+			}
+		case <-flush:
+			for s := range full {
+				reconcile(s)
+			}
+			for s, names := range pending {
+				if full[s] {
+					continue
+				}
+				for name := range names {
+					if _, err := s.reconcileFile(name); err != nil {
+						log.Printf("Failed to reconcile %s in %s: %v", name, s.path, err)
+					}
+				}
+			}
+			clear(full)
+			clear(pending)
+			flush = nil
+		case <-ticker.C:
+			if err := watchNew(); err != nil {
+				return err
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func readInotify(fd int, events chan<- watchEvent, errs chan<- error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == nil && n <= 0 {
+			err = io.EOF
+		}
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+int(raw.Len)]), "\x00")
+			events <- watchEvent{wd: raw.Wd, mask: raw.Mask, name: name}
+			offset = start + int(raw.Len)
+		}
+	}
+}
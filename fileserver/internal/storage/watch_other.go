@@ -0,0 +1,9 @@
+//go:build !linux
+
+package storage
+
+import "errors"
+
+func (b *Buckets) watchNotify() error {
+	return errors.New("inotify is only available on Linux")
+}
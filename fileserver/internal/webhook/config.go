@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"fmt"
+	"time"
+)
+
+// Hook receives the events of files matching one of Patterns, all files when
+// there are none. Events lists the event types to send, all by default.
+type Hook struct {
+	URL      string   `yaml:"url"`
+	Secret   string   `yaml:"secret"`
+	Events   []string `yaml:"events"`
+	Patterns []string `yaml:"patterns"`
+}
+
+type Config struct {
+	Hooks []Hook `yaml:"hooks"`
+	// failed deliveries are retried after InitialBackoff doubling up to
+	// MaxBackoff, a delivery is dropped after MaxAttempts
+	MaxAttempts    int           `yaml:"max_attempts" env:"FILESERVER_WEBHOOKS_MAX_ATTEMPTS" default:"10"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" env:"FILESERVER_WEBHOOKS_INITIAL_BACKOFF" default:"1s"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" env:"FILESERVER_WEBHOOKS_MAX_BACKOFF" default:"1h"`
+	Timeout        time.Duration `yaml:"timeout" env:"FILESERVER_WEBHOOKS_TIMEOUT" default:"10s"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Hour,
+		Timeout:        10 * time.Second,
+	}
+}
+
+// String hides hook secrets from logged configuration
+func (c Config) String() string {
+	return fmt.Sprintf("{Hooks:%d MaxAttempts:%d InitialBackoff:%s MaxBackoff:%s Timeout:%s}",
+		len(c.Hooks), c.MaxAttempts, c.InitialBackoff, c.MaxBackoff, c.Timeout)
+}
@@ -0,0 +1,327 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"yadro.com/course/internal/storage"
+)
+
+const (
+	signatureHeader = "X-Fileserver-Signature"
+	eventHeader     = "X-Fileserver-Event"
+	deliveryHeader  = "X-Fileserver-Delivery"
+)
+
+// delivery is an event waiting to be sent to a hook, it is kept in
+// <dir>/<id>.json until the hook accepts it or it runs out of attempts
+type delivery struct {
+	ID          string        `json:"id"`
+	URL         string        `json:"url"`
+	Event       storage.Event `json:"event"`
+	Attempts    int           `json:"attempts"`
+	NextAttempt time.Time     `json:"next_attempt"`
+}
+
+// Dispatcher sends file events to the configured hooks. Events are persisted
+// before they are sent, so deliveries pending at shutdown are retried after
+// a restart.
+type Dispatcher struct {
+	config *Config
+	dir    string
+	client *http.Client
+	queues []*queue
+	seq    atomic.Uint64
+}
+
+// queue delivers the events of one hook in order, a failing delivery holds
+// back the ones after it
+type queue struct {
+	hook    *Hook
+	mu      sync.Mutex
+	pending []*delivery
+	wake    chan struct{}
+}
+
+func NewDispatcher(config *Config, dir string) (*Dispatcher, error) {
+	d := &Dispatcher{
+		config: config,
+		dir:    dir,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+
+	for i := range config.Hooks {
+		hook := &config.Hooks[i]
+		if err := hook.validate(); err != nil {
+			return nil, err
+		}
+		d.queues = append(d.queues, &queue{hook: hook, wake: make(chan struct{}, 1)})
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (h *Hook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url %q must be an absolute http(s) url", h.URL)
+	}
+	for _, e := range h.Events {
+		switch storage.EventType(e) {
+		case storage.EventCreated, storage.EventUpdated, storage.EventDeleted:
+		default:
+			return fmt.Errorf("webhook %s: unknown event %q", h.URL, e)
+		}
+	}
+	for _, pattern := range h.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("webhook %s: invalid pattern %q", h.URL, pattern)
+		}
+	}
+	return nil
+}
+
+func (h *Hook) matches(e storage.Event) bool {
+	if len(h.Events) > 0 && !slices.Contains(h.Events, string(e.Type)) {
+		return false
+	}
+	if len(h.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range h.Patterns {
+		if ok, _ := path.Match(pattern, e.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// load queues the deliveries left from the previous run, deliveries of hooks
+// that are no longer configured are dropped
+func (d *Dispatcher) load() error {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		p := filepath.Join(d.dir, e.Name())
+		if !strings.HasSuffix(e.Name(), ".json") {
+			// an interrupted write
+			removeFile(p)
+			continue
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var dl delivery
+		if err := json.Unmarshal(data, &dl); err != nil {
+			log.Printf("Dropping unreadable webhook delivery %s: %v", p, err)
+			removeFile(p)
+			continue
+		}
+
+		i := slices.IndexFunc(d.queues, func(q *queue) bool { return q.hook.URL == dl.URL })
+		if i < 0 {
+			log.Printf("Dropping webhook delivery %s to %s which is no longer configured", dl.ID, dl.URL)
+			removeFile(p)
+			continue
+		}
+		d.queues[i].pending = append(d.queues[i].pending, &dl)
+	}
+
+	for _, q := range d.queues {
+		sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].ID < q.pending[j].ID })
+	}
+	return nil
+}
+
+// Notify queues the event for every hook interested in it
+func (d *Dispatcher) Notify(e storage.Event) {
+	for _, q := range d.queues {
+		if !q.hook.matches(e) {
+			continue
+		}
+		dl := &delivery{
+			// ids sort in the order of the events
+			ID:          fmt.Sprintf("%020d-%06d", e.Time.UnixNano(), d.seq.Add(1)%1000000),
+			URL:         q.hook.URL,
+			Event:       e,
+			NextAttempt: e.Time,
+		}
+		if err := d.save(dl); err != nil {
+			log.Printf("Failed to persist webhook delivery %s: %v", dl.ID, err)
+		}
+		q.push(dl)
+	}
+}
+
+// Start sends queued events in the background
+func (d *Dispatcher) Start() {
+	for _, q := range d.queues {
+		go d.run(q)
+	}
+}
+
+func (d *Dispatcher) run(q *queue) {
+	for {
+		dl := q.next()
+		if wait := time.Until(dl.NextAttempt); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		err := d.send(q.hook, dl)
+		if err == nil {
+			q.pop()
+			d.remove(dl)
+			continue
+		}
+
+		dl.Attempts++
+		if dl.Attempts >= d.config.MaxAttempts {
+			log.Printf("Dropping webhook delivery %s to %s after %d attempts: %v", dl.ID, dl.URL, dl.Attempts, err)
+			q.pop()
+			d.remove(dl)
+			continue
+		}
+		dl.NextAttempt = time.Now().Add(d.backoff(dl.Attempts))
+		log.Printf("Webhook delivery %s to %s failed, retrying at %s: %v",
+			dl.ID, dl.URL, dl.NextAttempt.Format(time.RFC3339), err)
+		if err := d.save(dl); err != nil {
+			log.Printf("Failed to persist webhook delivery %s: %v", dl.ID, err)
+		}
+	}
+}
+
+// backoff doubles the delay with every failed attempt
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.config.InitialBackoff
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := 1; i < attempts && delay < d.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if d.config.MaxBackoff > 0 {
+		delay = min(delay, d.config.MaxBackoff)
+	}
+	return delay
+}
+
+// send posts the event as JSON. With a secret the body is signed with
+// HMAC-SHA256 in the X-Fileserver-Signature header as sha256=<hex>.
+func (d *Dispatcher) send(hook *Hook, dl *delivery) error {
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventHeader, string(dl.Event.Type))
+	req.Header.Set(deliveryHeader, dl.ID)
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *Dispatcher) path(dl *delivery) string {
+	return filepath.Join(d.dir, dl.ID+".json")
+}
+
+// save writes the delivery to a temporary file first so a crash never leaves
+// a partial one
+func (d *Dispatcher) save(dl *delivery) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	tmp := d.path(dl) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path(dl))
+}
+
+func (d *Dispatcher) remove(dl *delivery) {
+	removeFile(d.path(dl))
+}
+
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to remove %s: %v", path, err)
+	}
+}
+
+func (q *queue) push(dl *delivery) {
+	q.mu.Lock()
+	q.pending = append(q.pending, dl)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for a pending delivery and returns it without removing it
+func (q *queue) next() *delivery {
+	for {
+		q.mu.Lock()
+		if len(q.pending) > 0 {
+			dl := q.pending[0]
+			q.mu.Unlock()
+			return dl
+		}
+		q.mu.Unlock()
+		<-q.wake
+	}
+}
+
+func (q *queue) pop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+}
@@ -1,10 +1,23 @@
 package hello_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -151,6 +164,30 @@ func TestFsRead(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestFsReadContentType(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	readUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name)
+	require.NoError(t, err)
+	response, err := fileClient.Head(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.True(t, strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain"))
+	require.True(t, strings.HasPrefix(response.Header.Get("Content-Disposition"), "inline"))
+
+	response, err = fileClient.Head(readUrl + "?download=1")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.True(t, strings.HasPrefix(response.Header.Get("Content-Disposition"), "attachment"))
+
+	err = deleteFiles()
+	require.NoError(t, err)
+}
+
 func TestFsReadNotExists(t *testing.T) {
 	defer deleteFiles()
 	err := createFiles()
@@ -195,6 +232,26 @@ func TestFsCreateAlreadyExists(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestFsCreateTooManyFields(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for i := 0; i < 200; i++ {
+		require.NoError(t, writer.WriteField("note", "repeated"))
+	}
+	part, err := writer.CreateFormFile("file", "fields.txt")
+	require.NoError(t, err)
+	_, err = part.Write([]byte("content"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	response, err := fileClient.Post(createUrl, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
+
 func TestFsUpdate(t *testing.T) {
 	defer deleteFiles()
 	err := createFiles()
@@ -262,3 +319,1301 @@ func TestFsUpdateNotExists(t *testing.T) {
 	err = deleteFiles()
 	require.NoError(t, err)
 }
+
+func TestFsUpdateNameMismatch(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", files[1].name)
+	require.NoError(t, err)
+	_, err = part.Write(files[0].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	updateUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name)
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodPut, updateUrl, body)
+	require.NoError(t, err)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	response, err := fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	readUrl, err := url.JoinPath(fileserverAddress, "files", files[1].name)
+	require.NoError(t, err)
+	response, err = fileClient.Get(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, files[1].content, data)
+
+	err = deleteFiles()
+	require.NoError(t, err)
+}
+
+func TestFsExpiry(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	err := writer.WriteField("expires_after", "1s")
+	require.NoError(t, err)
+	part, err := writer.CreateFormFile("file", "scratch.txt")
+	require.NoError(t, err)
+	_, err = part.Write(files[0].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodPost, createUrl, body)
+	require.NoError(t, err)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	response, err := fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	readUrl, err := url.JoinPath(fileserverAddress, "files", "scratch.txt")
+	require.NoError(t, err)
+	response, err = fileClient.Get(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	response, err = fileClient.Get(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestFsBuckets(t *testing.T) {
+	bucketsUrl, err := url.JoinPath(fileserverAddress, "buckets")
+	require.NoError(t, err)
+	response, err := fileClient.Post(bucketsUrl, "application/json", strings.NewReader(`{"name":"test-bucket"}`))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", files[0].name)
+	require.NoError(t, err)
+	_, err = part.Write(files[0].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	createUrl, err := url.JoinPath(bucketsUrl, "test-bucket", "files")
+	require.NoError(t, err)
+	response, err = fileClient.Post(createUrl, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	readUrl, err := url.JoinPath(createUrl, files[0].name)
+	require.NoError(t, err)
+	response, err = fileClient.Get(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	defaultUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name)
+	require.NoError(t, err)
+	response, err = fileClient.Get(defaultUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	deleteUrl, err := url.JoinPath(bucketsUrl, "test-bucket")
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodDelete, deleteUrl, nil)
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusConflict, response.StatusCode)
+
+	request, err = http.NewRequest(http.MethodDelete, deleteUrl+"?force=true", nil)
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestFsCompression(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	err := writer.WriteField("compression", "gzip")
+	require.NoError(t, err)
+	part, err := writer.CreateFormFile("file", "compressed.txt")
+	require.NoError(t, err)
+	_, err = part.Write(files[1].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	response, err := fileClient.Post(createUrl, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	readUrl, err := url.JoinPath(fileserverAddress, "files", "compressed.txt")
+	require.NoError(t, err)
+
+	// the client asks for gzip and decompresses the response itself
+	response, err = fileClient.Get(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.True(t, response.Uncompressed)
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, files[1].content, data)
+
+	request, err := http.NewRequest(http.MethodGet, readUrl, nil)
+	require.NoError(t, err)
+	request.Header.Set("Accept-Encoding", "identity")
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Empty(t, response.Header.Get("Content-Encoding"))
+	data, err = io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, files[1].content, data)
+
+	request, err = http.NewRequest(http.MethodDelete, readUrl, nil)
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestFsDigest(t *testing.T) {
+	upload := func(digest string) *http.Response {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", files[0].name)
+		require.NoError(t, err)
+		_, err = part.Write(files[0].content)
+		require.NoError(t, err)
+		err = writer.Close()
+		require.NoError(t, err)
+
+		createUrl, err := url.JoinPath(fileserverAddress, "files")
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodPost, createUrl, body)
+		require.NoError(t, err)
+		request.Header.Add("Content-Type", writer.FormDataContentType())
+		request.Header.Add("Content-MD5", digest)
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		return response
+	}
+	defer deleteFiles()
+
+	sum := md5.Sum([]byte("something else"))
+	response := upload(base64.StdEncoding.EncodeToString(sum[:]))
+	defer response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	sum = md5.Sum(files[0].content)
+	response = upload(base64.StdEncoding.EncodeToString(sum[:]))
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	readUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name)
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodHead, readUrl, nil)
+	require.NoError(t, err)
+	request.Header.Set("Accept-Encoding", "identity")
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	sha := sha256.Sum256(files[0].content)
+	require.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sha[:])+":", response.Header.Get("Repr-Digest"))
+}
+
+func TestFsMetadata(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	err := writer.WriteField("meta_owner", "ci")
+	require.NoError(t, err)
+	part, err := writer.CreateFormFile("file", files[0].name)
+	require.NoError(t, err)
+	_, err = part.Write(files[0].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodPost, createUrl, body)
+	require.NoError(t, err)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	request.Header.Add("X-Meta-Build", "42")
+	response, err := fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	defer deleteFiles()
+
+	readUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name)
+	require.NoError(t, err)
+	response, err = fileClient.Head(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, "42", response.Header.Get("X-Meta-Build"))
+	require.Equal(t, "ci", response.Header.Get("X-Meta-Owner"))
+
+	metadataUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name, "metadata")
+	require.NoError(t, err)
+	request, err = http.NewRequest(http.MethodPatch, metadataUrl, strings.NewReader(`{"build": "43", "owner": null}`))
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	listUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	response, err = fileClient.Get(listUrl + "?format=json")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	var list []struct {
+		Name     string            `json:"name"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&list)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, map[string]string{"build": "43"}, list[0].Metadata)
+}
+
+func TestFsSearch(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	search := func(query string) []string {
+		searchUrl, err := url.JoinPath(fileserverAddress, "search")
+		require.NoError(t, err)
+		response, err := fileClient.Get(searchUrl + "?" + query)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		var list []struct {
+			Name string `json:"name"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&list)
+		require.NoError(t, err)
+		names := []string{}
+		for _, f := range list {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	require.Equal(t, []string{files[0].name, files[1].name}, search("name=*.txt&content_type=text/*"))
+	require.Equal(t, []string{files[0].name}, search("min_size=10"))
+	require.Equal(t, []string{files[1].name}, search("regex=2"))
+	require.Empty(t, search("meta=build"))
+
+	metadataUrl, err := url.JoinPath(fileserverAddress, "files", files[1].name, "metadata")
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodPut, metadataUrl, strings.NewReader(`{"build": "42"}`))
+	require.NoError(t, err)
+	response, err := fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, []string{files[1].name}, search("meta=build=42"))
+
+	err = deleteFiles()
+	require.NoError(t, err)
+	require.Empty(t, search("name=*.txt"))
+}
+
+func TestFsSearchText(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	search := func(query string) []map[string]any {
+		searchUrl, err := url.JoinPath(fileserverAddress, "search", "text")
+		require.NoError(t, err)
+		response, err := fileClient.Get(searchUrl + "?q=" + url.QueryEscape(query))
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		var matches []map[string]any
+		err = json.NewDecoder(response.Body).Decode(&matches)
+		require.NoError(t, err)
+		return matches
+	}
+
+	matches := search("bye")
+	require.Len(t, matches, 1)
+	require.Equal(t, files[1].name, matches[0]["name"])
+	require.Equal(t, []any{map[string]any{"line": float64(2), "snippet": "Bye!"}}, matches[0]["lines"])
+
+	require.Len(t, search("gopher*"), 1)
+	require.Len(t, search(`"go gophers"`), 1)
+	require.Empty(t, search(`"gophers go"`))
+	require.Empty(t, search("hi gophers"))
+
+	err = deleteFiles()
+	require.NoError(t, err)
+	require.Empty(t, search("bye"))
+}
+
+func TestFsEvents(t *testing.T) {
+	name := fmt.Sprintf("events-%d.txt", time.Now().UnixNano())
+	eventsUrl, err := url.JoinPath(fileserverAddress, "events")
+	require.NoError(t, err)
+
+	// next returns the id and the type of the next event in the stream
+	next := func(reader *bufio.Reader) (string, string) {
+		id, event := "", ""
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				require.Contains(t, line, name)
+			case line == "" && id != "":
+				return id, event
+			}
+		}
+	}
+	stream := func(lastID string) *http.Response {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, eventsUrl+"?prefix=events-", nil)
+		require.NoError(t, err)
+		if lastID != "" {
+			request.Header.Set("Last-Event-ID", lastID)
+		}
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		require.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+		return response
+	}
+
+	response := stream("")
+	defer response.Body.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", name)
+	require.NoError(t, err)
+	_, err = part.Write(files[0].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	created, err := fileClient.Post(createUrl, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer created.Body.Close()
+	require.Equal(t, http.StatusCreated, created.StatusCode)
+
+	id, event := next(bufio.NewReader(response.Body))
+	require.Equal(t, "created", event)
+
+	deleteUrl, err := url.JoinPath(fileserverAddress, "files", name)
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodDelete, deleteUrl, nil)
+	require.NoError(t, err)
+	deleted, err := fileClient.Do(request)
+	require.NoError(t, err)
+	defer deleted.Body.Close()
+	require.Equal(t, http.StatusOK, deleted.StatusCode)
+
+	resumed := stream(id)
+	defer resumed.Body.Close()
+	_, event = next(bufio.NewReader(resumed.Body))
+	require.Equal(t, "deleted", event)
+}
+
+func TestFsChanges(t *testing.T) {
+	type change struct {
+		Seq   uint64 `json:"seq"`
+		Event string `json:"event"`
+		Name  string `json:"name"`
+	}
+	type page struct {
+		Changes []change `json:"changes"`
+		Next    uint64   `json:"next"`
+		Latest  uint64   `json:"latest"`
+	}
+	changes := func(since uint64) page {
+		changesUrl, err := url.JoinPath(fileserverAddress, "changes")
+		require.NoError(t, err)
+		response, err := fileClient.Get(fmt.Sprintf("%s?since=%d", changesUrl, since))
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		var p page
+		err = json.NewDecoder(response.Body).Decode(&p)
+		require.NoError(t, err)
+		return p
+	}
+
+	latest := changes(math.MaxUint64).Latest
+
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+	err = deleteFiles()
+	require.NoError(t, err)
+
+	p := changes(latest)
+	require.Equal(t, []change{
+		{Seq: latest + 1, Event: "created", Name: files[0].name},
+		{Seq: latest + 2, Event: "created", Name: files[1].name},
+		{Seq: latest + 3, Event: "deleted", Name: files[0].name},
+		{Seq: latest + 4, Event: "deleted", Name: files[1].name},
+	}, p.Changes)
+	require.Equal(t, latest+4, p.Next)
+	require.Empty(t, changes(p.Next).Changes)
+}
+
+func TestFsExportImport(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	exportUrl, err := url.JoinPath(fileserverAddress, "admin", "export")
+	require.NoError(t, err)
+	response, err := fileClient.Get(exportUrl + "?format=tar.gz&bucket=default")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	archive, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	require.NoError(t, err)
+	names := map[string]bool{}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names[header.Name] = true
+	}
+	for _, f := range files {
+		require.True(t, names["default/"+f.name])
+	}
+
+	err = deleteFiles()
+	require.NoError(t, err)
+
+	importUrl, err := url.JoinPath(fileserverAddress, "admin", "import")
+	require.NoError(t, err)
+	response, err = fileClient.Post(importUrl+"?conflict=skip", "application/gzip", bytes.NewReader(archive))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	readUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name)
+	require.NoError(t, err)
+	response, err = fileClient.Get(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, files[0].content, data)
+
+	response, err = fileClient.Post(importUrl, "application/gzip", bytes.NewReader(archive))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusConflict, response.StatusCode)
+}
+
+func TestFsArchive(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	archiveUrl, err := url.JoinPath(fileserverAddress, "archive")
+	require.NoError(t, err)
+	response, err := fileClient.Get(archiveUrl + "?name=" + files[0].name + "&name=" + files[1].name)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "attachment; filename=default.zip", response.Header.Get("Content-Disposition"))
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Len(t, zr.File, len(files))
+	for i, f := range files {
+		require.Equal(t, f.name, zr.File[i].Name)
+		entry, err := zr.File[i].Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(entry)
+		require.NoError(t, err)
+		require.Equal(t, f.content, content)
+	}
+
+	response, err = fileClient.Get(archiveUrl + "?name=missing.txt")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestFsExtract(t *testing.T) {
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	for _, name := range []string{"docs/a.txt", "docs/api/b.txt", "../evil.txt"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte("content of " + name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("extract", "true"))
+	require.NoError(t, writer.WriteField("dir", "site"))
+	part, err := writer.CreateFormFile("file", "site.zip")
+	require.NoError(t, err)
+	_, err = part.Write(archive.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	response, err := fileClient.Post(createUrl, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var report struct {
+		Extracted int `json:"extracted"`
+		Failed    int `json:"failed"`
+		Entries   []struct {
+			Entry  string `json:"entry"`
+			Name   string `json:"name"`
+			Status string `json:"status"`
+		} `json:"entries"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&report)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Extracted)
+	require.Equal(t, 1, report.Failed)
+	require.Equal(t, "site_docs_api_b.txt", report.Entries[1].Name)
+	require.Equal(t, "failed", report.Entries[2].Status)
+
+	for _, name := range []string{"site_docs_a.txt", "site_docs_api_b.txt"} {
+		fileUrl, err := url.JoinPath(fileserverAddress, "files", name)
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodDelete, fileUrl, nil)
+		require.NoError(t, err)
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+	}
+}
+
+func TestFsExtractDigestMismatch(t *testing.T) {
+	archive := &bytes.Buffer{}
+	tw := tar.NewWriter(archive)
+	content := []byte("extracted content")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "digest.txt", Mode: 0640, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("extract", "true"))
+	part, err := writer.CreateFormFile("file", "digest.tar")
+	require.NoError(t, err)
+	_, err = part.Write(archive.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodPost, createUrl, body)
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	sum := sha256.Sum256([]byte("another archive"))
+	request.Header.Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	response, err := fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	// nothing is extracted from an archive failing its digest
+	fileUrl, err := url.JoinPath(fileserverAddress, "files", "digest.txt")
+	require.NoError(t, err)
+	response, err = fileClient.Get(fileUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+// extractMaxSize matches the extract limit in tests/config/fileserver.yaml
+const extractMaxSize = 65536
+
+func TestFsExtractZipLimit(t *testing.T) {
+	extract := func(size int) *http.Response {
+		archive := &bytes.Buffer{}
+		zw := zip.NewWriter(archive)
+		for i, n := range []int{size / 2, size - size/2} {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("limit-%d.bin", i), Method: zip.Store})
+			require.NoError(t, err)
+			_, err = w.Write(bytes.Repeat([]byte{'x'}, n))
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		require.NoError(t, writer.WriteField("extract", "true"))
+		part, err := writer.CreateFormFile("file", "limit.zip")
+		require.NoError(t, err)
+		_, err = part.Write(archive.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		createUrl, err := url.JoinPath(fileserverAddress, "files")
+		require.NoError(t, err)
+		response, err := fileClient.Post(createUrl, writer.FormDataContentType(), body)
+		require.NoError(t, err)
+		return response
+	}
+
+	// a stored archive is larger than its content by its headers
+	response := extract(extractMaxSize)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	for i := range 2 {
+		fileUrl, err := url.JoinPath(fileserverAddress, "files", fmt.Sprintf("limit-%d.bin", i))
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodDelete, fileUrl, nil)
+		require.NoError(t, err)
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+	}
+
+	response = extract(extractMaxSize + 1)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+}
+
+func TestFsBatch(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	batchUrl, err := url.JoinPath(fileserverAddress, "batch")
+	require.NoError(t, err)
+	body := `{"operations": [
+		{"op": "copy", "name": "file1.txt", "destination": "file3.txt"},
+		{"op": "set-metadata", "name": "file2.txt", "metadata": {"owner": "gopher"}},
+		{"op": "delete", "name": "missing.txt"}]}`
+	response, err := fileClient.Post(batchUrl, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var report struct {
+		Succeeded int `json:"succeeded"`
+		Failed    int `json:"failed"`
+		Results   []struct {
+			Status int `json:"status"`
+		} `json:"results"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&report)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Succeeded)
+	require.Equal(t, 1, report.Failed)
+	require.Equal(t, http.StatusNotFound, report.Results[2].Status)
+
+	readUrl, err := url.JoinPath(fileserverAddress, "files", "file3.txt")
+	require.NoError(t, err)
+	response, err = fileClient.Get(readUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, files[0].content, data)
+
+	// the missing file fails the whole batch, file3.txt is kept
+	body = `{"atomic": true, "operations": [
+		{"op": "delete", "name": "file3.txt"},
+		{"op": "delete", "name": "missing.txt"}]}`
+	response, err = fileClient.Post(batchUrl, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusConflict, response.StatusCode)
+
+	body = `{"atomic": true, "operations": [{"op": "delete", "name": "file3.txt"}]}`
+	response, err = fileClient.Post(batchUrl, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	// each operation sees the files as the ones before it left them
+	body = `{"operations": [
+		{"op": "copy", "name": "file1.txt", "destination": "file3.txt"},
+		{"op": "move", "name": "file3.txt", "destination": "file4.txt"},
+		{"op": "delete", "name": "file4.txt"}]}`
+	response, err = fileClient.Post(batchUrl, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	err = json.NewDecoder(response.Body).Decode(&report)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Succeeded)
+	require.Equal(t, 0, report.Failed)
+}
+
+func TestFsCopyMove(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	sourceUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name)
+	require.NoError(t, err)
+	copyUrl, err := url.JoinPath(fileserverAddress, "files", "copy.txt")
+	require.NoError(t, err)
+	request, err := http.NewRequest("COPY", sourceUrl, nil)
+	require.NoError(t, err)
+	request.Header.Set("Destination", copyUrl)
+	response, err := fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	request, err = http.NewRequest("COPY", sourceUrl, nil)
+	require.NoError(t, err)
+	request.Header.Set("Destination", copyUrl)
+	request.Header.Set("Overwrite", "F")
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusPreconditionFailed, response.StatusCode)
+
+	response, err = fileClient.Post(copyUrl+"/move?destination=moved.txt", "", nil)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	response, err = fileClient.Get(copyUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	movedUrl, err := url.JoinPath(fileserverAddress, "files", "moved.txt")
+	require.NoError(t, err)
+	response, err = fileClient.Get(movedUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, files[0].content, data)
+
+	request, err = http.NewRequest(http.MethodDelete, movedUrl, nil)
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestFsVersionRestore(t *testing.T) {
+	bucket := fmt.Sprintf("versions-%d", time.Now().UnixNano())
+	bucketsUrl, err := url.JoinPath(fileserverAddress, "buckets")
+	require.NoError(t, err)
+	response, err := fileClient.Post(bucketsUrl, "application/json", strings.NewReader(
+		`{"name":"`+bucket+`","versioning":{"enabled":true,"max_versions":10}}`))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	defer func() {
+		request, err := http.NewRequest(http.MethodDelete, bucketsUrl+"/"+bucket+"?force=true", nil)
+		require.NoError(t, err)
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+	}()
+
+	filesUrl, err := url.JoinPath(bucketsUrl, bucket, "files")
+	require.NoError(t, err)
+	fileUrl, err := url.JoinPath(filesUrl, files[0].name)
+	require.NoError(t, err)
+	for i, method := range []string{http.MethodPost, http.MethodPut} {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", files[0].name)
+		require.NoError(t, err)
+		_, err = part.Write(files[i].content)
+		require.NoError(t, err)
+		err = writer.Close()
+		require.NoError(t, err)
+		target := filesUrl
+		if method == http.MethodPut {
+			target = fileUrl
+		}
+		request, err := http.NewRequest(method, target, body)
+		require.NoError(t, err)
+		request.Header.Add("Content-Type", writer.FormDataContentType())
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Less(t, response.StatusCode, 300)
+	}
+
+	response, err = fileClient.Get(fileUrl + "/versions")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var versions []struct {
+		ID     string `json:"id"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&versions)
+	require.NoError(t, err)
+	// versions are listed newest first, the oldest one holds the first upload
+	require.GreaterOrEqual(t, len(versions), 2)
+	oldest := versions[len(versions)-1]
+	sum := sha256.Sum256(files[0].content)
+	require.Equal(t, fmt.Sprintf("%x", sum), oldest.SHA256)
+
+	response, err = fileClient.Post(fileUrl+"/versions/"+oldest.ID+"/restore", "", nil)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	response, err = fileClient.Get(fileUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, files[0].content, data)
+
+	response, err = fileClient.Post(fileUrl+"/versions/unknown/restore", "", nil)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestFsTrashRestore(t *testing.T) {
+	name := fmt.Sprintf("trash-%d.txt", time.Now().UnixNano())
+	fileUrl, err := url.JoinPath(fileserverAddress, "files", name)
+	require.NoError(t, err)
+	trashUrl, err := url.JoinPath(fileserverAddress, "trash")
+	require.NoError(t, err)
+
+	// trashed returns the id of the trash entry holding the deleted file
+	trashed := func() string {
+		request, err := http.NewRequest(http.MethodDelete, fileUrl, nil)
+		require.NoError(t, err)
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+
+		response, err = fileClient.Get(trashUrl)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		var entries []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&entries)
+		require.NoError(t, err)
+		for _, e := range entries {
+			if e.Name == name {
+				require.Equal(t, int64(len(files[0].content)), e.Size)
+				return e.ID
+			}
+		}
+		require.Failf(t, "file not trashed", "%s is not listed in %v", name, entries)
+		return ""
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", name)
+	require.NoError(t, err)
+	_, err = part.Write(files[0].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	response, err := fileClient.Post(createUrl, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	id := trashed()
+	response, err = fileClient.Get(fileUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, err = fileClient.Post(trashUrl+"/"+id+"/restore", "", nil)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, name, strings.TrimSpace(string(data)))
+
+	response, err = fileClient.Get(fileUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	data, err = io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, files[0].content, data)
+
+	response, err = fileClient.Post(trashUrl+"/"+id+"/restore", "", nil)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	request, err := http.NewRequest(http.MethodDelete, trashUrl+"/"+trashed(), nil)
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+// webhookAddress and webhookSecret match the hook in tests/config/fileserver.yaml
+const (
+	webhookAddress = ":28090"
+	webhookSecret  = "webhook-secret"
+)
+
+func TestFsWebhook(t *testing.T) {
+	name := fmt.Sprintf("webhook-%d.txt", time.Now().UnixNano())
+	deleteUrl, err := url.JoinPath(fileserverAddress, "files", name)
+	require.NoError(t, err)
+	// a test failing halfway leaves no file behind for the others
+	defer func() {
+		request, err := http.NewRequest(http.MethodDelete, deleteUrl, nil)
+		if err != nil {
+			return
+		}
+		if response, err := fileClient.Do(request); err == nil {
+			response.Body.Close()
+		}
+	}()
+
+	type delivery struct {
+		Event     string `json:"event"`
+		Name      string `json:"name"`
+		Size      int64  `json:"size"`
+		header    string
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan delivery, 10)
+	listener, err := net.Listen("tcp", webhookAddress)
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.URL.Path != "/hooks" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		d := delivery{
+			header:    r.Header.Get("X-Fileserver-Event"),
+			signature: r.Header.Get("X-Fileserver-Signature"),
+			body:      body,
+		}
+		if err := json.Unmarshal(body, &d); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		deliveries <- d
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// next waits for the delivery of the next event of the file
+	next := func() delivery {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case d := <-deliveries:
+				if d.Name != name {
+					continue
+				}
+				mac := hmac.New(sha256.New, []byte(webhookSecret))
+				mac.Write(d.body)
+				require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), d.signature)
+				require.Equal(t, d.Event, d.header)
+				return d
+			case <-timeout:
+				require.FailNow(t, "no webhook delivered")
+			}
+		}
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", name)
+	require.NoError(t, err)
+	_, err = part.Write(files[0].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	response, err := fileClient.Post(createUrl, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	d := next()
+	require.Equal(t, "created", d.Event)
+	require.Equal(t, int64(len(files[0].content)), d.Size)
+
+	// the listener is kept until the deletion is delivered too
+	request, err := http.NewRequest(http.MethodDelete, deleteUrl, nil)
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "deleted", next().Event)
+}
+
+// replicaAddress is the replica of tests/compose.yaml the fileserver replicates to
+const replicaAddress = "http://localhost:28082"
+
+func TestFsReplication(t *testing.T) {
+	name := fmt.Sprintf("replication-%d.txt", time.Now().UnixNano())
+	deleteUrl, err := url.JoinPath(fileserverAddress, "files", name)
+	require.NoError(t, err)
+	// a test failing halfway leaves no file behind for the others
+	defer func() {
+		request, err := http.NewRequest(http.MethodDelete, deleteUrl, nil)
+		if err != nil {
+			return
+		}
+		if response, err := fileClient.Do(request); err == nil {
+			response.Body.Close()
+		}
+	}()
+	replicaUrl, err := url.JoinPath(replicaAddress, "files", name)
+	require.NoError(t, err)
+
+	// replicated waits until the replica serves the file with the status
+	// and the content expected
+	replicated := func(status int, content []byte) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			response, err := fileClient.Get(replicaUrl)
+			require.NoError(t, err)
+			data, err := io.ReadAll(response.Body)
+			response.Body.Close()
+			require.NoError(t, err)
+			if response.StatusCode == status && (content == nil || bytes.Equal(content, data)) {
+				return
+			}
+			require.True(t, time.Now().Before(deadline),
+				"replica answers %d %q", response.StatusCode, data)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", name)
+	require.NoError(t, err)
+	_, err = part.Write(files[0].content)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+	createUrl, err := url.JoinPath(fileserverAddress, "files")
+	require.NoError(t, err)
+	response, err := fileClient.Post(createUrl, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	replicated(http.StatusOK, files[0].content)
+
+	// the replica takes changes from the primary only
+	request, err := http.NewRequest(http.MethodDelete, replicaUrl, nil)
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	request, err = http.NewRequest(http.MethodDelete, deleteUrl, nil)
+	require.NoError(t, err)
+	response, err = fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	replicated(http.StatusNotFound, nil)
+}
+
+func TestFsQuota(t *testing.T) {
+	bucket := fmt.Sprintf("quota-%d", time.Now().UnixNano())
+	bucketsUrl, err := url.JoinPath(fileserverAddress, "buckets")
+	require.NoError(t, err)
+	response, err := fileClient.Post(bucketsUrl, "application/json", strings.NewReader(
+		`{"name":"`+bucket+`","quota":{"max_bytes":2000,"max_files":3,"max_file_size":1000}}`))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	defer func() {
+		request, err := http.NewRequest(http.MethodDelete, bucketsUrl+"/"+bucket+"?force=true", nil)
+		require.NoError(t, err)
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+	}()
+
+	filesUrl, err := url.JoinPath(bucketsUrl, bucket, "files")
+	require.NoError(t, err)
+	// upload sends size bytes as the file name and returns the status
+	upload := func(method, name string, size int) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", name)
+		require.NoError(t, err)
+		_, err = part.Write(bytes.Repeat([]byte("q"), size))
+		require.NoError(t, err)
+		err = writer.Close()
+		require.NoError(t, err)
+		target := filesUrl
+		if method == http.MethodPut {
+			target += "/" + name
+		}
+		request, err := http.NewRequest(method, target, body)
+		require.NoError(t, err)
+		request.Header.Add("Content-Type", writer.FormDataContentType())
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	require.Equal(t, http.StatusRequestEntityTooLarge, upload(http.MethodPost, "a.bin", 1001))
+	require.Equal(t, http.StatusCreated, upload(http.MethodPost, "a.bin", 900))
+	require.Equal(t, http.StatusCreated, upload(http.MethodPost, "b.bin", 900))
+	require.Equal(t, http.StatusInsufficientStorage, upload(http.MethodPost, "c.bin", 400))
+	require.Equal(t, http.StatusCreated, upload(http.MethodPost, "c.bin", 10))
+	require.Equal(t, http.StatusInsufficientStorage, upload(http.MethodPost, "d.bin", 10))
+
+	// a replaced file leaves room for its successor
+	require.Equal(t, http.StatusOK, upload(http.MethodPut, "a.bin", 900))
+	require.Equal(t, http.StatusOK, upload(http.MethodPut, "a.bin", 950))
+	require.Equal(t, http.StatusRequestEntityTooLarge, upload(http.MethodPut, "a.bin", 1001))
+	require.Equal(t, http.StatusInsufficientStorage, upload(http.MethodPut, "c.bin", 400))
+
+	response, err = fileClient.Get(filesUrl + "/a.bin")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	data, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Len(t, data, 950)
+}
+
+func TestFsCopyPreconditions(t *testing.T) {
+	defer deleteFiles()
+	err := createFiles()
+	require.NoError(t, err)
+
+	sourceUrl, err := url.JoinPath(fileserverAddress, "files", files[0].name)
+	require.NoError(t, err)
+	request, err := http.NewRequest(http.MethodGet, sourceUrl, nil)
+	require.NoError(t, err)
+	request.Header.Set("Accept-Encoding", "identity")
+	response, err := fileClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	sum := sha256.Sum256(files[0].content)
+	etag := fmt.Sprintf(`"%x"`, sum)
+	require.Equal(t, etag, response.Header.Get("ETag"))
+
+	copyUrl, err := url.JoinPath(fileserverAddress, "files", "copy-preconditions.txt")
+	require.NoError(t, err)
+	defer func() {
+		request, err := http.NewRequest(http.MethodDelete, copyUrl, nil)
+		require.NoError(t, err)
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+	}()
+	// transfer copies the source with the conditional headers and returns the status
+	transfer := func(headers map[string]string) int {
+		request, err := http.NewRequest("COPY", sourceUrl, nil)
+		require.NoError(t, err)
+		request.Header.Set("Destination", copyUrl)
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		response, err := fileClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	require.Equal(t, http.StatusPreconditionFailed, transfer(map[string]string{"If-Match": `"0000"`}))
+	response, err = fileClient.Get(copyUrl)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	require.Equal(t, http.StatusCreated, transfer(map[string]string{"If-Match": `"0000", ` + etag}))
+	require.Equal(t, http.StatusPreconditionFailed, transfer(map[string]string{"If-Match": etag, "If-None-Match": "*"}))
+	require.Equal(t, http.StatusPreconditionFailed, transfer(map[string]string{"If-None-Match": "W/" + etag}))
+	require.Equal(t, http.StatusPreconditionFailed, transfer(map[string]string{
+		"If-Unmodified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}))
+	require.Equal(t, http.StatusNoContent, transfer(map[string]string{"If-Match": etag, "If-None-Match": `"0000"`}))
+}